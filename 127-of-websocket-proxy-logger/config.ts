@@ -10,17 +10,32 @@
 
 /**
  * The JWT token required for authenticating with the WebSocket Proxy service.
- * Set to `null` if your WebSocket proxy does not require JWT authentication.
+ * The proxy rejects connections without a valid token. With JWT_SECRET set on the proxy,
+ * issue one with:
  *
- * @example "your-super-secret-jwt-token"
- * @example null
+ *   go_app_binary -issue-token user-1            (inside the Docker container: /app/go_app_binary)
+ *
+ * and paste the printed token here. The user ID must match the one your API key maps to
+ * ("user-1" for AUTH_API_KEY). Tokens expire (default 30 days, see -token-ttl).
+ *
+ * @example "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9..."
  */
-export const JWT_TOKEN: string | null = "valid-token-user-1";
+export const JWT_TOKEN: string | null = null;
 
 /**
  * The full URL of your WebSocket Proxy service.
  *
  * @example "ws://127.0.0.1:5345/v1/ws"
  * @example "wss://your-proxy.example.com/v1/ws"
+ * @example "ws://127.0.0.1:5345/v1/ws?weight=3" (weight for the "weighted" balancer strategy)
  */
 export const WEBSOCKET_PROXY_URL: string = "ws://127.0.0.1:5345/v1/ws";
+
+/**
+ * Optional label sent to the proxy in the hello handshake, shown in the proxy logs
+ * to tell browser tabs apart (for example the Google account this tab uses).
+ *
+ * @example "alice@gmail.com"
+ * @example null
+ */
+export const ACCOUNT_LABEL: string | null = null;
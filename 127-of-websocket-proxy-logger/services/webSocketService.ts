@@ -3,20 +3,31 @@ import {
   WSServerSentMessage,
   WSClientSentMessage,
   WSHttpRequestMessage,
+  WSCancelMessage,
+  WSCreditMessage,
   WSHttpResponseMessage,
   WSStreamStartMessage,
   WSStreamChunkMessage,
   WSStreamEndMessage,
   WSErrorMessage,
   WSPingMessage,
+  WSBodyEncoding,
+  WSFetchTiming,
+  WSHelloMessage,
+  WSServerHelloMessage,
+  WSHandshakeErrorMessage,
+  WS_PROTOCOL_VERSION,
 } from "../types";
-import { WEBSOCKET_PROXY_URL } from "../config"; // Import from new config file
+import { WEBSOCKET_PROXY_URL, ACCOUNT_LABEL } from "../config"; // Import from new config file
 
 const BASE_WEBSOCKET_URL = WEBSOCKET_PROXY_URL; // Use imported constant
 const PING_INTERVAL_MS = 25 * 1000; // 25 seconds
 const RECONNECT_INITIAL_DELAY_MS = 1000;
 const RECONNECT_MAX_DELAY_MS = 30 * 1000;
 const RECONNECT_JITTER_MS = 500;
+const CLIENT_BUILD = "127-of-websocket-proxy-logger/1.1.0";
+// Protocol features this client implements, announced in the hello handshake.
+const CLIENT_FEATURES = ["cancel", "flow_control", "base64_body"];
 
 // Numeric constants for WebSocket readyState
 const WS_CONNECTING = 0;
@@ -34,6 +45,8 @@ let reconnectTimeoutId: number | null = null;
 let currentReconnectDelay = RECONNECT_INITIAL_DELAY_MS;
 let explicitClose = false;
 let currentJwtToken: string | null = null;
+// Set when the server rejects the handshake in a way reconnecting cannot fix.
+let fatalError: string | null = null;
 
 function updateStatus(newStatus: WebSocketProxyStatus, details?: string) {
   if (currentStatus === newStatus && !details) return;
@@ -67,8 +80,113 @@ function sendToServer(message: WSClientSentMessage) {
   }
 }
 
+const BASE64_CHUNK_SIZE = 0x8000;
+
+function bytesToBase64(bytes: Uint8Array): string {
+  let binary = "";
+  for (let i = 0; i < bytes.length; i += BASE64_CHUNK_SIZE) {
+    binary += String.fromCharCode(...bytes.subarray(i, i + BASE64_CHUNK_SIZE));
+  }
+  return btoa(binary);
+}
+
+function base64ToBytes(data: string): Uint8Array {
+  const binary = atob(data);
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i);
+  }
+  return bytes;
+}
+
+// Text responses (JSON, SSE, ...) are streamed as UTF-8 strings so they stay
+// readable in the server logs; anything else is sent as base64.
+function isUtf8TextContentType(contentType: string | null): boolean {
+  if (!contentType) return false;
+  const [mimeType, ...params] = contentType.toLowerCase().split(";");
+  const charset = params
+    .map((p) => p.trim())
+    .find((p) => p.startsWith("charset="));
+  if (charset && !/^charset="?utf-?8"?$/.test(charset)) return false;
+  const type = mimeType.trim();
+  return (
+    type.startsWith("text/") ||
+    type === "application/json" ||
+    type.endsWith("+json") ||
+    type === "application/javascript" ||
+    type === "application/xml" ||
+    type.endsWith("+xml")
+  );
+}
+
+// Stream chunks the server is ready to accept for one request ("flow_control").
+// The reader loop waits here instead of reading further from the response body,
+// so a slow HTTP client pauses this fetch rather than losing data.
+class StreamCredits {
+  private available: number;
+  private wake: (() => void) | null = null;
+
+  constructor(window: number) {
+    this.available = window;
+  }
+
+  grant(chunks: number) {
+    this.available += chunks;
+    this.wake?.();
+    this.wake = null;
+  }
+
+  async take(signal: AbortSignal) {
+    while (this.available <= 0) {
+      await new Promise<void>((resolve, reject) => {
+        const onAbort = () => reject(signal.reason);
+        if (signal.aborted) return onAbort();
+        signal.addEventListener("abort", onAbort, { once: true });
+        this.wake = () => {
+          signal.removeEventListener("abort", onAbort);
+          resolve();
+        };
+      });
+    }
+    this.available--;
+  }
+}
+
+interface ActiveRequest {
+  controller: AbortController;
+  credits: StreamCredits | null; // null when the server did not ask for flow control
+}
+
+// In-flight fetches by request id, aborted when the server sends "cancel".
+const activeRequests = new Map<string, ActiveRequest>();
+
+function handleCancel(message: WSCancelMessage) {
+  const active = activeRequests.get(message.id);
+  if (!active) return; // already finished
+  console.log(
+    `WebSocket Proxy: Aborting request ID ${message.id} (${message.payload?.reason})`,
+  );
+  active.controller.abort();
+}
+
+function handleCredit(message: WSCreditMessage) {
+  activeRequests.get(message.id)?.credits?.grant(message.payload.chunks);
+}
+
+// The server fails every in-flight request when the socket closes, so there is
+// nobody left to deliver their responses to.
+function abortAllRequests() {
+  activeRequests.forEach(({ controller }) => controller.abort());
+  activeRequests.clear();
+}
+
 async function handleHttpRequest(request: WSHttpRequestMessage) {
   const { id, payload } = request;
+  const controller = new AbortController();
+  const creditWindow = payload.flow_control?.window;
+  const credits =
+    creditWindow && creditWindow > 0 ? new StreamCredits(creditWindow) : null;
+  activeRequests.set(id, { controller, credits });
   let { method, url, headers, body } = payload;
 
   if (method === "GET") {
@@ -97,16 +215,23 @@ async function handleHttpRequest(request: WSHttpRequestMessage) {
   const fetchOptions: RequestInit = {
     method,
     headers,
+    signal: controller.signal,
   };
 
   if (method !== "GET" && method !== "HEAD") {
     if (body !== undefined && body !== null) {
-      fetchOptions.body = body;
+      fetchOptions.body =
+        payload.encoding === "base64" ? base64ToBytes(body) : body;
     }
   }
 
   try {
+    const fetchStart = Date.now();
     const response = await fetch(url, fetchOptions);
+    // Only reported when the server is tracing this request
+    const timing: WSFetchTiming | undefined = payload.traceparent
+      ? { fetch_start: fetchStart, response_start: Date.now() }
+      : undefined;
 
     const responseHeaders: Record<string, string> = {};
     response.headers.forEach((value, key) => {
@@ -117,28 +242,32 @@ async function handleHttpRequest(request: WSHttpRequestMessage) {
       const streamStartMessage: WSStreamStartMessage = {
         id,
         type: "stream_start",
-        payload: { status: response.status, headers: responseHeaders },
+        payload: { status: response.status, headers: responseHeaders, timing },
       };
       sendToServer(streamStartMessage);
 
       const reader = response.body.getReader();
       const decoder = new TextDecoder();
+      const isText = isUtf8TextContentType(response.headers.get("content-type"));
 
       // eslint-disable-next-line no-constant-condition
       while (true) {
         const { done, value } = await reader.read();
         if (done) break;
+        await credits?.take(controller.signal);
 
-        const chunkData = decoder.decode(value, { stream: true });
         const streamChunkMessage: WSStreamChunkMessage = {
           id,
           type: "stream_chunk",
-          payload: { data: chunkData },
+          payload: isText
+            ? { data: decoder.decode(value, { stream: true }) }
+            : { data: bytesToBase64(value), encoding: "base64" },
         };
         sendToServer(streamChunkMessage);
       }
-      const finalChunk = decoder.decode();
+      const finalChunk = isText ? decoder.decode() : "";
       if (finalChunk) {
+        await credits?.take(controller.signal);
         const streamChunkMessage: WSStreamChunkMessage = {
           id,
           type: "stream_chunk",
@@ -154,22 +283,39 @@ async function handleHttpRequest(request: WSHttpRequestMessage) {
       };
       sendToServer(streamEndMessage);
     } else {
-      const responseBodyText = await response.text();
+      const responseBytes = new Uint8Array(await response.arrayBuffer());
+      let responseBody: string;
+      let encoding: WSBodyEncoding = "utf8";
+      try {
+        responseBody = new TextDecoder("utf-8", { fatal: true }).decode(
+          responseBytes,
+        );
+      } catch {
+        responseBody = bytesToBase64(responseBytes);
+        encoding = "base64";
+      }
       const httpResponseMessage: WSHttpResponseMessage = {
         id,
         type: "http_response",
         payload: {
           status: response.status,
           headers: responseHeaders,
-          body: responseBodyText,
+          body: responseBody,
+          encoding,
+          timing,
         },
       };
       console.log(
-        `WebSocket Proxy: Sending http_response for request ID ${id}, status: ${response.status}, body length: ${responseBodyText.length}`,
+        `WebSocket Proxy: Sending http_response for request ID ${id}, status: ${response.status}, body length: ${responseBytes.length} (${encoding})`,
       );
       sendToServer(httpResponseMessage);
     }
   } catch (error) {
+    if (controller.signal.aborted) {
+      // Cancelled by the server: it no longer expects any message for this id.
+      console.log(`WebSocket Proxy: Request ID ${id} aborted`);
+      return;
+    }
     console.error(
       `WebSocket Proxy: Fetch error for request ID ${id} (${method} ${url}):`,
       error,
@@ -191,11 +337,31 @@ async function handleHttpRequest(request: WSHttpRequestMessage) {
       };
     }
     sendToServer(errorMessage);
+  } finally {
+    activeRequests.delete(id);
   }
 }
 
 function onSocketOpen() {
-  updateStatus(WebSocketProxyStatus.CONNECTED);
+  // Requests are only routed here once the server has answered the hello.
+  const helloMessage: WSHelloMessage = {
+    type: "hello",
+    payload: {
+      protocol_version: WS_PROTOCOL_VERSION,
+      client_build: CLIENT_BUILD,
+      features: CLIENT_FEATURES,
+      ...(ACCOUNT_LABEL ? { account_label: ACCOUNT_LABEL } : {}),
+    },
+  };
+  sendToServer(helloMessage);
+}
+
+function handleServerHello(message: WSServerHelloMessage) {
+  const { protocol_version, features } = message.payload;
+  updateStatus(
+    WebSocketProxyStatus.CONNECTED,
+    `Server protocol v${protocol_version}, features: ${features.join(", ") || "none"}`,
+  );
   currentReconnectDelay = RECONNECT_INITIAL_DELAY_MS;
   if (reconnectTimeoutId) {
     clearTimeout(reconnectTimeoutId);
@@ -209,9 +375,27 @@ function onSocketMessage(event: MessageEvent) {
     const message = JSON.parse(event.data as string) as WSServerSentMessage;
 
     switch (message.type) {
+      case "hello":
+        handleServerHello(message as WSServerHelloMessage);
+        break;
+      case "error": {
+        const { code, message: reason } = (message as WSHandshakeErrorMessage)
+          .payload;
+        console.error(`WebSocket Proxy: Handshake rejected (${code}): ${reason}`);
+        if (code === "UNSUPPORTED_PROTOCOL") {
+          fatalError = `${reason}. Update this app to a version the proxy supports.`;
+        }
+        break;
+      }
       case "http_request":
         handleHttpRequest(message as WSHttpRequestMessage);
         break;
+      case "cancel":
+        handleCancel(message as WSCancelMessage);
+        break;
+      case "credit":
+        handleCredit(message as WSCreditMessage);
+        break;
       case "pong":
         break;
       default:
@@ -232,11 +416,14 @@ function onSocketError(event: Event) {
 
 function onSocketClose(event: CloseEvent) {
   stopPing();
+  abortAllRequests();
   if (reconnectTimeoutId) {
     return;
   }
 
-  if (explicitClose) {
+  if (fatalError) {
+    updateStatus(WebSocketProxyStatus.ERROR, fatalError);
+  } else if (explicitClose) {
     updateStatus(
       WebSocketProxyStatus.IDLE,
       `Connection closed by client. Code: ${event.code}`,
@@ -324,10 +511,14 @@ function connect(jwtToken: string) {
   }
 
   explicitClose = false;
+  fatalError = null;
   updateStatus(WebSocketProxyStatus.CONNECTING);
 
   // Use BASE_WEBSOCKET_URL which is now derived from config.ts
-  const wsUrl = `${BASE_WEBSOCKET_URL}?auth_token=${jwtToken}`;
+  // WEBSOCKET_PROXY_URL may already carry query parameters (e.g. ?weight=3)
+  const url = new URL(BASE_WEBSOCKET_URL);
+  url.searchParams.set("auth_token", jwtToken);
+  const wsUrl = url.toString();
   console.log(`WebSocket Proxy: Attempting to connect to ${wsUrl}`);
 
   try {
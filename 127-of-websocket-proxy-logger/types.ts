@@ -16,15 +16,46 @@ export enum WebSocketProxyStatus {
   ERROR = 'ERROR', // Connection error or other WebSocket error
 }
 
+// Encoding of a body string (http_request/http_response "body", stream_chunk "data").
+// "utf8" (the default when omitted) is the text itself; "base64" is used for binary data.
+export type WSBodyEncoding = "utf8" | "base64";
+
+// Protocol version implemented by this client; the server rejects versions it
+// does not support during the hello handshake.
+export const WS_PROTOCOL_VERSION = 1;
+
 // Messages sent from Client (this app) to WebSocket Server
+
+// First message on every connection. The server does not route requests to the
+// connection until it has accepted the hello.
+export interface WSHelloPayload {
+  protocol_version: number;
+  client_build: string;
+  account_label?: string; // which Google account this tab is logged in with
+  features: string[]; // e.g. "cancel", "flow_control", "base64_body"
+}
+export interface WSHelloMessage {
+  type: "hello";
+  payload: WSHelloPayload;
+}
+
 export interface WSPingMessage {
   type: "ping";
 }
 
+// Browser-side fetch timings (Unix milliseconds), reported when the request
+// carried a traceparent so the server can add them to the trace.
+export interface WSFetchTiming {
+  fetch_start: number;
+  response_start: number; // when the response headers arrived
+}
+
 export interface WSHttpResponsePayload {
   status: number;
   headers: Record<string, string>;
-  body: string; // response.text()
+  body: string; // response text, or base64 when encoding is "base64"
+  encoding?: WSBodyEncoding;
+  timing?: WSFetchTiming;
 }
 export interface WSHttpResponseMessage {
   id: string; // from the original http_request
@@ -35,6 +66,7 @@ export interface WSHttpResponseMessage {
 export interface WSStreamStartPayload {
   status: number;
   headers: Record<string, string>;
+  timing?: WSFetchTiming;
 }
 export interface WSStreamStartMessage {
   id: string; // from the original http_request
@@ -43,7 +75,8 @@ export interface WSStreamStartMessage {
 }
 
 export interface WSStreamChunkPayload {
-  data: string; // decoded chunk
+  data: string; // decoded chunk, or base64 when encoding is "base64"
+  encoding?: WSBodyEncoding;
 }
 export interface WSStreamChunkMessage {
   id: string; // from the original http_request
@@ -73,7 +106,7 @@ export interface WSErrorMessage {
   payload: WSErrorPayload;
 }
 
-export type WSClientSentMessage = WSPingMessage | WSHttpResponseMessage | WSStreamStartMessage | WSStreamChunkMessage | WSStreamEndMessage | WSErrorMessage;
+export type WSClientSentMessage = WSHelloMessage | WSPingMessage | WSHttpResponseMessage | WSStreamStartMessage | WSStreamChunkMessage | WSStreamEndMessage | WSErrorMessage;
 
 
 // Messages received by Client (this app) from WebSocket Server
@@ -81,7 +114,14 @@ export interface WSHttpRequestPayload {
   method: string; // "GET", "POST", etc.
   url: string;
   headers: Record<string, string>;
-  body?: string; // Should be a JSON string if present
+  body?: string; // Usually a JSON string; base64 when encoding is "base64" (e.g. file uploads)
+  encoding?: WSBodyEncoding;
+  // When present, send at most `window` stream_chunk messages before the first
+  // "credit" message, and afterwards only as many as the credits granted.
+  flow_control?: { window: number };
+  // W3C trace context of the server's dispatch span, present when the server
+  // exports traces. Not forwarded to Google.
+  traceparent?: string;
 }
 export interface WSHttpRequestMessage {
   id: string; // Unique request ID
@@ -89,8 +129,52 @@ export interface WSHttpRequestMessage {
   payload: WSHttpRequestPayload;
 }
 
+// Sent when the HTTP client behind a request went away or the server timed it out.
+// The browser must abort the fetch for this id and send nothing more for it
+// (no stream_chunk, stream_end or error); late messages are dropped by the server.
+export interface WSCancelPayload {
+  reason: string; // "client disconnected" or "timeout"
+}
+export interface WSCancelMessage {
+  id: string; // from the original http_request
+  type: "cancel";
+  payload: WSCancelPayload;
+}
+
+// Grants more stream_chunk messages for a request that uses flow_control.
+export interface WSCreditPayload {
+  chunks: number;
+}
+export interface WSCreditMessage {
+  id: string; // from the original http_request
+  type: "credit";
+  payload: WSCreditPayload;
+}
+
+// The server's reply to a compatible hello.
+export interface WSServerHelloPayload {
+  protocol_version: number;
+  min_protocol_version: number;
+  features: string[];
+  stream_credit_window: number;
+}
+export interface WSServerHelloMessage {
+  type: "hello";
+  payload: WSServerHelloPayload;
+}
+
+// Sent without an id right before the server closes a connection whose hello
+// was rejected.
+export interface WSHandshakeErrorMessage {
+  type: "error";
+  payload: {
+    code: "UNSUPPORTED_PROTOCOL" | "HANDSHAKE_FAILED";
+    message: string;
+  };
+}
+
 export interface WSPongMessage {
   type: "pong";
 }
 
-export type WSServerSentMessage = WSHttpRequestMessage | WSPongMessage;
+export type WSServerSentMessage = WSServerHelloMessage | WSHandshakeErrorMessage | WSHttpRequestMessage | WSCancelMessage | WSCreditMessage | WSPongMessage;
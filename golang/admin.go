@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- 连接管理接口 ---
+// 需要设置 ADMIN_API_KEY，请求头携带 "Authorization: Bearer <key>" 或 "X-Admin-Key: <key>"：
+//
+//	GET  /api/admin/connections                  列出所有浏览器连接
+//	POST /api/admin/connections/{id}/disconnect  关闭连接（浏览器端会自动重连，得到新的连接ID）
+//	POST /api/admin/connections/{id}/drain       不再向该连接分配新请求，正在处理的请求继续完成
+//	POST /api/admin/connections/{id}/resume      取消 drain
+
+// 管理密钥为配置项 auth.admin_api_key（环境变量 ADMIN_API_KEY，见 config.go）
+const adminConnectionsPath = "/api/admin/connections"
+
+// connectionInfo 是 GET /api/admin/connections 返回的单个连接
+type connectionInfo struct {
+	ID            string     `json:"id"`
+	UserID        string     `json:"user_id"`
+	RemoteAddr    string     `json:"remote_addr"`
+	ConnectedAt   time.Time  `json:"connected_at"`
+	LastActive    time.Time  `json:"last_active"`
+	InFlight      int        `json:"in_flight"`
+	TotalRequests int64      `json:"total_requests"`
+	Draining      bool       `json:"draining"`
+	Weight        int        `json:"weight"`
+	Client        ClientInfo `json:"client"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+}
+
+func describeConnection(uc *UserConnection) connectionInfo {
+	info := connectionInfo{
+		ID:            uc.ID,
+		UserID:        uc.UserID,
+		RemoteAddr:    uc.Conn.RemoteAddr().String(),
+		ConnectedAt:   uc.ConnectedAt,
+		LastActive:    uc.LastActive(),
+		InFlight:      uc.InFlight(),
+		TotalRequests: uc.totalRequests.Load(),
+		Draining:      uc.draining.Load(),
+		Weight:        uc.Weight,
+		Client:        uc.Client,
+	}
+	if msg, at := uc.LastError(); msg != "" {
+		info.LastError = msg
+		info.LastErrorAt = &at
+	}
+	return info
+}
+
+// authorizeAdmin 校验管理密钥，失败时写出错误响应
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminAPIKey := currentConfig().Auth.AdminAPIKey
+	if adminAPIKey == "" {
+		writeAdminError(w, http.StatusForbidden, "admin API is disabled: set ADMIN_API_KEY")
+		return false
+	}
+	key := r.Header.Get("X-Admin-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(adminAPIKey)) != 1 {
+		writeAdminError(w, http.StatusUnauthorized, "invalid admin key")
+		return false
+	}
+	return true
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// handleAdminConnections 处理 /api/admin/connections 及其子路径
+func handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, adminConnectionsPath), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		listConnections(w)
+		return
+	}
+
+	id, action, ok := strings.Cut(rest, "/")
+	if !ok || strings.Contains(action, "/") {
+		writeAdminError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	uc := globalPool.findConnection(id)
+	if uc == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("connection %q not found", id))
+		return
+	}
+
+	switch action {
+	case "disconnect":
+		adminLog(uc, "disconnecting")
+		globalPool.RemoveConnection(uc.UserID, uc.Conn)
+		closeUserConnection(uc, websocket.CloseNormalClosure, "disconnected by admin")
+	case "drain":
+		uc.draining.Store(true)
+		adminLog(uc, "draining, no new requests")
+	case "resume":
+		uc.draining.Store(false)
+		adminLog(uc, "accepting new requests")
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("unknown action %q", action))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(describeConnection(uc))
+}
+
+func listConnections(w http.ResponseWriter) {
+	conns := globalPool.allConnections()
+	infos := make([]connectionInfo, 0, len(conns))
+	for _, uc := range conns {
+		infos = append(infos, describeConnection(uc))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].UserID != infos[j].UserID {
+			return infos[i].UserID < infos[j].UserID
+		}
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"connections": infos,
+		"count":       len(infos),
+	})
+}
+
+func adminLog(uc *UserConnection, action string) {
+	logMsg := fmt.Sprintf("[ADMIN] Connection %s (user %s, %s): %s", uc.ID, uc.UserID, uc.Conn.RemoteAddr(), action)
+	log.Println(logMsg)
+	addLog("INFO", logMsg, map[string]interface{}{
+		"user_id":       uc.UserID,
+		"connection_id": uc.ID,
+		"connection":    uc.Conn.RemoteAddr().String(),
+		"in_flight":     uc.InFlight(),
+	})
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// --- Anthropic Messages API 兼容层 ---
+// 将 /v1/messages 请求转换为 Gemini 请求，经由 dispatchUpstream / processWebSocketResponse
+// 走同一条浏览器隧道，再把 Gemini 响应转换回 Anthropic 格式（含 SSE 事件流）。
+
+type anthropicRequest struct {
+	Model      string             `json:"model"`
+	MaxTokens  *int               `json:"max_tokens,omitempty"`
+	System     json.RawMessage    `json:"system,omitempty"`
+	Messages   []anthropicMessage `json:"messages"`
+	Tools      []anthropicTool    `json:"tools,omitempty"`
+	ToolChoice *struct {
+		Type string `json:"type"` // auto, any, tool, none
+		Name string `json:"name,omitempty"`
+	} `json:"tool_choice,omitempty"`
+	Stream        bool     `json:"stream"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"top_p,omitempty"`
+	TopK          *int     `json:"top_k,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	Thinking      *struct {
+		Type         string `json:"type"` // enabled, disabled
+		BudgetTokens int    `json:"budget_tokens"`
+	} `json:"thinking,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type anthropicContentBlock struct {
+	Type string `json:"type"`
+	// text
+	Text string `json:"text,omitempty"`
+	// image / document
+	Source *struct {
+		Type      string `json:"type"` // base64, url
+		MediaType string `json:"media_type,omitempty"`
+		Data      string `json:"data,omitempty"`
+		URL       string `json:"url,omitempty"`
+	} `json:"source,omitempty"`
+	// thinking
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	// tool_use
+	ID    string                 `json:"id,omitempty"`
+	Name  string                 `json:"name,omitempty"`
+	Input map[string]interface{} `json:"input,omitempty"`
+	// tool_result
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"input_schema,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens,omitempty"`
+}
+
+type anthropicResponse struct {
+	ID           string                   `json:"id"`
+	Type         string                   `json:"type"`
+	Role         string                   `json:"role"`
+	Model        string                   `json:"model"`
+	Content      []map[string]interface{} `json:"content"`
+	StopReason   *string                  `json:"stop_reason"`
+	StopSequence *string                  `json:"stop_sequence"`
+	Usage        anthropicUsage           `json:"usage"`
+}
+
+func handleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	apiKey, err := authenticateHTTPRequest(r)
+	if err != nil {
+		writeAnthropicError(w, http.StatusUnauthorized, "Proxy authentication failed")
+		return
+	}
+
+	var req anthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Model == "" {
+		writeAnthropicError(w, http.StatusBadRequest, "model: Field required")
+		return
+	}
+
+	geminiReq, err := convertAnthropicRequest(&req)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	bodyBytes, err := json.Marshal(geminiReq)
+	if err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, "Failed to build Gemini request")
+		return
+	}
+
+	reqID := uuid.NewString()
+	addLog("INFO", fmt.Sprintf("[ANTHROPIC %s] messages model=%s stream=%v", reqID, req.Model, req.Stream), map[string]interface{}{
+		"request_id":        reqID,
+		"user_id":           apiKey.UserID,
+		"key_label":         apiKey.Label,
+		"model":             req.Model,
+		"stream":            req.Stream,
+		"message_count":     len(req.Messages),
+		"tool_count":        len(req.Tools),
+		"anthropic_request": &req,
+	})
+
+	tw := newTranslatingWriter(w, newAnthropicTranslator(req.Model), req.Stream)
+	upstream := &upstreamRequest{
+		ID:       reqID,
+		UserID:   apiKey.UserID,
+		KeyLabel: apiKey.Label,
+		Route:    r.URL.Path,
+		Model:    req.Model,
+		Method:   http.MethodPost,
+		Path:     geminiModelPath(req.Model, req.Stream),
+		Headers:  map[string][]string{"Content-Type": {"application/json"}},
+	}
+	// 转换结果同样需要经过原生路径上的请求转换器（例如清理工具 schema 中不支持的字段）
+	upstream.Body = applyRequestTransformers(r.Context(), upstream.transformContext(), bodyBytes)
+	dispatchUpstream(tw, r, upstream)
+	tw.finish()
+}
+
+// convertAnthropicRequest 将 Anthropic Messages 请求转换为 Gemini 请求
+func convertAnthropicRequest(req *anthropicRequest) (*geminiRequest, error) {
+	out := &geminiRequest{Contents: []geminiContent{}}
+
+	if len(req.System) > 0 && string(req.System) != "null" {
+		parts, err := anthropicBlocksToParts(req.System, nil)
+		if err != nil {
+			return nil, fmt.Errorf("system: %v", err)
+		}
+		if len(parts) > 0 {
+			out.SystemInstruction = &geminiContent{Parts: parts}
+		}
+	}
+
+	// tool_use id -> 函数名，tool_result 只携带 id
+	toolNames := make(map[string]string)
+	for i, msg := range req.Messages {
+		var role string
+		switch msg.Role {
+		case "user":
+			role = "user"
+		case "assistant":
+			role = "model"
+		default:
+			return nil, fmt.Errorf("messages.%d.role: unsupported role %q", i, msg.Role)
+		}
+		parts, err := anthropicBlocksToParts(msg.Content, toolNames)
+		if err != nil {
+			return nil, fmt.Errorf("messages.%d.content: %v", i, err)
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		merge := len(out.Contents) > 0 && out.Contents[len(out.Contents)-1].Role == role
+		out.Contents = appendGeminiContent(out.Contents, role, merge, parts)
+	}
+
+	if len(req.Tools) > 0 {
+		decls := make([]geminiFunctionDeclaration, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			decls = append(decls, geminiFunctionDeclaration{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.InputSchema,
+			})
+		}
+		out.Tools = []geminiTool{{FunctionDeclarations: decls}}
+	}
+
+	if tc := req.ToolChoice; tc != nil {
+		fcc := &geminiFunctionCallingConfig{}
+		switch tc.Type {
+		case "auto":
+			fcc.Mode = "AUTO"
+		case "any":
+			fcc.Mode = "ANY"
+		case "none":
+			fcc.Mode = "NONE"
+		case "tool":
+			fcc.Mode = "ANY"
+			fcc.AllowedFunctionNames = []string{tc.Name}
+		default:
+			return nil, fmt.Errorf("tool_choice.type: unsupported value %q", tc.Type)
+		}
+		out.ToolConfig = &geminiToolConfig{FunctionCallingConfig: fcc}
+	}
+
+	cfg := &geminiGenerationConfig{
+		Temperature:     req.Temperature,
+		TopP:            req.TopP,
+		TopK:            req.TopK,
+		MaxOutputTokens: req.MaxTokens,
+		StopSequences:   req.StopSequences,
+	}
+	if th := req.Thinking; th != nil {
+		switch th.Type {
+		case "enabled":
+			budget := th.BudgetTokens
+			cfg.ThinkingConfig = &geminiThinkingConfig{ThinkingBudget: &budget, IncludeThoughts: true}
+		case "disabled":
+			budget := 0
+			cfg.ThinkingConfig = &geminiThinkingConfig{ThinkingBudget: &budget}
+		}
+	}
+	out.GenerationConfig = cfg
+
+	return out, nil
+}
+
+// anthropicBlocksToParts 解析 content（字符串或内容块数组）为 Gemini parts。
+// toolNames 为 nil 时（system）只允许文本块。
+func anthropicBlocksToParts(raw json.RawMessage, toolNames map[string]string) ([]geminiPart, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []geminiPart{{Text: text}}, nil
+	}
+
+	var blocks []anthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, errors.New("content must be a string or an array of content blocks")
+	}
+	parts := make([]geminiPart, 0, len(blocks))
+	for _, b := range blocks {
+		if toolNames == nil && b.Type != "text" {
+			return nil, fmt.Errorf("unsupported block type %q", b.Type)
+		}
+		switch b.Type {
+		case "text":
+			if b.Text != "" {
+				parts = append(parts, geminiPart{Text: b.Text})
+			}
+		case "image", "document":
+			part, err := anthropicSourceToPart(b)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		case "tool_use":
+			toolNames[b.ID] = b.Name
+			args := b.Input
+			if args == nil {
+				args = map[string]interface{}{}
+			}
+			parts = append(parts, geminiPart{
+				FunctionCall:     &geminiFunctionCall{Name: b.Name, Args: args},
+				ThoughtSignature: splitToolCallSignature(b.ID),
+			})
+		case "tool_result":
+			name, ok := toolNames[b.ToolUseID]
+			if !ok {
+				return nil, fmt.Errorf("tool_result references unknown tool_use_id %q", b.ToolUseID)
+			}
+			response, err := anthropicToolResultResponse(b)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, geminiPart{FunctionResponse: &geminiFunctionResponse{Name: name, Response: response}})
+		case "thinking":
+			if b.Thinking == "" && b.Signature != "" {
+				// 只含 signature 的思考块来自文本 part 上的 thoughtSignature（见 anthropicSignatureBlock），
+				// 放回前面的文本 part；前面没有文本时丢弃（Gemini 只校验 functionCall 上的签名）
+				if n := len(parts); n > 0 && parts[n-1].Text != "" && !parts[n-1].Thought && parts[n-1].ThoughtSignature == "" {
+					parts[n-1].ThoughtSignature = b.Signature
+				}
+				continue
+			}
+			// 思考块由 Gemini 的 thought part 转换而来，signature 即其 thoughtSignature，
+			// 原样带回后 Gemini 才能延续上一轮的推理（见 complete / streamEvent）
+			parts = append(parts, geminiPart{Text: b.Thinking, Thought: true, ThoughtSignature: b.Signature})
+		case "redacted_thinking":
+			// 本代理不会生成 redacted_thinking，它只来自 Anthropic 模型的历史，其中加密的 data 对 Gemini 没有意义
+		default:
+			return nil, fmt.Errorf("unsupported block type %q", b.Type)
+		}
+	}
+	return parts, nil
+}
+
+// anthropicSourceToPart 将 image/document 块的 source 转换为 inlineData 或 fileData
+func anthropicSourceToPart(b anthropicContentBlock) (geminiPart, error) {
+	if b.Source == nil {
+		return geminiPart{}, fmt.Errorf("%s block is missing source", b.Type)
+	}
+	switch b.Source.Type {
+	case "base64":
+		return geminiPart{InlineData: &geminiBlob{MimeType: b.Source.MediaType, Data: b.Source.Data}}, nil
+	case "url":
+		part := imageURLToPart(b.Source.URL)
+		if b.Type == "document" && part.FileData != nil {
+			part.FileData.MimeType = "application/pdf"
+		}
+		return part, nil
+	}
+	return geminiPart{}, fmt.Errorf("unsupported source type %q", b.Source.Type)
+}
+
+// anthropicToolResultResponse 将 tool_result 的内容包装为 functionResponse.response
+func anthropicToolResultResponse(b anthropicContentBlock) (map[string]interface{}, error) {
+	text := ""
+	if len(b.Content) > 0 && string(b.Content) != "null" {
+		parts, err := anthropicBlocksToParts(b.Content, map[string]string{})
+		if err != nil {
+			return nil, fmt.Errorf("tool_result: %v", err)
+		}
+		var sb strings.Builder
+		for _, p := range parts {
+			sb.WriteString(p.Text)
+		}
+		text = sb.String()
+	}
+	if b.IsError {
+		return map[string]interface{}{"error": text}, nil
+	}
+	return functionResponseObject(text), nil
+}
+
+// anthropicStopReason 将 Gemini finishReason 映射为 Anthropic stop_reason
+func anthropicStopReason(reason string, sawToolUse bool) string {
+	switch reason {
+	case "MAX_TOKENS":
+		return "max_tokens"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "refusal"
+	}
+	if sawToolUse {
+		return "tool_use"
+	}
+	return "end_turn"
+}
+
+func anthropicUsageFromGemini(u *geminiUsageMetadata) anthropicUsage {
+	if u == nil {
+		return anthropicUsage{}
+	}
+	return anthropicUsage{
+		InputTokens:          u.PromptTokenCount,
+		OutputTokens:         u.CandidatesTokenCount + u.ThoughtsTokenCount,
+		CacheReadInputTokens: u.CachedContentTokenCount,
+	}
+}
+
+// anthropicErrorType 根据HTTP状态码给出 Anthropic 风格的错误类型
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
+	}
+	if status >= 500 {
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
+
+// writeAnthropicError 以 Anthropic 错误格式写出响应
+func writeAnthropicError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    anthropicErrorType(status),
+			"message": message,
+		},
+	})
+}
+
+// anthropicTranslator 将 Gemini 响应转换为 Anthropic message 或
+// message_start / content_block_* / message_delta / message_stop 事件流
+type anthropicTranslator struct {
+	model string
+	id    string
+
+	// 流式状态
+	started    bool
+	blockIndex int    // 下一个内容块的 index
+	blockType  string // 当前打开的内容块类型，空表示没有打开的块
+	sawToolUse bool
+	finish     string
+	usage      anthropicUsage
+}
+
+func newAnthropicTranslator(model string) *anthropicTranslator {
+	return &anthropicTranslator{
+		model: model,
+		id:    "msg_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+	}
+}
+
+func (t *anthropicTranslator) fail(w http.ResponseWriter, status int, message, code string) {
+	writeAnthropicError(w, status, message)
+}
+
+func (t *anthropicTranslator) complete(w http.ResponseWriter, body []byte) {
+	var resp geminiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("[ANTHROPIC] Failed to parse Gemini response: %v", err)
+		writeAnthropicError(w, http.StatusBadGateway, "Invalid response from upstream: "+err.Error())
+		return
+	}
+
+	out := anthropicResponse{
+		ID:      t.id,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   t.model,
+		Content: []map[string]interface{}{},
+		Usage:   anthropicUsageFromGemini(resp.UsageMetadata),
+	}
+	finish := ""
+	sawToolUse := false
+	if len(resp.Candidates) > 0 {
+		cand := resp.Candidates[0]
+		finish = cand.FinishReason
+		for _, part := range cand.Content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				sawToolUse = true
+				out.Content = append(out.Content, anthropicToolUseBlock(part))
+			case part.Thought:
+				out.Content = append(out.Content, map[string]interface{}{"type": "thinking", "thinking": part.Text, "signature": part.ThoughtSignature})
+			case part.Text != "":
+				out.Content = append(out.Content, map[string]interface{}{"type": "text", "text": part.Text})
+			}
+			if anthropicTextSignature(part) {
+				out.Content = append(out.Content, anthropicSignatureBlock(part.ThoughtSignature))
+			}
+		}
+	} else if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		finish = "SAFETY"
+	}
+	stopReason := anthropicStopReason(finish, sawToolUse)
+	out.StopReason = &stopReason
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(out)
+}
+
+// streamEvent 将一个 Gemini SSE 事件转换为 Anthropic 事件
+func (t *anthropicTranslator) streamEvent(w http.ResponseWriter, data []byte) {
+	var resp geminiResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		log.Printf("[ANTHROPIC] Skipping unparsable stream event: %v", err)
+		return
+	}
+	if resp.UsageMetadata != nil {
+		t.usage = anthropicUsageFromGemini(resp.UsageMetadata)
+	}
+	t.ensureStarted(w)
+
+	if len(resp.Candidates) == 0 {
+		return
+	}
+	cand := resp.Candidates[0]
+	for _, part := range cand.Content.Parts {
+		switch {
+		case part.FunctionCall != nil:
+			t.sawToolUse = true
+			block := anthropicToolUseBlock(part)
+			input, _ := json.Marshal(block["input"])
+			block["input"] = map[string]interface{}{}
+			t.openBlock(w, "tool_use", block)
+			t.writeEvent(w, "content_block_delta", map[string]interface{}{
+				"index": t.blockIndex - 1,
+				"delta": map[string]interface{}{"type": "input_json_delta", "partial_json": string(input)},
+			})
+			t.closeBlock(w)
+		case part.Thought:
+			if t.blockType != "thinking" {
+				t.openBlock(w, "thinking", map[string]interface{}{"type": "thinking", "thinking": ""})
+			}
+			if part.Text != "" {
+				t.writeEvent(w, "content_block_delta", map[string]interface{}{
+					"index": t.blockIndex - 1,
+					"delta": map[string]interface{}{"type": "thinking_delta", "thinking": part.Text},
+				})
+			}
+			if part.ThoughtSignature != "" {
+				t.writeEvent(w, "content_block_delta", map[string]interface{}{
+					"index": t.blockIndex - 1,
+					"delta": map[string]interface{}{"type": "signature_delta", "signature": part.ThoughtSignature},
+				})
+			}
+		case part.Text != "":
+			if t.blockType != "text" {
+				t.openBlock(w, "text", map[string]interface{}{"type": "text", "text": ""})
+			}
+			t.writeEvent(w, "content_block_delta", map[string]interface{}{
+				"index": t.blockIndex - 1,
+				"delta": map[string]interface{}{"type": "text_delta", "text": part.Text},
+			})
+		}
+		if anthropicTextSignature(part) {
+			t.openBlock(w, "thinking", map[string]interface{}{"type": "thinking", "thinking": ""})
+			t.writeEvent(w, "content_block_delta", map[string]interface{}{
+				"index": t.blockIndex - 1,
+				"delta": map[string]interface{}{"type": "signature_delta", "signature": part.ThoughtSignature},
+			})
+			t.closeBlock(w)
+		}
+	}
+	if cand.FinishReason != "" {
+		t.finish = cand.FinishReason
+	}
+}
+
+func (t *anthropicTranslator) streamEnd(w http.ResponseWriter) {
+	t.ensureStarted(w)
+	t.closeBlock(w)
+	t.writeEvent(w, "message_delta", map[string]interface{}{
+		"delta": map[string]interface{}{"stop_reason": anthropicStopReason(t.finish, t.sawToolUse), "stop_sequence": nil},
+		"usage": map[string]interface{}{"output_tokens": t.usage.OutputTokens},
+	})
+	t.writeEvent(w, "message_stop", map[string]interface{}{})
+}
+
+// streamFail 在流中断时写出 error 事件（与 Anthropic API 流中途出错时相同），不写 message_delta / message_stop，
+// 客户端（如 anthropic SDK）会抛出 overloaded_error / api_error 而不是返回截断的回答
+func (t *anthropicTranslator) streamFail(w http.ResponseWriter, status int, message string) {
+	t.ensureStarted(w)
+	t.writeEvent(w, "error", map[string]interface{}{
+		"error": map[string]interface{}{"type": anthropicErrorType(status), "message": message},
+	})
+}
+
+// ensureStarted 在第一个事件前写出 message_start
+func (t *anthropicTranslator) ensureStarted(w http.ResponseWriter) {
+	if t.started {
+		return
+	}
+	t.started = true
+	t.writeEvent(w, "message_start", map[string]interface{}{
+		"message": anthropicResponse{
+			ID:      t.id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   t.model,
+			Content: []map[string]interface{}{},
+			Usage:   anthropicUsage{InputTokens: t.usage.InputTokens},
+		},
+	})
+}
+
+func (t *anthropicTranslator) openBlock(w http.ResponseWriter, blockType string, block map[string]interface{}) {
+	t.closeBlock(w)
+	t.writeEvent(w, "content_block_start", map[string]interface{}{"index": t.blockIndex, "content_block": block})
+	t.blockType = blockType
+	t.blockIndex++
+}
+
+func (t *anthropicTranslator) closeBlock(w http.ResponseWriter) {
+	if t.blockType == "" {
+		return
+	}
+	t.writeEvent(w, "content_block_stop", map[string]interface{}{"index": t.blockIndex - 1})
+	t.blockType = ""
+}
+
+func (t *anthropicTranslator) writeEvent(w http.ResponseWriter, event string, data map[string]interface{}) {
+	data["type"] = event
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[ANTHROPIC] Failed to marshal %s event: %v", event, err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+// anthropicTextSignature 判断 part 是否为带 thoughtSignature 的文本 part（未开启 includeThoughts 时
+// Gemini 常在最后一个、可能为空的文本 part 上返回签名）。文本块没有 signature 字段，
+// 签名放进一个只含 signature 的思考块，客户端带回后再还原到文本 part 上（见 anthropicBlocksToParts）
+func anthropicTextSignature(part geminiPart) bool {
+	return part.ThoughtSignature != "" && !part.Thought && part.FunctionCall == nil
+}
+
+func anthropicSignatureBlock(signature string) map[string]interface{} {
+	return map[string]interface{}{"type": "thinking", "thinking": "", "signature": signature}
+}
+
+// anthropicToolUseBlock 转换 functionCall part，part 上的 thoughtSignature 编码进 id（见 toolCallIDWithSignature）
+func anthropicToolUseBlock(part geminiPart) map[string]interface{} {
+	fc := part.FunctionCall
+	id := fc.ID
+	if id == "" {
+		id = "toolu_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:24]
+	}
+	id = toolCallIDWithSignature(id, part.ThoughtSignature)
+	input := fc.Args
+	if input == nil {
+		input = map[string]interface{}{}
+	}
+	return map[string]interface{}{"type": "tool_use", "id": id, "name": fc.Name, "input": input}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicThoughtSignatureRoundTrip(t *testing.T) {
+	const thoughtSig, callSig = "c2lnLXRob3VnaHQ=", "c2lnL2NhbGwr/w=="
+
+	// Gemini 响应 -> Anthropic 内容块
+	rec := httptest.NewRecorder()
+	newAnthropicTranslator("gemini-2.5-pro").complete(rec, []byte(`{"candidates":[{"content":{"role":"model","parts":[
+		{"text":"plan","thought":true,"thoughtSignature":"`+thoughtSig+`"},
+		{"functionCall":{"name":"lookup","args":{"q":"x"}},"thoughtSignature":"`+callSig+`"}
+	]},"finishReason":"STOP"}]}`))
+	var resp anthropicResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != 2 {
+		t.Fatalf("content = %v", resp.Content)
+	}
+
+	// 客户端在下一轮原样带回这些内容块
+	history, err := json.Marshal(resp.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := anthropicBlocksToParts(history, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []geminiPart{
+		{Text: "plan", Thought: true, ThoughtSignature: thoughtSig},
+		{FunctionCall: &geminiFunctionCall{Name: "lookup", Args: map[string]interface{}{"q": "x"}}, ThoughtSignature: callSig},
+	}
+	if !reflect.DeepEqual(parts, want) {
+		got, _ := json.Marshal(parts)
+		t.Fatalf("parts = %s", got)
+	}
+}
+
+// 未开启 includeThoughts 时签名在（可能为空的）文本 part 上，经只含 signature 的思考块带回到文本 part
+func TestAnthropicTextSignatureRoundTrip(t *testing.T) {
+	const sig = "c2lnLXRleHQ="
+	upstream := `{"candidates":[{"content":{"role":"model","parts":[{"text":"answer"},{"text":"","thoughtSignature":"` + sig + `"}]},"finishReason":"STOP"}]}`
+
+	rec := httptest.NewRecorder()
+	newAnthropicTranslator("gemini-2.5-pro").complete(rec, []byte(upstream))
+	var resp anthropicResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	history, err := json.Marshal(resp.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := anthropicBlocksToParts(history, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []geminiPart{{Text: "answer", ThoughtSignature: sig}}; !reflect.DeepEqual(parts, want) {
+		t.Fatalf("content = %s, parts = %+v", history, parts)
+	}
+
+	// 流式响应中签名同样以思考块的 signature_delta 送出
+	rec = httptest.NewRecorder()
+	tw := newTranslatingWriter(rec, newAnthropicTranslator("gemini-2.5-pro"), true)
+	tw.WriteHeader(200)
+	tw.Write([]byte("data: " + upstream + "\r\n\r\n"))
+	tw.finish()
+	var signature interface{}
+	for _, e := range anthropicStreamEvents(t, rec.Body.String()) {
+		if delta, ok := e["delta"].(map[string]interface{}); ok && delta["type"] == "signature_delta" {
+			signature = delta["signature"]
+		}
+	}
+	if signature != sig {
+		t.Fatalf("signature_delta = %v, want %q", signature, sig)
+	}
+
+	// 前面没有文本 part 时签名无处附着，不生成空 part
+	parts, err = anthropicBlocksToParts(json.RawMessage(`[{"type":"thinking","thinking":"","signature":"`+sig+`"}]`), map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 0 {
+		t.Fatalf("parts = %+v", parts)
+	}
+}
+
+func TestAnthropicRedactedThinkingDropped(t *testing.T) {
+	parts, err := anthropicBlocksToParts(json.RawMessage(`[{"type":"redacted_thinking","data":"opaque"},{"type":"text","text":"hi"}]`), map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []geminiPart{{Text: "hi"}}; !reflect.DeepEqual(parts, want) {
+		t.Fatalf("parts = %+v", parts)
+	}
+}
+
+func TestConvertAnthropicRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     string
+		want    string // geminiRequest 的 JSON
+		wantErr string
+	}{
+		{
+			name: "system blocks and consecutive messages merged",
+			req:  `{"system":[{"type":"text","text":"be brief"}],"messages":[{"role":"user","content":"a"},{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}],"max_tokens":5}`,
+			want: `{"contents":[{"role":"user","parts":[{"text":"a"},{"inlineData":{"mimeType":"image/png","data":"AAAA"}}]}],"systemInstruction":{"parts":[{"text":"be brief"}]},"generationConfig":{"maxOutputTokens":5}}`,
+		},
+		{
+			name: "tool use and result",
+			req: `{"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"f","input":{"x":1}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"{\"ok\":true}"}]},{"type":"tool_result","tool_use_id":"toolu_1","content":"boom","is_error":true}]}],
+				"tools":[{"name":"f","input_schema":{"type":"object"}}],"tool_choice":{"type":"tool","name":"f"}}`,
+			want: `{"contents":[{"role":"user","parts":[{"text":"hi"}]},{"role":"model","parts":[{"functionCall":{"name":"f","args":{"x":1}}}]},{"role":"user","parts":[{"functionResponse":{"name":"f","response":{"ok":true}}},{"functionResponse":{"name":"f","response":{"error":"boom"}}}]}],"tools":[{"functionDeclarations":[{"name":"f","parameters":{"type":"object"}}]}],"toolConfig":{"functionCallingConfig":{"mode":"ANY","allowedFunctionNames":["f"]}},"generationConfig":{}}`,
+		},
+		{
+			name: "thinking enabled and document url",
+			req:  `{"messages":[{"role":"user","content":[{"type":"document","source":{"type":"url","url":"https://example.com/a.pdf"}}]}],"thinking":{"type":"enabled","budget_tokens":1024}}`,
+			want: `{"contents":[{"role":"user","parts":[{"fileData":{"mimeType":"application/pdf","fileUri":"https://example.com/a.pdf"}}]}],"generationConfig":{"thinkingConfig":{"thinkingBudget":1024,"includeThoughts":true}}}`,
+		},
+		{name: "unknown role", req: `{"messages":[{"role":"system","content":"x"}]}`, wantErr: `messages.0.role: unsupported role "system"`},
+		{name: "non-text system block", req: `{"system":[{"type":"image"}],"messages":[]}`, wantErr: `system: unsupported block type "image"`},
+		{name: "unknown tool_use_id", req: `{"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"nope"}]}]}`, wantErr: `unknown tool_use_id "nope"`},
+		{name: "missing source", req: `{"messages":[{"role":"user","content":[{"type":"image"}]}]}`, wantErr: "image block is missing source"},
+		{name: "bad tool_choice", req: `{"messages":[],"tool_choice":{"type":"sometimes"}}`, wantErr: `tool_choice.type: unsupported value "sometimes"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req anthropicRequest
+			if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+				t.Fatal(err)
+			}
+			out, err := convertAnthropicRequest(&req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(out)
+			var gotV, wantV interface{}
+			json.Unmarshal(got, &gotV)
+			if err := json.Unmarshal([]byte(tt.want), &wantV); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotV, wantV) {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// anthropicStreamEvents 解析 Anthropic SSE，返回每个事件的 data
+func anthropicStreamEvents(t *testing.T, body string) []map[string]interface{} {
+	t.Helper()
+	var d sseDecoder
+	var events []map[string]interface{}
+	for _, e := range append(d.feed([]byte(body)), d.flush()...) {
+		var event map[string]interface{}
+		if err := json.Unmarshal(e, &event); err != nil {
+			t.Fatalf("event %q: %v", e, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAnthropicTranslatorStream(t *testing.T) {
+	upstream := ""
+	for _, e := range []string{
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"hmm","thought":true}]},"index":0}],"usageMetadata":{"promptTokenCount":4}}`,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"","thought":true,"thoughtSignature":"c2ln"}]},"index":0}]}`,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"Hel"}]},"index":0}]}`,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"lo"},{"functionCall":{"id":"t1","name":"f","args":{"a":1}}}]},"finishReason":"STOP","index":0}],"usageMetadata":{"promptTokenCount":4,"candidatesTokenCount":2,"thoughtsTokenCount":1}}`,
+	} {
+		upstream += "data: " + e + "\r\n\r\n"
+	}
+
+	rec := httptest.NewRecorder()
+	tw := newTranslatingWriter(rec, newAnthropicTranslator("gemini-2.5-pro"), true)
+	tw.WriteHeader(200)
+	for i := 0; i < len(upstream); i += 11 {
+		tw.Write([]byte(upstream[i:min(i+11, len(upstream))]))
+	}
+	tw.finish()
+
+	events := anthropicStreamEvents(t, rec.Body.String())
+	var types []string
+	for _, e := range events {
+		typ := e["type"].(string)
+		if delta, ok := e["delta"].(map[string]interface{}); ok && typ == "content_block_delta" {
+			typ += "/" + delta["type"].(string)
+		}
+		if block, ok := e["content_block"].(map[string]interface{}); ok {
+			typ += "/" + block["type"].(string)
+		}
+		types = append(types, typ)
+	}
+	want := []string{
+		"message_start",
+		"content_block_start/thinking", "content_block_delta/thinking_delta", "content_block_delta/signature_delta", "content_block_stop",
+		"content_block_start/text", "content_block_delta/text_delta", "content_block_delta/text_delta", "content_block_stop",
+		"content_block_start/tool_use", "content_block_delta/input_json_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("events = %q\nwant     %q", types, want)
+	}
+
+	if got := events[0]["message"].(map[string]interface{})["usage"].(map[string]interface{})["input_tokens"]; got != 4.0 {
+		t.Fatalf("message_start input_tokens = %v", got)
+	}
+	for i, e := range events {
+		if idx, ok := e["index"]; ok {
+			wantIdx := map[int]float64{1: 0, 2: 0, 3: 0, 4: 0, 5: 1, 6: 1, 7: 1, 8: 1, 9: 2, 10: 2, 11: 2}[i]
+			if idx != wantIdx {
+				t.Fatalf("event %d (%s) index = %v, want %v", i, types[i], idx, wantIdx)
+			}
+		}
+	}
+	delta := events[len(events)-2]
+	if delta["delta"].(map[string]interface{})["stop_reason"] != "tool_use" || delta["usage"].(map[string]interface{})["output_tokens"] != 3.0 {
+		t.Fatalf("message_delta = %v", delta)
+	}
+}
+
+func TestAnthropicTranslatorComplete(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		stopReason string
+		blocks     []string
+	}{
+		{"text", `{"candidates":[{"content":{"parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`, "end_turn", []string{"text"}},
+		{"text with signature", `{"candidates":[{"content":{"parts":[{"text":"hi","thoughtSignature":"c2ln"}]},"finishReason":"STOP"}]}`, "end_turn", []string{"text", "thinking"}},
+		{"max tokens", `{"candidates":[{"content":{"parts":[{"text":"hi"}]},"finishReason":"MAX_TOKENS"}]}`, "max_tokens", []string{"text"}},
+		{"thinking and tool use", `{"candidates":[{"content":{"parts":[{"text":"plan","thought":true},{"functionCall":{"name":"f"}}]},"finishReason":"STOP"}]}`, "tool_use", []string{"thinking", "tool_use"}},
+		{"safety", `{"candidates":[{"content":{"parts":[]},"finishReason":"SAFETY"}]}`, "refusal", nil},
+		{"blocked prompt", `{"promptFeedback":{"blockReason":"SAFETY"}}`, "refusal", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			newAnthropicTranslator("m").complete(rec, []byte(tt.body))
+			var resp anthropicResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var blocks []string
+			for _, b := range resp.Content {
+				blocks = append(blocks, b["type"].(string))
+			}
+			if *resp.StopReason != tt.stopReason || !reflect.DeepEqual(blocks, tt.blocks) {
+				t.Fatalf("stop_reason = %q, blocks = %q", *resp.StopReason, blocks)
+			}
+		})
+	}
+}
+
+func TestAnthropicErrorType(t *testing.T) {
+	tests := map[int]string{
+		400: "invalid_request_error",
+		401: "authentication_error",
+		403: "permission_error",
+		404: "not_found_error",
+		413: "request_too_large",
+		429: "rate_limit_error",
+		500: "api_error",
+		502: "api_error",
+		503: "overloaded_error",
+		529: "overloaded_error",
+	}
+	for status, want := range tests {
+		if got := anthropicErrorType(status); got != want {
+			t.Errorf("anthropicErrorType(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// --- HTTP 客户端 API Key 存储 ---
+// API_KEYS_FILE 指向的 JSON 文件把多个 API Key 映射到连接池用户：
+//
+//	{"keys": [{"key": "sk-alice", "user_id": "alice", "label": "Alice laptop", "enabled": true}]}
+//
+// AUTH_API_KEY 仍然有效，等价于一条 user_id 为 "user-1" 的记录。
+// 解析出的 user_id 决定请求使用哪个用户的浏览器连接（globalPool.GetConnection）。
+
+// APIKey is one entry of the key store
+type APIKey struct {
+	Key     string `json:"key"`
+	UserID  string `json:"user_id"`
+	Label   string `json:"label,omitempty"`
+	Enabled *bool  `json:"enabled,omitempty"` // default true
+}
+
+func (k *APIKey) enabled() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+// APIKeyStore maps API keys to users
+// Keys are indexed by their SHA-256 digest so the raw keys are not kept as map keys
+// A store is immutable; a reload builds a new one as part of the runtime state (see reload.go)
+type APIKeyStore struct {
+	keys map[[sha256.Size]byte]*APIKey
+}
+
+func newAPIKeyStore(keys []*APIKey) *APIKeyStore {
+	index := make(map[[sha256.Size]byte]*APIKey, len(keys))
+	for _, k := range keys {
+		index[sha256.Sum256([]byte(k.Key))] = k
+	}
+	return &APIKeyStore{keys: index}
+}
+
+var (
+	errAPIKeyMissing  = errors.New("missing API key")
+	errAPIKeyInvalid  = errors.New("invalid API key")
+	errAPIKeyDisabled = errors.New("API key is disabled")
+	errAPIKeyNoConfig = errors.New("server configuration error")
+)
+
+// Lookup resolves an API key to its entry
+// For a disabled key the entry is returned together with errAPIKeyDisabled so callers can log who it was
+func (s *APIKeyStore) Lookup(key string) (*APIKey, error) {
+	if key == "" {
+		return nil, errAPIKeyMissing
+	}
+
+	if len(s.keys) == 0 {
+		return nil, errAPIKeyNoConfig
+	}
+	entry, ok := s.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errAPIKeyInvalid
+	}
+	if !entry.enabled() {
+		return entry, errAPIKeyDisabled
+	}
+	return entry, nil
+}
+
+// summary counts the keys, the disabled keys and the distinct users
+func (s *APIKeyStore) summary() (keys, disabled, users int) {
+	seen := make(map[string]bool)
+	for _, k := range s.keys {
+		seen[k.UserID] = true
+		if !k.enabled() {
+			disabled++
+		}
+	}
+	return len(s.keys), disabled, len(seen)
+}
+
+// loadAPIKeys builds the key list from API_KEYS_FILE and AUTH_API_KEY
+func loadAPIKeys(path, authAPIKey string) ([]*APIKey, error) {
+	var keys []*APIKey
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var file struct {
+			Keys []*APIKey `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		seen := make(map[string]int)
+		for i, k := range file.Keys {
+			if k == nil || k.Key == "" {
+				return nil, fmt.Errorf("%s: keys[%d].key is required", path, i)
+			}
+			if k.UserID == "" {
+				return nil, fmt.Errorf("%s: keys[%d].user_id is required", path, i)
+			}
+			if j, dup := seen[k.Key]; dup {
+				return nil, fmt.Errorf("%s: keys[%d].key duplicates keys[%d].key", path, i, j)
+			}
+			seen[k.Key] = i
+		}
+		keys = file.Keys
+	}
+
+	if authAPIKey != "" {
+		for _, k := range keys {
+			if k.Key == authAPIKey {
+				return nil, errors.New("AUTH_API_KEY is also listed in API_KEYS_FILE")
+			}
+		}
+		// 单租户
+		keys = append(keys, &APIKey{Key: authAPIKey, UserID: "user-1", Label: "AUTH_API_KEY"})
+	}
+	return keys, nil
+}
+
+// logAPIKeys reports the key store loaded at startup
+func logAPIKeys(s *APIKeyStore) {
+	keys, disabled, users := s.summary()
+	if keys == 0 {
+		log.Println("CRITICAL: neither AUTH_API_KEY nor API_KEYS_FILE is set; all API requests will be rejected.")
+	} else {
+		log.Printf("API key store loaded: %d keys (%d disabled) for %d users", keys, disabled, users)
+	}
+}
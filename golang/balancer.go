@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// Balancer picks the connection that serves the next request of a user
+// It is called with the UserConnections lock held; candidates is non-empty and
+// keeps the order of conns.Connections
+type Balancer interface {
+	Name() string
+	Pick(conns *UserConnections, candidates []*UserConnection) *UserConnection
+}
+
+const defaultBalancerStrategy = "round_robin"
+
+// balancers holds the available strategies by name; they keep their state in
+// UserConnections / UserConnection, so one instance is shared by all users
+var balancers = map[string]Balancer{
+	"round_robin":     roundRobinBalancer{},
+	"least_in_flight": leastInFlightBalancer{},
+	"weighted":        weightedBalancer{},
+	"random":          randomBalancer{},
+}
+
+// roundRobinBalancer rotates through the connections using NextIndex
+type roundRobinBalancer struct{}
+
+func (roundRobinBalancer) Name() string { return "round_robin" }
+
+func (roundRobinBalancer) Pick(conns *UserConnections, candidates []*UserConnection) *UserConnection {
+	numConns := len(conns.Connections)
+	for i := 0; i < numConns; i++ {
+		idx := (conns.NextIndex + i) % numConns
+		if containsConnection(candidates, conns.Connections[idx]) {
+			conns.NextIndex = (idx + 1) % numConns // 更新索引
+			return conns.Connections[idx]
+		}
+	}
+	return candidates[0]
+}
+
+// leastInFlightBalancer picks the connection with the fewest active requests,
+// breaking ties round-robin so idle connections share the load
+type leastInFlightBalancer struct{}
+
+func (leastInFlightBalancer) Name() string { return "least_in_flight" }
+
+func (leastInFlightBalancer) Pick(conns *UserConnections, candidates []*UserConnection) *UserConnection {
+	least := candidates[0].InFlight()
+	for _, uc := range candidates[1:] {
+		if n := uc.InFlight(); n < least {
+			least = n
+		}
+	}
+	idle := make([]*UserConnection, 0, len(candidates))
+	for _, uc := range candidates {
+		if uc.InFlight() == least {
+			idle = append(idle, uc)
+		}
+	}
+	return roundRobinBalancer{}.Pick(conns, idle)
+}
+
+// weightedBalancer is a smooth weighted round-robin (as in nginx): a connection
+// with weight 3 gets three requests for every one sent to a connection with weight 1,
+// interleaved rather than in bursts. Weights come from the "weight" query parameter
+// of the WebSocket URL (default 1)
+type weightedBalancer struct{}
+
+func (weightedBalancer) Name() string { return "weighted" }
+
+func (weightedBalancer) Pick(conns *UserConnections, candidates []*UserConnection) *UserConnection {
+	total := 0
+	var best *UserConnection
+	for _, uc := range candidates {
+		uc.currentWeight += uc.Weight
+		total += uc.Weight
+		if best == nil || uc.currentWeight > best.currentWeight {
+			best = uc
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// randomBalancer picks a connection uniformly at random
+type randomBalancer struct{}
+
+func (randomBalancer) Name() string { return "random" }
+
+func (randomBalancer) Pick(conns *UserConnections, candidates []*UserConnection) *UserConnection {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// --- Configuration ---
+
+// balancerConfig is the JSON file pointed to by BALANCER_CONFIG
+//
+//	{"default": "least_in_flight", "users": {"alice": "weighted"}}
+type balancerConfig struct {
+	Default string            `json:"default"`
+	Users   map[string]string `json:"users"`
+}
+
+var balancerStrategyNames = func() []string {
+	names := make([]string, 0, len(balancers))
+	for name := range balancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}()
+
+// balancerFor returns the strategy configured for a user
+func balancerFor(userID string) Balancer {
+	return currentState().balancer.forUser(userID)
+}
+
+// balancerSetup is a validated BALANCER_CONFIG, part of the runtime state (see reload.go)
+type balancerSetup struct {
+	def   Balancer
+	users map[string]Balancer
+}
+
+func (setup *balancerSetup) forUser(userID string) Balancer {
+	if b, ok := setup.users[userID]; ok {
+		return b
+	}
+	return setup.def
+}
+
+// parseBalancerConfig reads and validates a JSON file without touching the active strategies
+// An empty path yields the default strategy for every user
+func parseBalancerConfig(path string) (*balancerSetup, error) {
+	setup := &balancerSetup{def: balancers[defaultBalancerStrategy], users: map[string]Balancer{}}
+	if path == "" {
+		return setup, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg balancerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	if cfg.Default != "" {
+		b, ok := balancers[cfg.Default]
+		if !ok {
+			return nil, fmt.Errorf("default: unknown strategy %q (available: %v)", cfg.Default, balancerStrategyNames)
+		}
+		setup.def = b
+	}
+	for userID, name := range cfg.Users {
+		b, ok := balancers[name]
+		if !ok {
+			return nil, fmt.Errorf("users.%s: unknown strategy %q (available: %v)", userID, name, balancerStrategyNames)
+		}
+		setup.users[userID] = b
+	}
+	return setup, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConnections 创建权重为 weights 的连接，pickSequence 用 a、b、c… 表示它们
+func testConnections(weights ...int) *UserConnections {
+	conns := &UserConnections{}
+	for _, w := range weights {
+		conns.Connections = append(conns.Connections, &UserConnection{Weight: w})
+	}
+	return conns
+}
+
+// setInFlight 设置连接上正在处理的请求数
+func setInFlight(uc *UserConnection, n int) {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	uc.requests = make(map[string]time.Time, n)
+	for i := 0; i < n; i++ {
+		uc.requests[fmt.Sprint(i)] = time.Now()
+	}
+}
+
+// pickSequence 连续调用 n 次 Pick，返回选中连接的序号（a 为 conns.Connections[0]）
+func pickSequence(b Balancer, conns *UserConnections, candidates []*UserConnection, n int) string {
+	var picks strings.Builder
+	for i := 0; i < n; i++ {
+		picked := b.Pick(conns, candidates)
+		for j, uc := range conns.Connections {
+			if uc == picked {
+				picks.WriteByte(byte('a' + j))
+			}
+		}
+	}
+	return picks.String()
+}
+
+func TestWeightedBalancerPick(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		n       int
+		want    string
+	}{
+		{"equal weights rotate", []int{1, 1, 1}, 6, "abcabc"},
+		{"smooth interleaving", []int{5, 1, 1}, 7, "aabacaa"},
+		{"3:1", []int{3, 1}, 8, "aabaaaba"},
+		{"single connection", []int{4}, 3, "aaa"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conns := testConnections(tt.weights...)
+			if got := pickSequence(weightedBalancer{}, conns, conns.Connections, tt.n); got != tt.want {
+				t.Fatalf("picks = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedBalancerDistribution(t *testing.T) {
+	conns := testConnections(3, 2, 1)
+	counts := map[rune]int{}
+	for _, c := range pickSequence(weightedBalancer{}, conns, conns.Connections, 600) {
+		counts[c]++
+	}
+	if want := map[rune]int{'a': 300, 'b': 200, 'c': 100}; !reflect.DeepEqual(counts, want) {
+		t.Fatalf("counts = %v, want %v", counts, want)
+	}
+
+	// 被排除的连接（例如已经试过的）不参与分配，其余按权重继续
+	counts = map[rune]int{}
+	for _, c := range pickSequence(weightedBalancer{}, conns, conns.Connections[1:], 300) {
+		counts[c]++
+	}
+	if want := map[rune]int{'b': 200, 'c': 100}; !reflect.DeepEqual(counts, want) {
+		t.Fatalf("counts without a = %v, want %v", counts, want)
+	}
+}
+
+func TestRoundRobinBalancerSkipsExcluded(t *testing.T) {
+	conns := testConnections(1, 1, 1)
+	candidates := []*UserConnection{conns.Connections[0], conns.Connections[2]}
+	if got := pickSequence(roundRobinBalancer{}, conns, candidates, 4); got != "acac" {
+		t.Fatalf("picks = %s, want acac", got)
+	}
+}
+
+func TestLeastInFlightBalancerPick(t *testing.T) {
+	conns := testConnections(1, 1, 1)
+	setInFlight(conns.Connections[0], 2)
+	// b 和 c 同样空闲，轮流分配
+	if got := pickSequence(leastInFlightBalancer{}, conns, conns.Connections, 4); got != "bcbc" {
+		t.Fatalf("picks = %s, want bcbc", got)
+	}
+}
+
+func TestParseBalancerConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantDef  string
+		wantUser string
+		wantErr  string
+	}{
+		{"default only", `{"default":"least_in_flight"}`, "least_in_flight", "least_in_flight", ""},
+		{"per-user override", `{"users":{"alice":"weighted"}}`, "round_robin", "weighted", ""},
+		{"unknown default", `{"default":"fastest"}`, "", "", `default: unknown strategy "fastest"`},
+		{"unknown user strategy", `{"users":{"alice":"fastest"}}`, "", "", `users.alice: unknown strategy "fastest"`},
+		{"invalid json", `{`, "", "", "parse "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "balancer.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			setup, err := parseBalancerConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := setup.forUser("bob").Name(); got != tt.wantDef {
+				t.Fatalf("default = %s, want %s", got, tt.wantDef)
+			}
+			if got := setup.forUser("alice").Name(); got != tt.wantUser {
+				t.Fatalf("alice = %s, want %s", got, tt.wantUser)
+			}
+		})
+	}
+
+	setup, err := parseBalancerConfig("")
+	if err != nil || setup.forUser("alice").Name() != defaultBalancerStrategy {
+		t.Fatalf("empty path: %v, %v", setup, err)
+	}
+}
+
+func TestGetConnectionSkipsTriedConnections(t *testing.T) {
+	pool := &ConnectionPool{Users: map[string]*UserConnections{"u": testConnections(1, 1)}}
+
+	first, err := pool.GetConnection("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.GetConnection("u", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("retry picked the connection that already failed")
+	}
+	if uc, err := pool.GetConnection("u", first, second); err == nil {
+		t.Fatalf("all connections tried, got %p", uc)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- 配置文件 ---
+// PROXY_CONFIG 指向 YAML 配置文件（示例见 proxy.example.yaml），未设置时只使用内置默认值和环境变量。
+// 优先级：环境变量 > 配置文件 > 内置默认值；每个配置项对应的环境变量见下方结构体的 env 标签，
+// 例如 timeouts.request 对应 REQUEST_TIMEOUT，auth.api_key 对应 AUTH_API_KEY。
+// 启动时校验全部配置，错误信息以配置项路径开头（如 "timeouts.request: must be positive, got 0s"），
+// 来自环境变量的值会同时注明变量名。
+//
+// 运行中收到 SIGHUP 或配置文件被修改时会重新加载，不影响已有的浏览器连接（见 reload.go）。
+//
+// OTEL_* 追踪配置沿用 OpenTelemetry 的标准环境变量，不在此文件中（见 tracing.go）。
+
+// proxyConfig 是完整的服务器配置，加载并校验后只读，通过 currentConfig 访问
+type proxyConfig struct {
+	Listen       listenConfig       `yaml:"listen"`
+	Timeouts     timeoutsConfig     `yaml:"timeouts"`
+	Upstream     upstreamConfig     `yaml:"upstream"`
+	Auth         authConfig         `yaml:"auth"`
+	Routing      routingConfig      `yaml:"routing"`
+	Logging      loggingConfig      `yaml:"logging"`
+	Transformers transformersConfig `yaml:"transformers"`
+	Reload       reloadSettings     `yaml:"reload"`
+}
+
+type listenConfig struct {
+	Addr   string `yaml:"addr" env:"LISTEN_ADDR"`
+	WSPath string `yaml:"ws_path" env:"WS_PATH"` // 浏览器 WebSocket 连接的路径
+}
+
+type timeoutsConfig struct {
+	Request        time.Duration `yaml:"request" env:"REQUEST_TIMEOUT"` // 等待浏览器完成响应的最长时间
+	WSRead         time.Duration `yaml:"ws_read" env:"WS_READ_TIMEOUT"` // 浏览器连接多久没有任何消息视为断开
+	WSHello        time.Duration `yaml:"ws_hello" env:"WS_HELLO_TIMEOUT"`
+	WSPingInterval time.Duration `yaml:"ws_ping_interval" env:"WS_PING_INTERVAL"` // 0 关闭失效连接清理
+	WSIdle         time.Duration `yaml:"ws_idle" env:"WS_IDLE_TIMEOUT"`
+	ModelsCacheTTL time.Duration `yaml:"models_cache_ttl" env:"MODELS_CACHE_TTL"`     // 0 不缓存
+	ShutdownDrain  time.Duration `yaml:"shutdown_drain" env:"SHUTDOWN_DRAIN_TIMEOUT"` // 退出前等待进行中请求的最长时间，见 shutdown.go
+}
+
+type upstreamConfig struct {
+	BaseURL            string        `yaml:"base_url" env:"UPSTREAM_BASE_URL"` // 浏览器端实际请求的 Gemini API 地址
+	MaxAttempts        int           `yaml:"max_attempts" env:"UPSTREAM_MAX_ATTEMPTS"`
+	RetryBackoff       time.Duration `yaml:"retry_backoff" env:"UPSTREAM_RETRY_BACKOFF"`
+	RetryBackoffMax    time.Duration `yaml:"retry_backoff_max" env:"UPSTREAM_RETRY_BACKOFF_MAX"`
+	StreamCreditWindow int           `yaml:"stream_credit_window" env:"STREAM_CREDIT_WINDOW"` // 0 关闭流控
+}
+
+type authConfig struct {
+	APIKey      string    `yaml:"api_key" env:"AUTH_API_KEY"`
+	APIKeysFile string    `yaml:"api_keys_file" env:"API_KEYS_FILE"`
+	AdminAPIKey string    `yaml:"admin_api_key" env:"ADMIN_API_KEY"`
+	JWT         jwtConfig `yaml:"jwt"`
+	// AllowLegacyToken 在未配置 JWT 密钥时接受固定 token "valid-token-user-1"，仅用于本地测试
+	AllowLegacyToken bool `yaml:"allow_legacy_token" env:"ALLOW_LEGACY_WS_TOKEN"`
+}
+
+type jwtConfig struct {
+	Secret        string        `yaml:"secret" env:"JWT_SECRET"`
+	PublicKeyFile string        `yaml:"public_key_file" env:"JWT_PUBLIC_KEY_FILE"`
+	JWKSFile      string        `yaml:"jwks_file" env:"JWT_JWKS_FILE"`
+	Audience      string        `yaml:"audience" env:"JWT_AUDIENCE"`
+	Issuer        string        `yaml:"issuer" env:"JWT_ISSUER"`
+	UserClaim     string        `yaml:"user_claim" env:"JWT_USER_CLAIM"`
+	Leeway        time.Duration `yaml:"leeway" env:"JWT_LEEWAY"`
+}
+
+type routingConfig struct {
+	BalancerConfig string `yaml:"balancer_config" env:"BALANCER_CONFIG"` // 见 balancer.go
+}
+
+type loggingConfig struct {
+	BufferSize int           `yaml:"buffer_size" env:"LOG_BUFFER_SIZE"` // 内存中保留的日志条数
+	Dir        string        `yaml:"dir" env:"LOG_DIR"`                 // 持久化日志目录，见 logsink.go
+	FileMaxMB  int           `yaml:"file_max_mb" env:"LOG_FILE_MAX_MB"`
+	MaxAge     time.Duration `yaml:"max_age" env:"LOG_MAX_AGE"`
+	MaxFiles   int           `yaml:"max_files" env:"LOG_MAX_FILES"`
+}
+
+type transformersConfig struct {
+	ConfigFile string `yaml:"config_file" env:"TRANSFORMERS_CONFIG"` // 见 transformer_registry.go
+	// ThinkingBudgets 把 thinkingLevel / reasoning effort 映射为 thinkingBudget，
+	// 配置文件中的条目覆盖同名默认值，未知级别使用 high
+	ThinkingBudgets map[string]int `yaml:"thinking_budgets"`
+}
+
+type reloadSettings struct {
+	PollInterval time.Duration `yaml:"poll_interval" env:"CONFIG_POLL_INTERVAL"` // 检查配置文件修改时间的间隔，0 只响应 SIGHUP
+}
+
+func defaultConfig() *proxyConfig {
+	return &proxyConfig{
+		Listen: listenConfig{Addr: ":5345", WSPath: "/v1/ws"},
+		Timeouts: timeoutsConfig{
+			Request:        600 * time.Second,
+			WSRead:         60 * time.Second,
+			WSHello:        10 * time.Second,
+			WSPingInterval: 20 * time.Second,
+			WSIdle:         45 * time.Second,
+			ModelsCacheTTL: 5 * time.Minute,
+			ShutdownDrain:  30 * time.Second,
+		},
+		Upstream: upstreamConfig{
+			BaseURL:            "https://generativelanguage.googleapis.com",
+			MaxAttempts:        3,
+			RetryBackoff:       200 * time.Millisecond,
+			RetryBackoffMax:    2 * time.Second,
+			StreamCreditWindow: 32,
+		},
+		Auth: authConfig{JWT: jwtConfig{UserClaim: "sub", Leeway: 30 * time.Second}},
+		Logging: loggingConfig{
+			BufferSize: 1000,
+			FileMaxMB:  50,
+			MaxAge:     7 * 24 * time.Hour,
+			MaxFiles:   20,
+		},
+		Transformers: transformersConfig{
+			// Based on working example: high = 26240 tokens
+			ThinkingBudgets: map[string]int{"high": 26240, "medium": 13120, "low": 6560},
+		},
+		Reload: reloadSettings{PollInterval: 5 * time.Second},
+	}
+}
+
+// currentConfig 返回当前生效的配置，调用方不得修改（运行时状态见 reload.go）
+func currentConfig() *proxyConfig {
+	return currentState().config
+}
+
+// loadConfig 依次应用默认值、配置文件（path 为空时跳过）和环境变量，并校验结果
+func loadConfig(path string) (*proxyConfig, error) {
+	c := defaultConfig()
+	v := reflect.ValueOf(c).Elem()
+	var errs []error
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		// 空文件没有文档节点
+		if len(root.Content) > 0 {
+			decodeConfigNode(root.Content[0], v, "", &errs)
+		}
+	}
+	applyConfigEnv(v, "", &errs)
+	// 解析失败的配置项保留默认值，不会在校验中重复报错
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+func configKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// decodeConfigNode 把 YAML 节点写入配置结构体，错误以配置项路径开头
+func decodeConfigNode(node *yaml.Node, v reflect.Value, path string, errs *[]error) {
+	if node.Tag == "!!null" {
+		return // "key:" 未填写值时保留默认值
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			*errs = append(*errs, fmt.Errorf("%s: expected a mapping (line %d)", configPathOrRoot(path), node.Line))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			key := configKey(path, keyNode.Value)
+			field, ok := configField(v, keyNode.Value)
+			if !ok {
+				*errs = append(*errs, fmt.Errorf("%s: unknown key (line %d)", key, keyNode.Line))
+				continue
+			}
+			decodeConfigNode(valueNode, field, key, errs)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			*errs = append(*errs, fmt.Errorf("%s: expected a mapping (line %d)", path, node.Line))
+			return
+		}
+		// 与默认值合并，而不是整体替换
+		merged := reflect.MakeMap(v.Type())
+		for _, k := range v.MapKeys() {
+			merged.SetMapIndex(k, v.MapIndex(k))
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			key := configKey(path, keyNode.Value)
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if valueNode.Kind != yaml.ScalarNode {
+				*errs = append(*errs, fmt.Errorf("%s: expected a single value (line %d)", key, valueNode.Line))
+				continue
+			}
+			if err := setConfigValue(elem, valueNode.Value); err != nil {
+				*errs = append(*errs, fmt.Errorf("%s: %w (line %d)", key, err, valueNode.Line))
+				continue
+			}
+			merged.SetMapIndex(reflect.ValueOf(keyNode.Value), elem)
+		}
+		v.Set(merged)
+	default:
+		if node.Kind != yaml.ScalarNode {
+			*errs = append(*errs, fmt.Errorf("%s: expected a single value (line %d)", path, node.Line))
+			return
+		}
+		if err := setConfigValue(v, node.Value); err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %w (line %d)", path, err, node.Line))
+		}
+	}
+}
+
+func configPathOrRoot(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+// configField 按 yaml 标签查找结构体字段
+func configField(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("yaml") == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// applyConfigEnv 用已设置的环境变量覆盖配置项
+func applyConfigEnv(v reflect.Value, path string, errs *[]error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := configKey(path, f.Tag.Get("yaml"))
+		if f.Type.Kind() == reflect.Struct {
+			applyConfigEnv(v.Field(i), key, errs)
+			continue
+		}
+		name := f.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		if err := setConfigValue(v.Field(i), raw); err != nil {
+			*errs = append(*errs, fmt.Errorf("%s (env %s): %w", key, name, err))
+		}
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setConfigValue(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q (use e.g. 30s, 5m, 1h)", raw)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q (use true or false)", raw)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
+
+// validate 检查取值范围，返回所有错误
+func (c *proxyConfig) validate() []error {
+	var errs []error
+	bad := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	positive := func(key string, d time.Duration) {
+		if d <= 0 {
+			bad(key, "must be positive, got %s", d)
+		}
+	}
+	nonNegative := func(key string, d time.Duration) {
+		if d < 0 {
+			bad(key, "must not be negative, got %s", d)
+		}
+	}
+
+	if c.Listen.Addr == "" {
+		bad("listen.addr", "must not be empty")
+	}
+	if !strings.HasPrefix(c.Listen.WSPath, "/") {
+		bad("listen.ws_path", "must start with /, got %q", c.Listen.WSPath)
+	}
+
+	positive("timeouts.request", c.Timeouts.Request)
+	positive("timeouts.ws_read", c.Timeouts.WSRead)
+	positive("timeouts.ws_hello", c.Timeouts.WSHello)
+	nonNegative("timeouts.ws_ping_interval", c.Timeouts.WSPingInterval)
+	nonNegative("timeouts.ws_idle", c.Timeouts.WSIdle)
+	if c.Timeouts.WSPingInterval > 0 && c.Timeouts.WSIdle < c.Timeouts.WSPingInterval {
+		// 空闲时间从最后一条消息算起，短于 ping 间隔时正常的连接也会在两次 ping 之间被清理
+		bad("timeouts.ws_idle", "must not be less than timeouts.ws_ping_interval (%s), got %s", c.Timeouts.WSPingInterval, c.Timeouts.WSIdle)
+	}
+	nonNegative("timeouts.models_cache_ttl", c.Timeouts.ModelsCacheTTL)
+	nonNegative("timeouts.shutdown_drain", c.Timeouts.ShutdownDrain)
+
+	if u, err := url.Parse(c.Upstream.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		bad("upstream.base_url", "must be an absolute http(s) URL, got %q", c.Upstream.BaseURL)
+	} else if strings.HasSuffix(c.Upstream.BaseURL, "/") {
+		bad("upstream.base_url", "must not end with /, got %q", c.Upstream.BaseURL)
+	}
+	if c.Upstream.MaxAttempts < 1 {
+		bad("upstream.max_attempts", "must be at least 1, got %d", c.Upstream.MaxAttempts)
+	}
+	nonNegative("upstream.retry_backoff", c.Upstream.RetryBackoff)
+	if c.Upstream.RetryBackoffMax < c.Upstream.RetryBackoff {
+		bad("upstream.retry_backoff_max", "must not be less than upstream.retry_backoff (%s), got %s", c.Upstream.RetryBackoff, c.Upstream.RetryBackoffMax)
+	}
+	if c.Upstream.StreamCreditWindow < 0 {
+		bad("upstream.stream_credit_window", "must not be negative, got %d", c.Upstream.StreamCreditWindow)
+	}
+
+	if jwt := c.Auth.JWT; jwt.Secret == "" && jwt.PublicKeyFile == "" && jwt.JWKSFile == "" && !c.Auth.AllowLegacyToken {
+		bad("auth.jwt", "one of secret, public_key_file or jwks_file is required to authenticate browser WebSocket clients "+
+			"(set auth.allow_legacy_token: true to accept the fixed token %q for local testing)", legacyAuthToken)
+	}
+	if c.Auth.JWT.UserClaim == "" {
+		bad("auth.jwt.user_claim", "must not be empty")
+	}
+	nonNegative("auth.jwt.leeway", c.Auth.JWT.Leeway)
+
+	if c.Logging.BufferSize < 1 {
+		bad("logging.buffer_size", "must be at least 1, got %d", c.Logging.BufferSize)
+	}
+	if c.Logging.FileMaxMB < 1 {
+		bad("logging.file_max_mb", "must be at least 1, got %d", c.Logging.FileMaxMB)
+	}
+	nonNegative("logging.max_age", c.Logging.MaxAge)
+	if c.Logging.MaxFiles < 0 {
+		bad("logging.max_files", "must not be negative, got %d", c.Logging.MaxFiles)
+	}
+
+	if _, ok := c.Transformers.ThinkingBudgets["high"]; !ok {
+		bad("transformers.thinking_budgets", `must define "high" (used for unknown levels)`)
+	}
+	levels := make([]string, 0, len(c.Transformers.ThinkingBudgets))
+	for level := range c.Transformers.ThinkingBudgets {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	for _, level := range levels {
+		// -1 表示由模型动态决定
+		if budget := c.Transformers.ThinkingBudgets[level]; budget < -1 {
+			bad("transformers.thinking_budgets."+level, "must be -1 (dynamic) or a non-negative token count, got %d", budget)
+		}
+	}
+
+	nonNegative("reload.poll_interval", c.Reload.PollInterval)
+	return errs
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validTestConfig 返回能通过校验的默认配置（默认配置没有 JWT 密钥）
+func validTestConfig() *proxyConfig {
+	c := defaultConfig()
+	c.Auth.AllowLegacyToken = true
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *proxyConfig)
+		wantErr string // 空表示应当通过
+	}{
+		{"defaults with legacy token", func(c *proxyConfig) {}, ""},
+		{"JWT secret instead of legacy token", func(c *proxyConfig) { c.Auth.AllowLegacyToken = false; c.Auth.JWT.Secret = "s" }, ""},
+		{"no browser auth", func(c *proxyConfig) { c.Auth.AllowLegacyToken = false }, "auth.jwt: one of secret, public_key_file or jwks_file is required"},
+		{"empty listen addr", func(c *proxyConfig) { c.Listen.Addr = "" }, "listen.addr: must not be empty"},
+		{"ws path without slash", func(c *proxyConfig) { c.Listen.WSPath = "ws" }, "listen.ws_path: must start with /"},
+		{"zero request timeout", func(c *proxyConfig) { c.Timeouts.Request = 0 }, "timeouts.request: must be positive"},
+		{"negative drain", func(c *proxyConfig) { c.Timeouts.ShutdownDrain = -time.Second }, "timeouts.shutdown_drain: must not be negative"},
+		{"ws idle shorter than ping interval", func(c *proxyConfig) {
+			c.Timeouts.WSPingInterval, c.Timeouts.WSIdle = 20*time.Second, 10*time.Second
+		}, "timeouts.ws_idle: must not be less than timeouts.ws_ping_interval (20s), got 10s"},
+		{"ws idle equal to ping interval", func(c *proxyConfig) {
+			c.Timeouts.WSPingInterval, c.Timeouts.WSIdle = 20*time.Second, 20*time.Second
+		}, ""},
+		{"ws idle ignored when reaper is off", func(c *proxyConfig) {
+			c.Timeouts.WSPingInterval, c.Timeouts.WSIdle = 0, 0
+		}, ""},
+		{"relative base url", func(c *proxyConfig) { c.Upstream.BaseURL = "example.com" }, "upstream.base_url: must be an absolute http(s) URL"},
+		{"base url with trailing slash", func(c *proxyConfig) { c.Upstream.BaseURL = "https://example.com/" }, "upstream.base_url: must not end with /"},
+		{"no attempts", func(c *proxyConfig) { c.Upstream.MaxAttempts = 0 }, "upstream.max_attempts: must be at least 1"},
+		{"backoff max below backoff", func(c *proxyConfig) {
+			c.Upstream.RetryBackoff, c.Upstream.RetryBackoffMax = time.Second, time.Millisecond
+		}, "upstream.retry_backoff_max: must not be less than upstream.retry_backoff"},
+		{"negative credit window", func(c *proxyConfig) { c.Upstream.StreamCreditWindow = -1 }, "upstream.stream_credit_window: must not be negative"},
+		{"empty user claim", func(c *proxyConfig) { c.Auth.JWT.UserClaim = "" }, "auth.jwt.user_claim: must not be empty"},
+		{"zero log buffer", func(c *proxyConfig) { c.Logging.BufferSize = 0 }, "logging.buffer_size: must be at least 1"},
+		{"thinking budgets without high", func(c *proxyConfig) { c.Transformers.ThinkingBudgets = map[string]int{"low": 1} }, `transformers.thinking_budgets: must define "high"`},
+		{"invalid thinking budget", func(c *proxyConfig) { c.Transformers.ThinkingBudgets = map[string]int{"high": -2} }, "transformers.thinking_budgets.high: must be -1 (dynamic)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validTestConfig()
+			tt.modify(c)
+			errs := c.validate()
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Fatalf("validate() = %v, want no errors", errs)
+				}
+				return
+			}
+			for _, err := range errs {
+				if strings.Contains(err.Error(), tt.wantErr) {
+					return
+				}
+			}
+			t.Fatalf("validate() = %v, want an error containing %q", errs, tt.wantErr)
+		})
+	}
+}
+
+// clearConfigEnv 清空所有配置项对应的环境变量，避免运行测试的环境影响结果
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	var walk func(rt reflect.Type)
+	walk = func(rt reflect.Type) {
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+			} else if name := f.Tag.Get("env"); name != "" {
+				t.Setenv(name, "")
+			}
+		}
+	}
+	walk(reflect.TypeOf(proxyConfig{}))
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+auth:
+  allow_legacy_token: true
+timeouts:
+  request: 2m
+  ws_idle:
+upstream:
+  max_attempts: 5
+transformers:
+  thinking_budgets:
+    low: 100
+`)
+	clearConfigEnv(t)
+	t.Setenv("UPSTREAM_MAX_ATTEMPTS", "7")
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := defaultConfig()
+	if c.Timeouts.Request != 2*time.Minute {
+		t.Errorf("timeouts.request = %s, want 2m from the file", c.Timeouts.Request)
+	}
+	if c.Timeouts.WSIdle != def.Timeouts.WSIdle {
+		t.Errorf("timeouts.ws_idle = %s, want the default for an empty value", c.Timeouts.WSIdle)
+	}
+	if c.Upstream.MaxAttempts != 7 {
+		t.Errorf("upstream.max_attempts = %d, want 7 from the environment", c.Upstream.MaxAttempts)
+	}
+	if c.Timeouts.WSRead != def.Timeouts.WSRead {
+		t.Errorf("timeouts.ws_read = %s, want the default", c.Timeouts.WSRead)
+	}
+	// map 与默认值合并
+	if c.Transformers.ThinkingBudgets["low"] != 100 || c.Transformers.ThinkingBudgets["high"] != def.Transformers.ThinkingBudgets["high"] {
+		t.Errorf("thinking_budgets = %v", c.Transformers.ThinkingBudgets)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		env      map[string]string
+		wantErrs []string
+	}{
+		{"unknown key", "auth:\n  allow_legacy_token: true\ntimeouts:\n  reqest: 1s\n", nil, []string{"timeouts.reqest: unknown key (line 4)"}},
+		{"bad duration", "auth:\n  allow_legacy_token: true\ntimeouts:\n  request: soon\n", nil, []string{`timeouts.request: invalid duration "soon"`}},
+		{"mapping expected", "auth: yes\n", nil, []string{"auth: expected a mapping (line 1)"}},
+		{"bad env value", "auth:\n  allow_legacy_token: true\n", map[string]string{"UPSTREAM_MAX_ATTEMPTS": "many"}, []string{`upstream.max_attempts (env UPSTREAM_MAX_ATTEMPTS): invalid integer "many"`}},
+		{"all errors reported", "timeouts:\n  ws_ping_interval: 1m\n  ws_idle: 30s\n", nil, []string{"timeouts.ws_idle: must not be less than", "auth.jwt: one of"}},
+		{"invalid YAML", "auth: [\n", nil, []string{"proxy.yaml: yaml:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := loadConfig(writeConfigFile(t, tt.config))
+			if err == nil {
+				t.Fatal("loadConfig() succeeded")
+			}
+			for _, want := range tt.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("loadConfig() error = %v, want containing %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// --- OpenAI /v1/embeddings 兼容层 ---
+// 单个字符串 input 映射为 embedContent，数组 input 映射为 batchEmbedContents。
+// batchEmbedContents 每次最多接受 embeddingsBatchLimit 个请求，更长的数组按顺序分批发送，结果按原顺序合并。
+
+// embeddingsBatchLimit 是 batchEmbedContents 单次请求的条数上限
+const embeddingsBatchLimit = 100
+
+type openAIEmbeddingRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	Dimensions     *int            `json:"dimensions,omitempty"`
+	EncodingFormat string          `json:"encoding_format,omitempty"` // float, base64
+}
+
+type openAIEmbedding struct {
+	Object    string      `json:"object"`
+	Index     int         `json:"index"`
+	Embedding interface{} `json:"embedding"` // []float64 或 base64 字符串
+}
+
+type openAIEmbeddingResponse struct {
+	Object string            `json:"object"`
+	Data   []openAIEmbedding `json:"data"`
+	Model  string            `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+type geminiEmbedContentRequest struct {
+	Model                string        `json:"model,omitempty"`
+	Content              geminiContent `json:"content"`
+	OutputDimensionality *int          `json:"outputDimensionality,omitempty"`
+}
+
+type geminiEmbedding struct {
+	Values []float64 `json:"values"`
+}
+
+func handleOpenAIEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	apiKey, err := authenticateHTTPRequest(r)
+	if err != nil {
+		writeOpenAIError(w, http.StatusUnauthorized, "Proxy authentication failed", "")
+		return
+	}
+
+	var req openAIEmbeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error(), "")
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Model == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "'model' is required", "")
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("unsupported encoding_format %q", req.EncodingFormat), "")
+		return
+	}
+
+	inputs, batch, err := parseEmbeddingInput(req.Input)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+
+	model := strings.TrimPrefix(req.Model, "models/")
+	method := "embedContent"
+	if batch {
+		method = "batchEmbedContents"
+	}
+	chunks := splitEmbeddingInputs(inputs, embeddingsBatchLimit)
+
+	reqID := uuid.NewString()
+	addLog("INFO", fmt.Sprintf("[OPENAI %s] embeddings model=%s inputs=%d", reqID, req.Model, len(inputs)), map[string]interface{}{
+		"request_id":  reqID,
+		"user_id":     apiKey.UserID,
+		"key_label":   apiKey.Label,
+		"model":       req.Model,
+		"input_count": len(inputs),
+		"dimensions":  req.Dimensions,
+		"method":      method,
+		"batches":     len(chunks),
+	})
+
+	out := openAIEmbeddingResponse{Object: "list", Model: req.Model, Data: make([]openAIEmbedding, 0, len(inputs))}
+	for i, chunk := range chunks {
+		var payload interface{}
+		if batch {
+			requests := make([]geminiEmbedContentRequest, 0, len(chunk))
+			for _, input := range chunk {
+				requests = append(requests, geminiEmbedContentRequest{
+					Model:                "models/" + model,
+					Content:              geminiContent{Parts: []geminiPart{{Text: input}}},
+					OutputDimensionality: req.Dimensions,
+				})
+			}
+			payload = map[string]interface{}{"requests": requests}
+		} else {
+			payload = geminiEmbedContentRequest{
+				Content:              geminiContent{Parts: []geminiPart{{Text: chunk[0]}}},
+				OutputDimensionality: req.Dimensions,
+			}
+		}
+		bodyBytes, err := json.Marshal(payload)
+		if err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, "Failed to build Gemini request", "")
+			return
+		}
+
+		id := reqID
+		if len(chunks) > 1 {
+			id = fmt.Sprintf("%s-b%d", reqID, i+1)
+		}
+		t := &openAIEmbeddingsTranslator{inputs: chunk, batch: batch}
+		tw := newTranslatingWriter(w, t, false)
+		upstream := &upstreamRequest{
+			ID:       id,
+			UserID:   apiKey.UserID,
+			KeyLabel: apiKey.Label,
+			Route:    r.URL.Path,
+			Model:    model,
+			Method:   http.MethodPost,
+			Path:     "/v1beta/models/" + url.PathEscape(model) + ":" + method,
+			Headers:  map[string][]string{"Content-Type": {"application/json"}},
+		}
+		upstream.Body = applyRequestTransformers(r.Context(), upstream.transformContext(), bodyBytes)
+		dispatchUpstream(tw, r, upstream)
+		tw.finish()
+		// 失败时错误已经写给客户端，已完成的批次一并丢弃
+		if !t.ok {
+			return
+		}
+
+		for _, e := range t.embeddings {
+			var vector interface{} = e.Values
+			if req.EncodingFormat == "base64" {
+				vector = encodeEmbeddingBase64(e.Values)
+			}
+			out.Data = append(out.Data, openAIEmbedding{Object: "embedding", Index: len(out.Data), Embedding: vector})
+		}
+		out.Usage.PromptTokens += t.promptTokens
+	}
+	out.Usage.TotalTokens = out.Usage.PromptTokens
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(out)
+}
+
+// splitEmbeddingInputs 把 inputs 按顺序切分为每批最多 size 个
+func splitEmbeddingInputs(inputs []string, size int) [][]string {
+	var chunks [][]string
+	for len(inputs) > size {
+		chunks = append(chunks, inputs[:size])
+		inputs = inputs[size:]
+	}
+	return append(chunks, inputs)
+}
+
+// parseEmbeddingInput 解析 input，batch 表示调用方传入的是数组
+func parseEmbeddingInput(raw json.RawMessage) ([]string, bool, error) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		if single == "" {
+			return nil, false, errors.New("'input' cannot be an empty string")
+		}
+		return []string{single}, false, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, false, errors.New("'input' must be a string or an array of strings; token arrays are not supported")
+	}
+	if len(list) == 0 {
+		return nil, false, errors.New("'input' cannot be an empty array")
+	}
+	return list, true, nil
+}
+
+// openAIEmbeddingsTranslator 解析一次 embedContent / batchEmbedContents 的结果，成功时不写响应
+// （由 handleOpenAIEmbeddings 合并各批后写出），失败时以 OpenAI 格式写出错误
+type openAIEmbeddingsTranslator struct {
+	inputs []string
+	batch  bool
+
+	ok           bool
+	embeddings   []geminiEmbedding
+	promptTokens int
+}
+
+func (t *openAIEmbeddingsTranslator) fail(w http.ResponseWriter, status int, message, code string) {
+	writeOpenAIError(w, status, message, code)
+}
+
+func (t *openAIEmbeddingsTranslator) complete(w http.ResponseWriter, body []byte) {
+	var resp struct {
+		Embedding     *geminiEmbedding     `json:"embedding"`
+		Embeddings    []geminiEmbedding    `json:"embeddings"`
+		UsageMetadata *geminiUsageMetadata `json:"usageMetadata"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("[OPENAI] Failed to parse Gemini embeddings: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "Invalid response from upstream: "+err.Error(), "")
+		return
+	}
+	embeddings := resp.Embeddings
+	if !t.batch && resp.Embedding != nil {
+		embeddings = []geminiEmbedding{*resp.Embedding}
+	}
+	if len(embeddings) != len(t.inputs) {
+		writeOpenAIError(w, http.StatusBadGateway, fmt.Sprintf("Upstream returned %d embeddings for %d inputs", len(embeddings), len(t.inputs)), "")
+		return
+	}
+	t.embeddings = embeddings
+
+	// embedContent 通常不返回 token 用量，此时按约 4 字符/token 估算
+	if resp.UsageMetadata != nil && resp.UsageMetadata.PromptTokenCount > 0 {
+		t.promptTokens = resp.UsageMetadata.PromptTokenCount
+	} else {
+		for _, input := range t.inputs {
+			t.promptTokens += (len([]rune(input)) + 3) / 4
+		}
+	}
+	t.ok = true
+}
+
+func (t *openAIEmbeddingsTranslator) streamEvent(w http.ResponseWriter, data []byte) {}
+
+func (t *openAIEmbeddingsTranslator) streamEnd(w http.ResponseWriter) {}
+
+// encodeEmbeddingBase64 按 OpenAI encoding_format=base64 的约定编码（小端 float32）
+func encodeEmbeddingBase64(values []float64) string {
+	buf := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
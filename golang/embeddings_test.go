@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSplitEmbeddingInputs(t *testing.T) {
+	inputs := func(n int) []string {
+		s := make([]string, n)
+		for i := range s {
+			s[i] = fmt.Sprint(i)
+		}
+		return s
+	}
+	tests := []struct {
+		n    int
+		want []int
+	}{
+		{1, []int{1}},
+		{100, []int{100}},
+		{101, []int{100, 1}},
+		{250, []int{100, 100, 50}},
+	}
+	for _, tt := range tests {
+		in := inputs(tt.n)
+		chunks := splitEmbeddingInputs(in, embeddingsBatchLimit)
+		var sizes []int
+		var joined []string
+		for _, c := range chunks {
+			sizes = append(sizes, len(c))
+			joined = append(joined, c...)
+		}
+		if !reflect.DeepEqual(sizes, tt.want) || !reflect.DeepEqual(joined, in) {
+			t.Errorf("splitEmbeddingInputs(%d inputs) sizes = %v, want %v (order preserved: %v)", tt.n, sizes, tt.want, reflect.DeepEqual(joined, in))
+		}
+	}
+}
+
+func TestOpenAIEmbeddingsTranslator(t *testing.T) {
+	tests := []struct {
+		name       string
+		inputs     []string
+		batch      bool
+		body       string
+		wantOK     bool
+		wantTokens int
+	}{
+		{"single", []string{"abcd"}, false, `{"embedding":{"values":[0.5]}}`, true, 1},
+		{"batch with usage", []string{"a", "b"}, true, `{"embeddings":[{"values":[1]},{"values":[2]}],"usageMetadata":{"promptTokenCount":7}}`, true, 7},
+		{"count mismatch", []string{"a", "b"}, true, `{"embeddings":[{"values":[1]}]}`, false, 0},
+		{"invalid json", []string{"a"}, false, `nope`, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tr := &openAIEmbeddingsTranslator{inputs: tt.inputs, batch: tt.batch}
+			tr.complete(rec, []byte(tt.body))
+			if tr.ok != tt.wantOK || tr.promptTokens != tt.wantTokens {
+				t.Fatalf("ok=%v tokens=%d, want ok=%v tokens=%d", tr.ok, tr.promptTokens, tt.wantOK, tt.wantTokens)
+			}
+			if tt.wantOK && rec.Body.Len() != 0 {
+				t.Fatalf("successful batch should not write, got %s", rec.Body)
+			}
+			if !tt.wantOK && rec.Code != 502 {
+				t.Fatalf("status = %d, want 502", rec.Code)
+			}
+		})
+	}
+}
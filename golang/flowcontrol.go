@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// --- 流式响应的流量控制 ---
+// 对握手时声明了 flow_control 功能的浏览器（见 handshake.go），http_request 的 payload 带
+// "flow_control": {"window": N}。浏览器在未获得额度时不发送 stream_chunk：初始额度为 N 个数据块，
+// 服务器每把数据块写给 HTTP 客户端后通过 credit 消息补充：
+//
+//	{"id": "...", "type": "credit", "payload": {"chunks": 16}}
+//
+// 每个请求最多缓冲 N 个数据块，HTTP 客户端读得慢时只有对应的浏览器 fetch 暂停读取，
+// 同一连接上的其他请求不受影响。浏览器不遵守额度导致通道满时，readPump 最多等待
+// flowControlDeliverTimeout，之后让这个请求失败，而不是继续阻塞同一连接上的其他请求。
+// 未声明该功能的客户端照常发送，通道满时 readPump 不等待（否则同一连接上的其他请求都会暂停），
+// 消息按顺序排进该请求自己的溢出队列，由单独的协程转入通道，不会丢弃；
+// 只有队列超过 legacyOverflowLimit 时才让这个请求失败。
+// 请求因此失败时计入 aistudio_proxy_dropped_messages_total{reason="buffer_full"}。
+// N 为配置项 upstream.stream_credit_window（见 config.go），为 0 时不启用流控。
+
+const (
+	// legacyRespChanSize 未启用流控时每个请求的通道容量
+	legacyRespChanSize = 256
+	// legacyOverflowLimit 未启用流控时通道满后每个请求最多排队的消息数，防止内存无限增长
+	legacyOverflowLimit = 8192
+)
+
+// flowControlDeliverTimeout 启用流控时通道满后 readPump 最多等待的时间（测试中会调小）
+var flowControlDeliverTimeout = 2 * time.Second
+
+// pendingRequest 是一个等待浏览器响应的请求，由 pendingRequests 按WS消息ID索引
+type pendingRequest struct {
+	ch   chan *WSMessage
+	done chan struct{} // 处理函数返回时关闭，阻塞中的投递随之放弃
+
+	// 消息无法投递（溢出队列超出上限或等待超时）时关闭 overflowed，processWebSocketResponse 随之结束该请求
+	flowControlled bool
+	overflowed     chan struct{}
+	overflowOnce   sync.Once
+
+	// 未启用流控时通道满后的消息按顺序排在 queue 中，由 forward 协程转入 ch
+	queueMu    sync.Mutex
+	queue      []*WSMessage
+	forwarding bool // forward 协程运行中，可能持有一条已出队、尚未转入 ch 的消息
+}
+
+// newPendingRequest 创建等待响应的请求，window 为 0 表示不使用流控
+func newPendingRequest(window int) *pendingRequest {
+	size := legacyRespChanSize
+	if window > 0 {
+		// 额外容量留给不占额度的 stream_start、stream_end、error 等消息
+		size = window + 4
+	}
+	return &pendingRequest{
+		ch:             make(chan *WSMessage, size),
+		done:           make(chan struct{}),
+		flowControlled: window > 0,
+		overflowed:     make(chan struct{}),
+	}
+}
+
+// deliver 把消息交给处理函数，返回丢弃消息的原因（用作指标的 reason 标签），投递成功时返回空。
+// 启用流控时通道满则等待（浏览器遵守额度时不会发生），超时后丢弃消息并标记请求溢出；
+// 未启用时不等待，通道满则放入溢出队列
+func (p *pendingRequest) deliver(msg *WSMessage) string {
+	if !p.flowControlled {
+		return p.enqueue(msg)
+	}
+	select {
+	case p.ch <- msg:
+		return ""
+	case <-p.done:
+		return "request_finished"
+	default:
+	}
+	timer := time.NewTimer(flowControlDeliverTimeout)
+	defer timer.Stop()
+	select {
+	case p.ch <- msg:
+		return ""
+	case <-p.done:
+		return "request_finished"
+	case <-timer.C:
+		p.overflow()
+		return "buffer_full"
+	}
+}
+
+// enqueue 投递未启用流控的请求的消息：队列为空时直接放入通道，否则排在队列末尾保持顺序
+func (p *pendingRequest) enqueue(msg *WSMessage) string {
+	select {
+	case <-p.done:
+		return "request_finished"
+	default:
+	}
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	if !p.forwarding {
+		select {
+		case p.ch <- msg:
+			return ""
+		default:
+		}
+	}
+	if len(p.queue) >= legacyOverflowLimit {
+		p.overflow()
+		return "buffer_full"
+	}
+	p.queue = append(p.queue, msg)
+	if !p.forwarding {
+		p.forwarding = true
+		go p.forward()
+	}
+	return ""
+}
+
+// forward 把溢出队列中的消息依次转入通道，队列清空或请求结束时退出
+func (p *pendingRequest) forward() {
+	for {
+		p.queueMu.Lock()
+		if len(p.queue) == 0 {
+			p.forwarding = false
+			p.queueMu.Unlock()
+			return
+		}
+		msg := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.queueMu.Unlock()
+
+		select {
+		case p.ch <- msg:
+		case <-p.done:
+			p.queueMu.Lock()
+			p.queue = nil
+			p.forwarding = false
+			p.queueMu.Unlock()
+			return
+		}
+	}
+}
+
+// overflow 标记请求溢出，processWebSocketResponse 随之以 502 结束该请求
+func (p *pendingRequest) overflow() {
+	p.overflowOnce.Do(func() { close(p.overflowed) })
+}
+
+// finish 在处理函数返回时调用
+func (p *pendingRequest) finish() {
+	close(p.done)
+}
+
+// flowControlWindow 返回发往该连接的请求使用的额度，不使用流控时返回 0。
+// 额度在请求开始时确定，请求处理期间不随配置变化
+func flowControlWindow(conn *UserConnection) int {
+	if !conn.Client.HasFeature(featureFlowControl) {
+		return 0
+	}
+	return currentConfig().Upstream.StreamCreditWindow
+}
+
+// chunkConsumed 在一个 stream_chunk 写给 HTTP 客户端后调用，
+// 攒够半个窗口再补充额度，避免每个数据块都回一条 credit 消息
+func (a *upstreamAttempt) chunkConsumed() {
+	if a.window == 0 {
+		return
+	}
+	a.unacked++
+	if a.unacked < (a.window+1)/2 {
+		return
+	}
+	n := a.unacked
+	a.unacked = 0
+	err := a.conn.safeWriteJSON(WSMessage{ID: a.wsID, Type: "credit", Payload: map[string]interface{}{"chunks": n}})
+	if err != nil {
+		// 连接已断开，readPump 会结束此请求
+		log.Printf("[FLOW %s] Failed to send credit over WebSocket: %v", a.req.ID, err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPendingRequestDeliverWithoutFlowControl(t *testing.T) {
+	p := newPendingRequest(0)
+	defer p.finish()
+
+	// 通道满后不阻塞 readPump，也不丢弃：消息排进溢出队列，按顺序到达处理函数
+	const n = legacyRespChanSize + 100
+	result := make(chan string, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if reason := p.deliver(&WSMessage{ID: fmt.Sprint(i), Type: "stream_chunk"}); reason != "" {
+				result <- fmt.Sprintf("deliver #%d dropped: %s", i, reason)
+				return
+			}
+		}
+		result <- ""
+	}()
+	select {
+	case err := <-result:
+		if err != "" {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deliver blocked on a full channel without flow control")
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-p.ch:
+			if msg.ID != fmt.Sprint(i) {
+				t.Fatalf("message #%d = %s, out of order", i, msg.ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message #%d never arrived", i)
+		}
+	}
+	select {
+	case <-p.overflowed:
+		t.Fatal("overflowed closed while the queue was within its limit")
+	default:
+	}
+}
+
+func TestPendingRequestOverflowLimit(t *testing.T) {
+	p := newPendingRequest(0)
+	msg := &WSMessage{Type: "stream_chunk"}
+	delivered := 0
+	for p.deliver(msg) == "" {
+		delivered++
+		if delivered > legacyRespChanSize+legacyOverflowLimit+1 {
+			t.Fatal("overflow queue grew past its limit")
+		}
+	}
+	// 通道和队列都满了（forward 协程可能还持有一条已出队的消息）
+	if full := legacyRespChanSize + legacyOverflowLimit; delivered != full && delivered != full+1 {
+		t.Fatalf("delivered %d messages before overflowing, want %d or %d", delivered, full, full+1)
+	}
+	select {
+	case <-p.overflowed:
+	default:
+		t.Fatal("overflowed was not closed")
+	}
+	// 再次溢出不会重复关闭通道
+	if reason := p.deliver(msg); reason != "buffer_full" {
+		t.Fatalf("second overflow = %q", reason)
+	}
+
+	p.finish()
+	if reason := p.deliver(msg); reason != "request_finished" {
+		t.Fatalf("deliver after finish = %q, want request_finished", reason)
+	}
+}
+
+func TestPendingRequestDeliverWithFlowControl(t *testing.T) {
+	old := flowControlDeliverTimeout
+	flowControlDeliverTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { flowControlDeliverTimeout = old })
+
+	p := newPendingRequest(2)
+	msg := &WSMessage{Type: "stream_chunk"}
+	for i := 0; i < cap(p.ch); i++ {
+		if reason := p.deliver(msg); reason != "" {
+			t.Fatalf("deliver #%d dropped: %s", i, reason)
+		}
+	}
+
+	// 启用流控时通道满则等待，直到处理函数取走消息
+	result := make(chan string, 1)
+	go func() { result <- p.deliver(msg) }()
+	select {
+	case reason := <-result:
+		t.Fatalf("deliver returned %q instead of blocking", reason)
+	case <-time.After(20 * time.Millisecond):
+	}
+	<-p.ch
+	if reason := <-result; reason != "" {
+		t.Fatalf("deliver after a message was consumed = %q", reason)
+	}
+
+	// 浏览器不遵守额度、处理函数一直不取时，等待超时后让请求失败
+	start := time.Now()
+	if reason := p.deliver(msg); reason != "buffer_full" {
+		t.Fatalf("deliver on a stalled request = %q, want buffer_full", reason)
+	}
+	if waited := time.Since(start); waited < flowControlDeliverTimeout {
+		t.Fatalf("gave up after %s, before the %s timeout", waited, flowControlDeliverTimeout)
+	}
+	select {
+	case <-p.overflowed:
+	default:
+		t.Fatal("overflowed was not closed after the timeout")
+	}
+
+	// 请求结束后放弃等待
+	go func() { result <- p.deliver(msg) }()
+	p.finish()
+	if reason := <-result; reason != "request_finished" {
+		t.Fatalf("deliver after finish = %q, want request_finished", reason)
+	}
+}
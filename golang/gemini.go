@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Gemini API 的请求/响应结构，供各兼容层（OpenAI 等）在两种格式之间转换时使用。
+// 原生代理路径不解析请求体，不依赖这些类型。
+
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []geminiTool            `json:"tools,omitempty"`
+	ToolConfig        *geminiToolConfig       `json:"toolConfig,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	ThoughtSignature string                  `json:"thoughtSignature,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+	FileData         *geminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"` // base64
+}
+
+type geminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type geminiFunctionCall struct {
+	ID   string                 `json:"id,omitempty"`
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args"`
+}
+
+type geminiFunctionResponse struct {
+	ID       string                 `json:"id,omitempty"`
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type geminiToolConfig struct {
+	FunctionCallingConfig *geminiFunctionCallingConfig `json:"functionCallingConfig,omitempty"`
+}
+
+type geminiFunctionCallingConfig struct {
+	Mode                 string   `json:"mode"` // AUTO, ANY, NONE
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature        *float64              `json:"temperature,omitempty"`
+	TopP               *float64              `json:"topP,omitempty"`
+	TopK               *int                  `json:"topK,omitempty"`
+	MaxOutputTokens    *int                  `json:"maxOutputTokens,omitempty"`
+	CandidateCount     *int                  `json:"candidateCount,omitempty"`
+	StopSequences      []string              `json:"stopSequences,omitempty"`
+	PresencePenalty    *float64              `json:"presencePenalty,omitempty"`
+	FrequencyPenalty   *float64              `json:"frequencyPenalty,omitempty"`
+	Seed               *int64                `json:"seed,omitempty"`
+	ResponseMimeType   string                `json:"responseMimeType,omitempty"`
+	ResponseJSONSchema interface{}           `json:"responseJsonSchema,omitempty"`
+	ThinkingConfig     *geminiThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type geminiThinkingConfig struct {
+	ThinkingBudget  *int `json:"thinkingBudget,omitempty"`
+	IncludeThoughts bool `json:"includeThoughts,omitempty"`
+}
+
+type geminiResponse struct {
+	Candidates     []geminiCandidate     `json:"candidates"`
+	PromptFeedback *geminiPromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  *geminiUsageMetadata  `json:"usageMetadata,omitempty"`
+	ModelVersion   string                `json:"modelVersion,omitempty"`
+	ResponseID     string                `json:"responseId,omitempty"`
+}
+
+type geminiCandidate struct {
+	Content      geminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+type geminiPromptFeedback struct {
+	BlockReason string `json:"blockReason,omitempty"`
+}
+
+type geminiUsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+}
+
+// geminiModelPath 构建 generateContent / streamGenerateContent 的请求路径
+func geminiModelPath(model string, stream bool) string {
+	model = url.PathEscape(strings.TrimPrefix(model, "models/"))
+	if stream {
+		return "/v1beta/models/" + model + ":streamGenerateContent?alt=sse"
+	}
+	return "/v1beta/models/" + model + ":generateContent"
+}
+
+// toolCallSignatureSep 分隔工具调用 id 和其中携带的 thoughtSignature。
+// Gemini 在 functionCall part 上返回 thoughtSignature，下一轮必须原样带回；
+// Anthropic tool_use 没有对应字段，但客户端会在历史中原样带回 id，因此把签名编码进 id
+// （OpenAI tool_calls 的签名保存在服务器端，见 openAIToolSignatures）
+const toolCallSignatureSep = "__sig_"
+
+// toolCallIDWithSignature 把 thoughtSignature 编码进工具调用 id（base64url，只含 id 允许的字符）
+func toolCallIDWithSignature(id, signature string) string {
+	if signature == "" {
+		return id
+	}
+	return id + toolCallSignatureSep + base64.RawURLEncoding.EncodeToString([]byte(signature))
+}
+
+// splitToolCallSignature 从工具调用 id 中取出 toolCallIDWithSignature 编码的 thoughtSignature，没有时返回空
+func splitToolCallSignature(id string) string {
+	i := strings.LastIndex(id, toolCallSignatureSep)
+	if i < 0 {
+		return ""
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(id[i+len(toolCallSignatureSep):])
+	if err != nil {
+		return ""
+	}
+	return string(signature)
+}
+
+// parseGeminiError 从 Gemini 错误响应体中提取错误信息，
+// 非 JSON 的响应体（例如代理自身的 http.Error 文本）按原文返回
+func parseGeminiError(body []byte) (message, status string) {
+	var errBody struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errBody); err == nil && errBody.Error.Message != "" {
+		return errBody.Error.Message, errBody.Error.Status
+	}
+	return strings.TrimSpace(string(body)), ""
+}
+
+// writeGeminiError 以 Gemini（Google API）错误格式写出响应，status 为 UNAVAILABLE 等 gRPC 状态名
+func writeGeminiError(w http.ResponseWriter, code int, message, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"status":  status,
+		},
+	})
+}
+
+// sseDecoder 将任意切分的 SSE 字节流还原为完整事件的 data 内容
+type sseDecoder struct {
+	buf  []byte
+	data [][]byte
+}
+
+// feed 写入一段数据，返回其中已完整的事件
+func (d *sseDecoder) feed(p []byte) [][]byte {
+	d.buf = append(d.buf, p...)
+	var events [][]byte
+	for {
+		i := bytes.IndexByte(d.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(d.buf[:i], "\r")
+		d.buf = d.buf[i+1:]
+		if event := d.line(line); event != nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// flush 返回流结束时尚未以空行结尾的最后一个事件
+func (d *sseDecoder) flush() [][]byte {
+	var events [][]byte
+	if len(d.buf) > 0 {
+		if event := d.line(bytes.TrimRight(d.buf, "\r")); event != nil {
+			events = append(events, event)
+		}
+		d.buf = nil
+	}
+	if event := d.line(nil); event != nil {
+		events = append(events, event)
+	}
+	return events
+}
+
+func (d *sseDecoder) line(line []byte) []byte {
+	if len(line) == 0 {
+		if len(d.data) == 0 {
+			return nil
+		}
+		event := bytes.Join(d.data, []byte("\n"))
+		d.data = nil
+		return event
+	}
+	if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+		d.data = append(d.data, bytes.TrimPrefix(data, []byte(" ")))
+	}
+	return nil
+}
+
+// responseTranslator 将 Gemini 响应转换为某种兼容格式（OpenAI、Anthropic 等）
+type responseTranslator interface {
+	// complete 写出非流式响应，body 为完整的 Gemini 响应体
+	complete(w http.ResponseWriter, body []byte)
+	// streamEvent 写出一个 Gemini SSE 事件对应的内容，响应头已由 translatingWriter 写出
+	streamEvent(w http.ResponseWriter, data []byte)
+	// streamEnd 写出流的结尾
+	streamEnd(w http.ResponseWriter)
+	// fail 以兼容格式写出错误，message/code 取自 Gemini 错误响应
+	fail(w http.ResponseWriter, status int, message, code string)
+}
+
+// streamFailTranslator 由支持流式输出的 responseTranslator 实现：
+// 流在中途中断（浏览器报错、连接断开、超时、服务器关闭）时写出兼容格式的错误事件，
+// 而不是 streamEnd 的正常结尾，避免客户端把截断的回答当作完整结果
+type streamFailTranslator interface {
+	streamFail(w http.ResponseWriter, status int, message string)
+}
+
+// translatingWriter 实现 http.ResponseWriter，接收 processWebSocketResponse 写出的
+// Gemini 响应（状态码、响应头、响应体/SSE 数据块），交给 responseTranslator 转换后写到底层 w。
+// 上游响应头不会被转发，兼容格式使用自己的响应头。
+type translatingWriter struct {
+	w      http.ResponseWriter
+	t      responseTranslator
+	stream bool
+	header http.Header
+
+	status int
+	buf    bytes.Buffer // 非流式响应体或错误响应体
+	sse    sseDecoder
+
+	// 流在中途中断时由 processWebSocketResponse 设置（见 abortStream）
+	abortStatus  int
+	abortMessage string
+}
+
+func newTranslatingWriter(w http.ResponseWriter, t responseTranslator, stream bool) *translatingWriter {
+	return &translatingWriter{w: w, t: t, stream: stream, header: make(http.Header)}
+}
+
+func (tw *translatingWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *translatingWriter) WriteHeader(status int) {
+	if tw.status != 0 {
+		return
+	}
+	tw.status = status
+	if tw.stream && status < 400 {
+		tw.w.Header().Set("Content-Type", "text/event-stream")
+		tw.w.Header().Set("Cache-Control", "no-cache")
+		tw.w.Header().Set("Connection", "keep-alive")
+		tw.w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (tw *translatingWriter) Write(p []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if !tw.stream || tw.status >= 400 {
+		return tw.buf.Write(p)
+	}
+	for _, event := range tw.sse.feed(p) {
+		tw.t.streamEvent(tw.w, event)
+	}
+	return len(p), nil
+}
+
+func (tw *translatingWriter) Flush() {
+	if tw.stream && tw.status > 0 && tw.status < 400 {
+		if f, ok := tw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// abortStream 记录流在响应头写出后中断的原因，finish 据此写出错误而不是正常结尾
+func (tw *translatingWriter) abortStream(status int, message string) {
+	if tw.abortStatus == 0 {
+		tw.abortStatus, tw.abortMessage = status, message
+	}
+}
+
+// finish 在 dispatchUpstream 返回后调用，写出非流式结果、错误或流式结尾
+func (tw *translatingWriter) finish() {
+	switch {
+	case tw.status == 0:
+		tw.t.fail(tw.w, http.StatusBadGateway, "Empty response from upstream", "")
+	case tw.status >= 400:
+		message, code := parseGeminiError(tw.buf.Bytes())
+		tw.t.fail(tw.w, tw.status, message, code)
+	case tw.abortStatus != 0 && !tw.stream:
+		// 非流式响应还没有写出，缓冲的响应体不完整，直接返回错误
+		tw.t.fail(tw.w, tw.abortStatus, tw.abortMessage, "")
+	case !tw.stream:
+		tw.t.complete(tw.w, tw.buf.Bytes())
+	case tw.abortStatus != 0:
+		// 未结束的 SSE 事件可能不完整，直接丢弃
+		if ft, ok := tw.t.(streamFailTranslator); ok {
+			ft.streamFail(tw.w, tw.abortStatus, tw.abortMessage)
+		}
+		tw.Flush()
+	default:
+		for _, event := range tw.sse.flush() {
+			tw.t.streamEvent(tw.w, event)
+		}
+		tw.t.streamEnd(tw.w)
+		tw.Flush()
+	}
+}
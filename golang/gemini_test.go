@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSSEDecoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{"single event", []string{"data: {\"a\":1}\n\n"}, []string{`{"a":1}`}},
+		{"crlf line endings", []string{"data: x\r\n\r\ndata: y\r\n\r\n"}, []string{"x", "y"}},
+		{"split inside data and separator", []string{"da", "ta: hel", "lo\r", "\n", "\r\n"}, []string{"hello"}},
+		{"multi-line data joined with newline", []string{"data: a\ndata: b\n\n"}, []string{"a\nb"}},
+		{"no space after colon", []string{"data:x\n\n"}, []string{"x"}},
+		{"comments and other fields ignored", []string{": ping\nevent: message\nid: 1\ndata: x\n\n"}, []string{"x"}},
+		{"blank lines without data", []string{"\n\n\n"}, nil},
+		{"last event without trailing blank line", []string{"data: a\n\ndata: b"}, []string{"a", "b"}},
+		{"last event ends with a single newline", []string{"data: a\n"}, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d sseDecoder
+			var got []string
+			for _, c := range tt.chunks {
+				for _, e := range d.feed([]byte(c)) {
+					got = append(got, string(e))
+				}
+			}
+			for _, e := range d.flush() {
+				got = append(got, string(e))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingTranslator 记录 translatingWriter 交给它的调用
+type recordingTranslator struct {
+	calls []string
+}
+
+func (r *recordingTranslator) complete(w http.ResponseWriter, body []byte) {
+	r.calls = append(r.calls, "complete:"+string(body))
+}
+
+func (r *recordingTranslator) streamEvent(w http.ResponseWriter, data []byte) {
+	r.calls = append(r.calls, "event:"+string(data))
+}
+
+func (r *recordingTranslator) streamEnd(w http.ResponseWriter) {
+	r.calls = append(r.calls, "end")
+}
+
+func (r *recordingTranslator) fail(w http.ResponseWriter, status int, message, code string) {
+	r.calls = append(r.calls, "fail:"+http.StatusText(status)+":"+message+":"+code)
+}
+
+func (r *recordingTranslator) streamFail(w http.ResponseWriter, status int, message string) {
+	r.calls = append(r.calls, "streamFail:"+message)
+}
+
+func TestTranslatingWriter(t *testing.T) {
+	geminiError := `{"error":{"code":429,"message":"quota","status":"RESOURCE_EXHAUSTED"}}`
+	tests := []struct {
+		name   string
+		stream bool
+		status int
+		writes []string
+		abort  string
+		want   []string
+	}{
+		{"non-stream body", false, 200, []string{`{"cand`, `idates":[]}`}, "", []string{`complete:{"candidates":[]}`}},
+		{"stream events", true, 200, []string{"data: a\n", "\ndata: b"}, "", []string{"event:a", "event:b", "end"}},
+		{"upstream error", true, 429, []string{geminiError}, "", []string{"fail:Too Many Requests:quota:RESOURCE_EXHAUSTED"}},
+		{"no response", false, 0, nil, "", []string{"fail:Bad Gateway:Empty response from upstream:"}},
+		{"aborted stream drops partial event", true, 200, []string{"data: a\n\ndata: part"}, "connection lost", []string{"event:a", "streamFail:connection lost"}},
+		{"aborted non-stream", false, 200, []string{`{"cand`}, "connection lost", []string{"fail:Bad Gateway:connection lost:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &recordingTranslator{}
+			tw := newTranslatingWriter(httptest.NewRecorder(), rt, tt.stream)
+			if tt.status != 0 {
+				tw.WriteHeader(tt.status)
+			}
+			for _, p := range tt.writes {
+				tw.Write([]byte(p))
+			}
+			if tt.abort != "" {
+				tw.abortStream(http.StatusBadGateway, tt.abort)
+			}
+			tw.finish()
+			if !reflect.DeepEqual(rt.calls, tt.want) {
+				t.Fatalf("calls = %q, want %q", strings.Join(rt.calls, " | "), strings.Join(tt.want, " | "))
+			}
+		})
+	}
+}
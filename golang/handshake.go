@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- 浏览器连接握手 ---
+// 连接建立后浏览器必须先发送 hello，服务器验证协议版本后回复自己的 hello，之后连接才加入连接池：
+//
+//	→ {"type": "hello", "payload": {"protocol_version": 1, "client_build": "...", "account_label": "...", "features": ["cancel", "flow_control"]}}
+//	← {"type": "hello", "payload": {"protocol_version": 1, "min_protocol_version": 1, "features": [...], "stream_credit_window": 32}}
+//
+// 版本不兼容或超时未收到 hello 时，服务器发送 error（code 为 UNSUPPORTED_PROTOCOL / HANDSHAKE_FAILED）后关闭连接。
+
+const (
+	wsProtocolVersion    = 1 // 服务器实现的协议版本
+	wsMinProtocolVersion = 1 // 可接受的最低客户端版本
+)
+
+// 客户端可声明的功能
+const (
+	featureCancel      = "cancel"       // 处理 cancel 消息（见 proxy.go）
+	featureFlowControl = "flow_control" // 遵守 flow_control / credit（见 flowcontrol.go）
+	featureBase64Body  = "base64_body"  // 支持 encoding 为 base64 的请求/响应体
+)
+
+// serverFeatures 服务器支持的功能，随 hello 回复发送
+var serverFeatures = []string{featureCancel, featureFlowControl, featureBase64Body}
+
+// ClientInfo 是浏览器在 hello 中声明的信息，保存在 UserConnection.Client
+type ClientInfo struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	ClientBuild     string   `json:"client_build,omitempty"`
+	AccountLabel    string   `json:"account_label,omitempty"`
+	Features        []string `json:"features,omitempty"`
+}
+
+// HasFeature 判断客户端是否声明了某项功能
+func (c ClientInfo) HasFeature(name string) bool {
+	for _, f := range c.Features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeError 握手失败，code 随 error 消息发给客户端
+type handshakeError struct {
+	code string
+	err  error
+}
+
+func (e *handshakeError) Error() string { return e.err.Error() }
+
+// performHandshake 读取客户端的 hello 并回复服务器能力，必须在 readPump 启动前调用
+func performHandshake(conn *websocket.Conn) (ClientInfo, error) {
+	var client ClientInfo
+
+	conn.SetReadDeadline(time.Now().Add(currentConfig().Timeouts.WSHello))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		return client, &handshakeError{"HANDSHAKE_FAILED", fmt.Errorf("no hello received: %w", err)}
+	}
+	if msg.Type != "hello" {
+		return client, &handshakeError{"HANDSHAKE_FAILED", fmt.Errorf("expected hello, got %q", msg.Type)}
+	}
+	raw, _ := json.Marshal(msg.Payload)
+	if err := json.Unmarshal(raw, &client); err != nil {
+		return client, &handshakeError{"HANDSHAKE_FAILED", fmt.Errorf("invalid hello payload: %w", err)}
+	}
+	if client.ProtocolVersion < wsMinProtocolVersion || client.ProtocolVersion > wsProtocolVersion {
+		return client, &handshakeError{"UNSUPPORTED_PROTOCOL", fmt.Errorf(
+			"protocol version %d is not supported (server accepts %d-%d)",
+			client.ProtocolVersion, wsMinProtocolVersion, wsProtocolVersion)}
+	}
+
+	reply := WSMessage{Type: "hello", Payload: map[string]interface{}{
+		"protocol_version":     wsProtocolVersion,
+		"min_protocol_version": wsMinProtocolVersion,
+		"features":             serverFeatures,
+		"stream_credit_window": currentConfig().Upstream.StreamCreditWindow,
+	}}
+	if err := conn.WriteJSON(reply); err != nil {
+		return client, fmt.Errorf("send hello: %w", err)
+	}
+	return client, nil
+}
+
+// rejectHandshake 通知客户端握手失败并关闭连接
+func rejectHandshake(conn *websocket.Conn, userID string, err error) {
+	code := "HANDSHAKE_FAILED"
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		code = hsErr.code
+	}
+
+	logMsg := fmt.Sprintf("[HANDSHAKE] Rejected browser connection for user %s (%s): %v", userID, conn.RemoteAddr(), err)
+	log.Println(logMsg)
+	addLog("WARN", logMsg, map[string]interface{}{
+		"user_id":    userID,
+		"connection": conn.RemoteAddr().String(),
+		"code":       code,
+		"error":      err.Error(),
+	})
+
+	deadline := time.Now().Add(wsControlWriteTimeout)
+	conn.SetWriteDeadline(deadline)
+	conn.WriteJSON(WSMessage{Type: "error", Payload: map[string]interface{}{"code": code, "message": err.Error()}})
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, code), deadline)
+	conn.Close()
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// --- 浏览器 WebSocket 连接的 JWT 验证 ---
+// 通过环境变量配置：
+//   JWT_SECRET           HS256 共享密钥
+//   JWT_PUBLIC_KEY_FILE  RS256/ES256 公钥（PEM，PKIX 公钥或证书）
+//   JWT_JWKS_FILE        RS256/ES256 公钥集合（JWKS JSON），按 kid 选择
+//   JWT_AUDIENCE         要求 aud 包含该值（可选）
+//   JWT_ISSUER           要求 iss 等于该值（可选）
+//   JWT_USER_CLAIM       作为连接池 userID 的 claim，默认 "sub"
+//   JWT_LEEWAY           exp/nbf 允许的时钟偏差，默认 30s
+// 三种密钥必须配置其一，否则拒绝启动；只有显式设置 auth.allow_legacy_token（ALLOW_LEGACY_WS_TOKEN=true）时
+// 才接受旧的固定 token "valid-token-user-1"，仅用于本地测试。
+// 配置 JWT_SECRET 后可用 `wsproxy -issue-token <userID>` 签发 HS256 token（见 issueJWT）。
+
+const legacyAuthToken = "valid-token-user-1"
+
+// jwtValidator 持有验证所需的密钥和 claim 要求
+type jwtValidator struct {
+	hmacSecret []byte
+	publicKey  interface{}            // JWT_PUBLIC_KEY_FILE，*rsa.PublicKey 或 *ecdsa.PublicKey
+	jwks       map[string]interface{} // kid -> 公钥
+	audience   string
+	issuer     string
+	userClaim  string
+	leeway     time.Duration
+}
+
+// loadJWTValidator 根据 auth.jwt 配置（JWT_* 环境变量）创建验证器，未配置任何密钥时返回 nil
+func loadJWTValidator(c jwtConfig) (*jwtValidator, error) {
+	v := &jwtValidator{
+		audience:  c.Audience,
+		issuer:    c.Issuer,
+		userClaim: c.UserClaim,
+		leeway:    c.Leeway,
+	}
+
+	if c.Secret != "" {
+		v.hmacSecret = []byte(c.Secret)
+	}
+	if path := c.PublicKeyFile; path != "" {
+		key, err := loadPEMPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("auth.jwt.public_key_file: %w", err)
+		}
+		v.publicKey = key
+	}
+	if path := c.JWKSFile; path != "" {
+		keys, err := loadJWKS(path)
+		if err != nil {
+			return nil, fmt.Errorf("auth.jwt.jwks_file: %w", err)
+		}
+		v.jwks = keys
+	}
+
+	if v.hmacSecret == nil && v.publicKey == nil && v.jwks == nil {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// methods 返回当前配置允许的签名算法，防止算法混淆（例如用公钥当 HMAC 密钥）
+func (v *jwtValidator) methods() []string {
+	var methods []string
+	if v.hmacSecret != nil {
+		methods = append(methods, "HS256")
+	}
+	keys := make([]interface{}, 0, len(v.jwks)+1)
+	if v.publicKey != nil {
+		keys = append(keys, v.publicKey)
+	}
+	for _, key := range v.jwks {
+		keys = append(keys, key)
+	}
+	var hasRSA, hasEC bool
+	for _, key := range keys {
+		switch key.(type) {
+		case *rsa.PublicKey:
+			hasRSA = true
+		case *ecdsa.PublicKey:
+			hasEC = true
+		}
+	}
+	if hasRSA {
+		methods = append(methods, "RS256")
+	}
+	if hasEC {
+		methods = append(methods, "ES256")
+	}
+	return methods
+}
+
+// keyFunc 根据 alg 和 kid 选择验证密钥
+func (v *jwtValidator) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() == "HS256" {
+		return v.hmacSecret, nil
+	}
+
+	if kid, _ := token.Header["kid"].(string); kid != "" && v.jwks != nil {
+		key, ok := v.jwks[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		return key, nil
+	}
+	if v.publicKey != nil {
+		return v.publicKey, nil
+	}
+	// 没有 kid 时，JWKS 中只有一个密钥才能确定使用哪个
+	if len(v.jwks) == 1 {
+		for _, key := range v.jwks {
+			return key, nil
+		}
+	}
+	return nil, errors.New("token has no kid and no default public key is configured")
+}
+
+// validate 验证签名、exp、nbf、aud、iss，返回 userClaim 的值
+func (v *jwtValidator) validate(tokenString string) (string, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(v.methods()),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(v.leeway),
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+	if v.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.issuer))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, v.keyFunc, opts...); err != nil {
+		return "", err
+	}
+
+	userID, _ := claims[v.userClaim].(string)
+	if userID == "" {
+		return "", fmt.Errorf("claim %q is missing or not a string", v.userClaim)
+	}
+	return userID, nil
+}
+
+// issueJWT 用 auth.jwt.secret 签发浏览器连接使用的 HS256 token，包含 exp/iat 以及配置的 aud/iss
+// 使用公钥验证时，token 由持有私钥的一方签发，这里无法生成
+func issueJWT(c jwtConfig, userID string, ttl time.Duration) (string, error) {
+	if c.Secret == "" {
+		return "", errors.New("auth.jwt.secret (JWT_SECRET) is required to issue tokens; with public_key_file or jwks_file, sign tokens with the matching private key")
+	}
+	if userID == "" {
+		return "", errors.New("user ID must not be empty")
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("token lifetime must be positive, got %s", ttl)
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		c.UserClaim: userID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(ttl).Unix(),
+	}
+	if c.Audience != "" {
+		claims["aud"] = c.Audience
+	}
+	if c.Issuer != "" {
+		claims["iss"] = c.Issuer
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(c.Secret))
+}
+
+// describe 用于启动日志
+func (v *jwtValidator) describe() string {
+	parts := []string{"algorithms=" + strings.Join(v.methods(), ",")}
+	if v.jwks != nil {
+		parts = append(parts, fmt.Sprintf("jwks_keys=%d", len(v.jwks)))
+	}
+	if v.audience != "" {
+		parts = append(parts, "aud="+v.audience)
+	}
+	if v.issuer != "" {
+		parts = append(parts, "iss="+v.issuer)
+	}
+	parts = append(parts, "user_claim="+v.userClaim)
+	return strings.Join(parts, " ")
+}
+
+// loadPEMPublicKey 读取 PEM 格式的公钥（PUBLIC KEY / RSA PUBLIC KEY / CERTIFICATE）
+func loadPEMPublicKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: ES256 requires a P-256 key", path)
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported public key type %T", path, key)
+	}
+}
+
+// jwk 是 JWKS 中的单个密钥，只解析 RSA 和 P-256 EC 公钥所需字段
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS 读取 JWKS 文件，跳过非签名用途和不支持的密钥
+func loadJWKS(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	keys := make(map[string]interface{})
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaPublicKey()
+		case "EC":
+			key, err = k.ecdsaPublicKey()
+		default:
+			log.Printf("JWKS %s: skipping key %d with unsupported kty %q", path, i, k.Kty)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: keys[%d]: %w", path, i, err)
+		}
+		if _, dup := keys[k.Kid]; dup {
+			return nil, fmt.Errorf("%s: keys[%d]: duplicate kid %q", path, i, k.Kid)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no usable signing keys", path)
+	}
+	return keys, nil
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("invalid RSA modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	exponent := 0
+	for _, b := range e {
+		exponent = exponent<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+}
+
+func (k jwk) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	if k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q (ES256 requires P-256)", k.Crv)
+	}
+	x, errX := base64.RawURLEncoding.DecodeString(k.X)
+	y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+	if errX != nil || errY != nil || len(x) == 0 || len(y) == 0 {
+		return nil, errors.New("invalid EC coordinates")
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("EC point is not on curve P-256")
+	}
+	return key, nil
+}
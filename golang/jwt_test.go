@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useJWTConfig 让 validateJWT 使用给定配置，测试结束后恢复
+func useJWTConfig(t *testing.T, c authConfig) {
+	t.Helper()
+	config := defaultConfig()
+	config.Auth = c
+	if config.Auth.JWT.UserClaim == "" {
+		config.Auth.JWT.UserClaim = "sub"
+	}
+	validator, err := loadJWTValidator(config.Auth.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useRuntimeState(t, func(state *runtimeState) {
+		state.config = config
+		state.jwtValidator = validator
+	})
+}
+
+func signHS256(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidateJWTHS256(t *testing.T) {
+	const secret = "test-secret"
+	useJWTConfig(t, authConfig{JWT: jwtConfig{Secret: secret, Audience: "proxy", Issuer: "issuer", Leeway: 30 * time.Second}})
+
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "alice", "aud": "proxy", "iss": "issuer", "exp": now.Add(time.Hour).Unix()}
+	}
+	with := func(key string, value interface{}) jwt.MapClaims {
+		c := valid()
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256, err := jwt.NewWithClaims(jwt.SigningMethodRS256, valid()).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, valid()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr string
+	}{
+		{"valid", signHS256(t, secret, valid()), "alice", ""},
+		{"empty token", "", "", "missing auth_token"},
+		{"wrong secret", signHS256(t, "other-secret", valid()), "", "signature is invalid"},
+		{"wrong algorithm RS256", rs256, "", "signing method RS256 is invalid"},
+		{"alg none", none, "", "signing method none is invalid"},
+		{"missing exp", signHS256(t, secret, with("exp", nil)), "", "exp claim is required"},
+		{"expired beyond leeway", signHS256(t, secret, with("exp", now.Add(-time.Minute).Unix())), "", "token is expired"},
+		{"expired within leeway", signHS256(t, secret, with("exp", now.Add(-10*time.Second).Unix())), "alice", ""},
+		{"nbf beyond leeway", signHS256(t, secret, with("nbf", now.Add(time.Minute).Unix())), "", "token is not valid yet"},
+		{"nbf within leeway", signHS256(t, secret, with("nbf", now.Add(10*time.Second).Unix())), "alice", ""},
+		{"bad aud", signHS256(t, secret, with("aud", "someone-else")), "", "token has invalid audience"},
+		{"missing aud", signHS256(t, secret, with("aud", nil)), "", "aud claim is required"},
+		{"bad iss", signHS256(t, secret, with("iss", "evil")), "", "token has invalid issuer"},
+		{"missing user claim", signHS256(t, secret, with("sub", nil)), "", `claim "sub" is missing`},
+		{"legacy token rejected when JWT is configured", legacyAuthToken, "", "invalid token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateJWT(tt.token)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateJWT() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateJWT() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("validateJWT() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateJWTPublicKeyRejectsHMACWithPublicKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &jwtValidator{publicKey: &ecKey.PublicKey, userClaim: "sub"}
+	claims := jwt.MapClaims{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}
+
+	es256, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := v.validate(es256); err != nil || got != "bob" {
+		t.Fatalf("ES256 token: got %q, %v", got, err)
+	}
+
+	// 算法混淆：把公钥当作 HMAC 密钥签名
+	pub, _ := ecKey.PublicKey.ECDH()
+	hs256 := signHS256(t, string(pub.Bytes()), claims)
+	if _, err := v.validate(hs256); err == nil || !strings.Contains(err.Error(), "signing method HS256 is invalid") {
+		t.Fatalf("HS256 token against public key: error = %v", err)
+	}
+}
+
+func TestValidateJWTLegacyToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   bool
+		token   string
+		want    string
+		wantErr string
+	}{
+		{"not allowed by default", false, legacyAuthToken, "", "JWT validation is not configured"},
+		{"allowed with opt-in", true, legacyAuthToken, "user-1", ""},
+		{"other token with opt-in", true, "guess", "", "invalid token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useJWTConfig(t, authConfig{AllowLegacyToken: tt.allow})
+			got, err := validateJWT(tt.token)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateJWT() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("validateJWT() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssueJWTRoundTrip(t *testing.T) {
+	c := jwtConfig{Secret: "test-secret", Audience: "proxy", Issuer: "issuer", UserClaim: "uid", Leeway: time.Second}
+	useJWTConfig(t, authConfig{JWT: c})
+
+	token, err := issueJWT(c, "carol", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := validateJWT(token); err != nil || got != "carol" {
+		t.Fatalf("validateJWT(issued) = %q, %v", got, err)
+	}
+	if _, err := issueJWT(jwtConfig{PublicKeyFile: "key.pem", UserClaim: "sub"}, "carol", time.Hour); err == nil {
+		t.Fatal("issueJWT without a secret should fail")
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"strings"
 	"sync"
 	"time"
 )
 
 // LogEntry represents a single log entry for the web UI
 type LogEntry struct {
+	ID        int64                  `json:"id"` // 单调递增的序号，用于日志流断线续传
 	Timestamp time.Time              `json:"timestamp"`
 	Level     string                 `json:"level"` // INFO, ERROR, WARN, DEBUG
 	Message   string                 `json:"message"`
@@ -14,9 +17,9 @@ type LogEntry struct {
 }
 
 var (
-	logBuffer    []LogEntry
-	logBufferMu  sync.RWMutex
-	maxLogBuffer = 1000 // Keep last 1000 log entries
+	logBuffer   []LogEntry // 保留最近 logging.buffer_size 条（见 config.go）
+	logBufferMu sync.RWMutex
+	lastLogID   int64 // 最近分配的 LogEntry.ID，受 logBufferMu 保护
 )
 
 // addLog adds a log entry to the buffer
@@ -29,10 +32,77 @@ func addLog(level, message string, data map[string]interface{}) {
 	}
 
 	logBufferMu.Lock()
-	defer logBufferMu.Unlock()
-
+	lastLogID++
+	entry.ID = lastLogID
 	logBuffer = append(logBuffer, entry)
-	if len(logBuffer) > maxLogBuffer {
-		logBuffer = logBuffer[1:] // Remove oldest entry
+	if excess := len(logBuffer) - currentConfig().Logging.BufferSize; excess > 0 {
+		logBuffer = logBuffer[excess:] // Remove oldest entries
+	}
+	publishLog(entry) // 推送给 /api/logs/stream 的订阅者（见 logstream.go）
+	// 持久化到磁盘（见 logsink.go）：在 logBufferMu 内按 ID 顺序放入写入队列，
+	// 由单独的写入协程落盘，文件中的日志顺序与 ID 一致（/api/logs 的游标依赖这一点）
+	persistentLogs.enqueue(entry)
+	logBufferMu.Unlock()
+}
+
+// logFilter 是 /api/logs 的查询条件，零值字段表示不限
+type logFilter struct {
+	levels    map[string]bool
+	requestID string
+	since     time.Time
+	until     time.Time
+	text      string // 小写，匹配 message 和 data
+	afterID   int64  // 分页游标，只返回 ID 更大的日志
+}
+
+func (f *logFilter) matches(e LogEntry) bool {
+	if e.ID <= f.afterID {
+		return false
+	}
+	if f.levels != nil && !f.levels[e.Level] {
+		return false
+	}
+	if (!f.since.IsZero() && e.Timestamp.Before(f.since)) || (!f.until.IsZero() && e.Timestamp.After(f.until)) {
+		return false
+	}
+	if f.requestID != "" {
+		if id, _ := e.Data["request_id"].(string); id != f.requestID {
+			return false
+		}
+	}
+	if f.text != "" && !strings.Contains(strings.ToLower(e.Message), f.text) {
+		data, _ := json.Marshal(e.Data)
+		if !strings.Contains(strings.ToLower(string(data)), f.text) {
+			return false
+		}
+	}
+	return true
+}
+
+// logsMatching 按 ID 顺序返回内存缓冲区中符合条件的日志，最多 limit 条，还有更多时第二个返回值为 true
+func logsMatching(f *logFilter, limit int) ([]LogEntry, bool) {
+	logBufferMu.RLock()
+	defer logBufferMu.RUnlock()
+
+	var entries []LogEntry
+	for _, e := range logBuffer {
+		if !f.matches(e) {
+			continue
+		}
+		if len(entries) >= limit {
+			return entries, true
+		}
+		entries = append(entries, e)
+	}
+	return entries, false
+}
+
+// oldestBufferedLogID 返回内存缓冲区中最早一条日志的ID，缓冲区为空时返回 0
+func oldestBufferedLogID() int64 {
+	logBufferMu.RLock()
+	defer logBufferMu.RUnlock()
+	if len(logBuffer) == 0 {
+		return 0
 	}
+	return logBuffer[0].ID
 }
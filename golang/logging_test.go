@@ -0,0 +1,89 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLogFilterMatches(t *testing.T) {
+	at := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	entry := LogEntry{
+		ID:        10,
+		Timestamp: at,
+		Level:     "WARN",
+		Message:   "[OPENAI abc] Upstream Returned 429",
+		Data:      map[string]interface{}{"request_id": "abc", "user_id": "Alice"},
+	}
+	tests := []struct {
+		name   string
+		filter logFilter
+		want   bool
+	}{
+		{"zero filter", logFilter{}, true},
+		{"level match", logFilter{levels: parseLevels("error, warn")}, true},
+		{"level mismatch", logFilter{levels: parseLevels("ERROR")}, false},
+		{"request id match", logFilter{requestID: "abc"}, true},
+		{"request id mismatch", logFilter{requestID: "abd"}, false},
+		{"since inclusive", logFilter{since: at}, true},
+		{"since after", logFilter{since: at.Add(time.Second)}, false},
+		{"until inclusive", logFilter{until: at}, true},
+		{"until before", logFilter{until: at.Add(-time.Second)}, false},
+		{"text in message, case-insensitive", logFilter{text: "returned 429"}, true},
+		{"text in data", logFilter{text: "alice"}, true},
+		{"text in data key", logFilter{text: "user_id"}, true},
+		{"text nowhere", logFilter{text: "bob"}, false},
+		{"cursor before entry", logFilter{afterID: 9}, true},
+		{"cursor at entry", logFilter{afterID: 10}, false},
+		{"all conditions", logFilter{levels: parseLevels("WARN"), requestID: "abc", since: at.Add(-time.Minute), until: at.Add(time.Minute), text: "429", afterID: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(entry); got != tt.want {
+				t.Fatalf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogsMatchingLimit(t *testing.T) {
+	logBufferMu.Lock()
+	saved := logBuffer
+	logBuffer = []LogEntry{
+		{ID: 1, Level: "INFO"}, {ID: 2, Level: "ERROR"}, {ID: 3, Level: "ERROR"}, {ID: 4, Level: "INFO"}, {ID: 5, Level: "ERROR"},
+	}
+	logBufferMu.Unlock()
+	t.Cleanup(func() {
+		logBufferMu.Lock()
+		logBuffer = saved
+		logBufferMu.Unlock()
+	})
+
+	ids := func(entries []LogEntry) []int64 {
+		var out []int64
+		for _, e := range entries {
+			out = append(out, e.ID)
+		}
+		return out
+	}
+	tests := []struct {
+		name          string
+		filter        logFilter
+		limit         int
+		want          []int64
+		wantTruncated bool
+	}{
+		{"limit reached", logFilter{levels: parseLevels("ERROR")}, 2, []int64{2, 3}, true},
+		{"exactly limit", logFilter{levels: parseLevels("ERROR")}, 3, []int64{2, 3, 5}, false},
+		{"next page from cursor", logFilter{levels: parseLevels("ERROR"), afterID: 3}, 2, []int64{5}, false},
+		{"no match", logFilter{levels: parseLevels("DEBUG")}, 2, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := logsMatching(&tt.filter, tt.limit)
+			if g := ids(got); !slices.Equal(g, tt.want) || truncated != tt.wantTruncated {
+				t.Fatalf("logsMatching() = %v, %v, want %v, %v", g, truncated, tt.want, tt.wantTruncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- 持久化日志 ---
+// 设置 logging.dir（LOG_DIR）后，addLog 记录的每条日志同时以 JSONL 格式追加到 <dir>/requests.jsonl。
+// 文件超过 logging.file_max_mb 时轮转为 requests-<轮转时间>.jsonl；
+// 超过 logging.max_age 或超出 logging.max_files 个的旧文件会被删除。
+// /api/logs 带 since/until 参数或游标早于内存缓冲区时从这些文件中查询，不受内存缓冲区大小的限制。
+
+const (
+	logFilePrefix     = "requests"
+	logFileExt        = ".jsonl"
+	logRotateTimeFmt  = "20060102T150405.000"
+	logQueryMaxResult = 5000 // /api/logs 单次最多返回的条数
+	logSinkQueueSize  = 4096 // 等待写入磁盘的日志条数上限
+)
+
+// logSink 把日志写入轮转的 JSONL 文件。
+// addLog 把日志放入 queue，单个写入协程（run）按入队顺序落盘，磁盘写入和轮转不占用 logBufferMu
+type logSink struct {
+	dir      string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	queue  chan LogEntry
+	closed bool          // queue 已关闭，受 logBufferMu 保护
+	done   chan struct{} // 写入协程退出后关闭
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// persistentLogs 在 main 中初始化，为 nil 时只保留内存中的日志
+var persistentLogs *logSink
+
+// initLogSink 根据 logging 配置打开持久化日志
+func initLogSink(c loggingConfig) error {
+	dir := c.Dir
+	if dir == "" {
+		return nil
+	}
+	sink, err := openLogSink(dir, int64(c.FileMaxMB)<<20, c.MaxAge, c.MaxFiles)
+	if err != nil {
+		return err
+	}
+	persistentLogs = sink
+
+	// 日志ID接着磁盘上最后一条继续编号，重启后 ID 仍然单调递增
+	logBufferMu.Lock()
+	lastLogID = sink.lastID()
+	logBufferMu.Unlock()
+
+	log.Printf("Persistent logs enabled: %s (rotate at %d MB, keep %d files / %s), last log id %d",
+		dir, sink.maxSize>>20, sink.maxFiles, sink.maxAge, lastLogID)
+
+	// 流量很小时可能长时间不轮转，定期清理过期文件
+	go func() {
+		for range time.Tick(time.Hour) {
+			sink.mu.Lock()
+			sink.cleanup()
+			sink.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func openLogSink(dir string, maxSize int64, maxAge time.Duration, maxFiles int) (*logSink, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("logging.file_max_mb must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &logSink{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+		queue:    make(chan LogEntry, logSinkQueueSize),
+		done:     make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.cleanup()
+	go s.run()
+	return s, nil
+}
+
+// enqueue 把日志交给写入协程，调用方持有 logBufferMu（保证入队顺序与 ID 一致）。
+// 队列满说明磁盘长时间跟不上，此时宁可让 addLog 等待也不丢弃日志
+func (s *logSink) enqueue(entry LogEntry) {
+	if s == nil || s.closed {
+		return
+	}
+	s.queue <- entry
+}
+
+// run 是唯一的写入协程，按入队顺序写入日志，队列关闭后关闭文件
+func (s *logSink) run() {
+	defer close(s.done)
+	for entry := range s.queue {
+		s.mu.Lock()
+		s.write(entry)
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+func (s *logSink) currentPath() string {
+	return filepath.Join(s.dir, logFilePrefix+logFileExt)
+}
+
+func (s *logSink) open() error {
+	f, err := os.OpenFile(s.currentPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// write 追加一条日志，写入失败只打印到标准输出，不影响请求处理。
+// 只由写入协程调用，调用方持有 s.mu
+func (s *logSink) write(entry LogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Persistent log: cannot encode entry %q: %v", entry.Message, err)
+		return
+	}
+	line = append(line, '\n')
+
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			log.Printf("Persistent log: rotate failed: %v", err)
+		}
+	}
+	if s.file == nil {
+		return
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		log.Printf("Persistent log: write failed: %v", err)
+	}
+}
+
+// close 等待队列中的日志写完后关闭文件，之后的日志只保留在内存中；退出前调用
+func (s *logSink) close() {
+	if s == nil {
+		return
+	}
+	logBufferMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	logBufferMu.Unlock()
+	<-s.done
+}
+
+// rotate 把当前文件重命名为带轮转时间的文件并重新打开，调用方持有 s.mu
+func (s *logSink) rotate() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	rotated := filepath.Join(s.dir, logFilePrefix+"-"+time.Now().UTC().Format(logRotateTimeFmt)+logFileExt)
+	if err := os.Rename(s.currentPath(), rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.cleanup()
+	return s.open()
+}
+
+// rotatedFile 是一个已轮转的日志文件，until 为轮转时间（文件中所有日志都早于它）
+type rotatedFile struct {
+	path  string
+	until time.Time
+}
+
+// rotatedFiles 按时间从旧到新返回已轮转的文件
+func (s *logSink) rotatedFiles() []rotatedFile {
+	matches, _ := filepath.Glob(filepath.Join(s.dir, logFilePrefix+"-*"+logFileExt))
+	files := make([]rotatedFile, 0, len(matches))
+	for _, path := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), logFilePrefix+"-"), logFileExt)
+		t, err := time.Parse(logRotateTimeFmt, stamp)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{path: path, until: t})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].until.Before(files[j].until) })
+	return files
+}
+
+// cleanup 删除过期和超出数量的轮转文件，调用方持有 s.mu
+func (s *logSink) cleanup() {
+	files := s.rotatedFiles()
+	for i, f := range files {
+		expired := s.maxAge > 0 && time.Since(f.until) > s.maxAge
+		excess := s.maxFiles > 0 && len(files)-i > s.maxFiles
+		if !expired && !excess {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Persistent log: cannot remove %s: %v", f.path, err)
+		}
+	}
+}
+
+// lastID 返回磁盘上最新一条日志的ID
+func (s *logSink) lastID() int64 {
+	paths := []string{s.currentPath()}
+	files := s.rotatedFiles()
+	for i := len(files) - 1; i >= 0; i-- {
+		paths = append(paths, files[i].path)
+	}
+	for _, path := range paths {
+		var last int64
+		scanLogFile(path, func(e LogEntry) bool {
+			if e.ID > last {
+				last = e.ID
+			}
+			return true
+		})
+		if last > 0 {
+			return last
+		}
+	}
+	return 0
+}
+
+// query 按时间顺序返回符合条件的日志，最多 limit 条，还有更多时第二个返回值为 true
+func (s *logSink) query(f *logFilter, limit int) ([]LogEntry, bool, error) {
+	since, until := f.since, f.until
+	s.mu.Lock()
+	files := s.rotatedFiles()
+	s.mu.Unlock()
+
+	// 轮转时间是文件内容的上界，前一个文件的轮转时间是下界
+	paths := make([]string, 0, len(files)+1)
+	var from time.Time
+	for _, f := range files {
+		if (since.IsZero() || !f.until.Before(since)) && (until.IsZero() || !from.After(until)) {
+			paths = append(paths, f.path)
+		}
+		from = f.until
+	}
+	if until.IsZero() || !from.After(until) {
+		paths = append(paths, s.currentPath())
+	}
+
+	var entries []LogEntry
+	for _, path := range paths {
+		done, err := scanLogFile(path, func(e LogEntry) bool {
+			if !f.matches(e) {
+				return true
+			}
+			if len(entries) >= limit {
+				return false
+			}
+			entries = append(entries, e)
+			return true
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("read %s: %w", filepath.Base(path), err)
+		}
+		if done {
+			return entries, true, nil
+		}
+	}
+	return entries, false, nil
+}
+
+// scanLogFile 依次解码文件中的日志，fn 返回 false 时停止并返回 true；
+// 无法解析的行（例如正在写入的最后一行）被跳过
+func scanLogFile(path string, fn func(LogEntry) bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// 文件可能刚被轮转或清理
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var e LogEntry
+			if json.Unmarshal(line, &e) == nil && !fn(e) {
+				return true, nil
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddLogPersistsInIDOrder(t *testing.T) {
+	sink, err := openLogSink(t.TempDir(), 1<<30, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := persistentLogs
+	persistentLogs = sink
+	t.Cleanup(func() {
+		persistentLogs = old
+		sink.close()
+	})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				addLog("INFO", fmt.Sprintf("g%d-%d", g, i), nil)
+			}
+		}(g)
+	}
+	wg.Wait()
+	sink.close() // 等待写入协程把队列写完
+
+	f, err := os.Open(sink.currentPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lastID int64
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.ID <= lastID {
+			t.Fatalf("line %d: id %d after %d", lines+1, entry.ID, lastID)
+		}
+		lastID = entry.ID
+		lines++
+	}
+	if lines != 8*200 {
+		t.Fatalf("persisted %d entries, want %d", lines, 8*200)
+	}
+}
+
+// 磁盘写入卡住时 addLog 不等待，内存中的日志照常可读
+func TestAddLogDoesNotWaitForDisk(t *testing.T) {
+	sink, err := openLogSink(t.TempDir(), 1<<30, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := persistentLogs
+	persistentLogs = sink
+	t.Cleanup(func() {
+		persistentLogs = old
+		sink.close()
+	})
+
+	sink.mu.Lock() // 模拟缓慢的写入或轮转
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			addLog("INFO", fmt.Sprintf("slow disk %d", i), nil)
+		}
+		logBufferMu.RLock()
+		logBufferMu.RUnlock()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		sink.mu.Unlock()
+		t.Fatal("addLog blocked on the disk writer")
+	}
+	sink.mu.Unlock()
+
+	sink.close()
+	entries, _, err := sink.query(&logFilter{text: "slow disk"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("persisted %d entries, want 10", len(entries))
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- 实时日志流 ---
+// GET /api/logs/stream 以 Server-Sent Events 推送 addLog 新增的日志：
+//
+//	id: 42
+//	event: log
+//	data: {"id":42,"timestamp":"...","level":"INFO",...}
+//
+// 参数：
+//   level     逗号分隔的级别，只推送这些级别（如 ERROR,WARN），默认全部
+//   since_id  先补发内存缓冲区中 ID 大于该值的日志再推送新日志；
+//             浏览器 EventSource 断线重连时自动携带的 Last-Event-ID 头优先
+// 需要补发的日志已被挤出缓冲区时，先发送一条 gap 事件，data 为 {"oldest_id": N}。
+// 客户端读得太慢导致订阅队列满时服务器断开连接，客户端按 Last-Event-ID 续传即可。
+
+const (
+	logStreamQueueSize = 256
+	logStreamHeartbeat = 15 * time.Second
+)
+
+// logSubscriber 是一个 /api/logs/stream 连接
+type logSubscriber struct {
+	ch     chan LogEntry
+	levels map[string]bool // nil 表示全部级别
+}
+
+func (s *logSubscriber) accepts(e LogEntry) bool {
+	return s.levels == nil || s.levels[e.Level]
+}
+
+// logSubscribers 受 logBufferMu 保护，与缓冲区在同一把锁下更新，
+// 保证补发的日志和推送的日志之间不重复也不遗漏
+var logSubscribers = make(map[*logSubscriber]struct{})
+
+// publishLog 把新日志推送给订阅者，调用方持有 logBufferMu
+func publishLog(entry LogEntry) {
+	for sub := range logSubscribers {
+		if !sub.accepts(entry) {
+			continue
+		}
+		select {
+		case sub.ch <- entry:
+		default:
+			// 队列已满，断开该订阅，客户端重连后从 Last-Event-ID 续传
+			close(sub.ch)
+			delete(logSubscribers, sub)
+		}
+	}
+}
+
+// parseLevels 解析逗号分隔的日志级别，空字符串返回 nil
+func parseLevels(v string) map[string]bool {
+	if v == "" {
+		return nil
+	}
+	levels := make(map[string]bool)
+	for _, l := range strings.Split(v, ",") {
+		if l = strings.ToUpper(strings.TrimSpace(l)); l != "" {
+			levels[l] = true
+		}
+	}
+	return levels
+}
+
+func handleLogStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if shuttingDown.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// EventSource 重连时的 Last-Event-ID 比 URL 中最初的 since_id 更新
+	resumeFrom := r.URL.Query().Get("since_id")
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		resumeFrom = v
+	}
+	var sinceID int64 = -1 // -1 表示不补发
+	if resumeFrom != "" {
+		id, err := strconv.ParseInt(resumeFrom, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "invalid since_id", http.StatusBadRequest)
+			return
+		}
+		sinceID = id
+	}
+
+	sub := &logSubscriber{
+		ch:     make(chan LogEntry, logStreamQueueSize),
+		levels: parseLevels(r.URL.Query().Get("level")),
+	}
+
+	logBufferMu.Lock()
+	var backlog []LogEntry
+	oldestID := int64(-1)
+	if sinceID >= 0 {
+		for _, e := range logBuffer {
+			if e.ID > sinceID && sub.accepts(e) {
+				backlog = append(backlog, e)
+			}
+		}
+		if len(logBuffer) > 0 && logBuffer[0].ID > sinceID+1 {
+			oldestID = logBuffer[0].ID
+		}
+	}
+	logSubscribers[sub] = struct{}{}
+	logBufferMu.Unlock()
+
+	defer func() {
+		logBufferMu.Lock()
+		if _, ok := logSubscribers[sub]; ok {
+			delete(logSubscribers, sub)
+			close(sub.ch)
+		}
+		logBufferMu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if oldestID >= 0 {
+		fmt.Fprintf(w, "event: gap\ndata: {\"oldest_id\":%d}\n\n", oldestID)
+	}
+	for _, e := range backlog {
+		if writeLogEvent(w, e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(logStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if writeLogEvent(w, e) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// closeLogStreams 结束所有 SSE 日志流，关闭服务器时调用，避免长连接拖住 http.Server.Shutdown
+func closeLogStreams() {
+	logBufferMu.Lock()
+	defer logBufferMu.Unlock()
+	for sub := range logSubscribers {
+		delete(logSubscribers, sub)
+		close(sub.ch)
+	}
+}
+
+func writeLogEvent(w http.ResponseWriter, e LogEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		// 无法编码的日志跳过，不中断整个流
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", e.ID, data)
+	return err
+}
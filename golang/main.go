@@ -2,16 +2,29 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// --- Constants ---
-const (
-	wsPath          = "/v1/ws"
-	proxyListenAddr = ":5345"
-)
+// envInt 从环境变量读取整数，未设置或无效时返回默认值
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %d: %v", key, v, def, err)
+		return def
+	}
+	return n
+}
 
 // --- Global Connection Pool ---
 var globalPool = &ConnectionPool{
@@ -32,15 +45,91 @@ func handleGetLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logBufferMu.RLock()
-	defer logBufferMu.RUnlock()
+	// 查询参数（均可选）：
+	//   level       逗号分隔的级别，如 ERROR,WARN
+	//   request_id  只返回该请求的日志
+	//   since/until RFC3339 时间范围
+	//   q           在 message 和 data 中搜索（不区分大小写）
+	//   limit       最多返回的条数，默认和上限均为 logQueryMaxResult
+	//   cursor      只返回 ID 大于该值的日志；翻页时传入上一页的 next_cursor
+	// 结果按 ID 升序排列。启用 LOG_DIR 且查询范围超出内存缓冲区时从磁盘查询
+	query := r.URL.Query()
+	filter := &logFilter{
+		levels:    parseLevels(query.Get("level")),
+		requestID: query.Get("request_id"),
+		text:      strings.ToLower(query.Get("q")),
+	}
+	var err error
+	if filter.since, err = parseTimeParam(query.Get("since")); err != nil {
+		writeLogsError(w, http.StatusBadRequest, "invalid since: expected RFC3339 time")
+		return
+	}
+	if filter.until, err = parseTimeParam(query.Get("until")); err != nil {
+		writeLogsError(w, http.StatusBadRequest, "invalid until: expected RFC3339 time")
+		return
+	}
+	limit := logQueryMaxResult
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > logQueryMaxResult {
+			writeLogsError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit: expected 1-%d", logQueryMaxResult))
+			return
+		}
+		limit = n
+	}
+	cursorSet := query.Get("cursor") != ""
+	if cursorSet {
+		if filter.afterID, err = strconv.ParseInt(query.Get("cursor"), 10, 64); err != nil || filter.afterID < 0 {
+			writeLogsError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+
+	source := "memory"
+	var entries []LogEntry
+	var truncated bool
+	useDisk := !filter.since.IsZero() || !filter.until.IsZero() || (cursorSet && filter.afterID+1 < oldestBufferedLogID())
+	if persistentLogs != nil && useDisk {
+		source = "disk"
+		entries, truncated, err = persistentLogs.query(filter, limit)
+		if err != nil {
+			writeLogsError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		entries, truncated = logsMatching(filter, limit)
+	}
+	if entries == nil {
+		entries = []LogEntry{}
+	}
 
+	// next_cursor 为本页最后一条的ID；没有结果时保持不变，便于轮询新日志
+	nextCursor := filter.afterID
+	if len(entries) > 0 {
+		nextCursor = entries[len(entries)-1].ID
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"logs":  logBuffer,
-		"count": len(logBuffer),
+		"logs":        entries,
+		"count":       len(entries),
+		"source":      source,
+		"truncated":   truncated,
+		"next_cursor": nextCursor,
 	})
 }
 
+// parseTimeParam 解析 RFC3339 时间参数，空字符串返回零值
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func writeLogsError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
 func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -67,12 +156,90 @@ func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 // --- Main Function ---
 
 func main() {
+	issueTokenFor := flag.String("issue-token", "", "print a WebSocket JWT for this user ID, signed with auth.jwt.secret, and exit")
+	issueTokenTTL := flag.Duration("token-ttl", 30*24*time.Hour, "lifetime of the token printed by -issue-token")
+	flag.Parse()
+
+	// 配置：内置默认值 < PROXY_CONFIG 指向的 YAML 文件 < 环境变量（见 config.go）
+	configPath := os.Getenv("PROXY_CONFIG")
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	// 签发浏览器端 config.ts 中的 JWT_TOKEN
+	if *issueTokenFor != "" {
+		token, err := issueJWT(config.Auth.JWT, *issueTokenFor, *issueTokenTTL)
+		if err != nil {
+			log.Fatalf("Cannot issue token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	// 加载配置引用的文件：API Key、JWT 密钥、负载均衡策略、转换器（见 reload.go 的 runtimeState）
+	state, err := newRuntimeState(config)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	activeState.Store(state)
+	if configPath != "" {
+		log.Printf("Loaded configuration from %s", configPath)
+	}
+
+	// 转换器配置（可选）：启用/禁用内置转换器、按路由或模型匹配规则、自定义字段转换器
+	if path := config.Transformers.ConfigFile; path != "" {
+		log.Printf("Transformer config loaded from %s: request=%v response=%v", path, requestTransformers.Names(), responseTransformers.Names())
+	}
+
+	// HTTP 客户端 API Key（auth.api_key / auth.api_keys_file）
+	logAPIKeys(state.apiKeys)
+
+	// 持久化日志（可选）：logging.dir 下轮转的 JSONL 文件
+	if err := initLogSink(config.Logging); err != nil {
+		log.Fatalf("Invalid logging.dir configuration: %v", err)
+	}
+
+	// OTLP 追踪（可选，见 tracing.go）
+	if err := initTracing(); err != nil {
+		log.Fatalf("Invalid tracing configuration: %v", err)
+	}
+
+	// 负载均衡策略（可选）：默认 round_robin，可按用户指定
+	if path := config.Routing.BalancerConfig; path != "" {
+		log.Printf("Balancer config loaded from %s: default=%s, %d per-user strategies", path, state.balancer.def.Name(), len(state.balancer.users))
+	}
+
+	// 浏览器 WebSocket 连接的 JWT 验证
+	if validator := state.jwtValidator; validator != nil {
+		log.Printf("WebSocket JWT validation enabled: %s", validator.describe())
+	} else {
+		// validate 已保证此时设置了 auth.allow_legacy_token
+		log.Printf("WARNING: auth.allow_legacy_token is set; WebSocket clients are authenticated with the fixed token %q. Do not use this outside local testing.", legacyAuthToken)
+	}
+
+	// 定期 ping 浏览器连接并清理失效连接
+	startConnectionReaper()
+
+	// SIGHUP 或配置文件修改时热重载（见 reload.go）
+	startConfigReloader(configPath)
+
 	// WebSocket 路由
+	wsPath, proxyListenAddr := config.Listen.WSPath, config.Listen.Addr
 	http.HandleFunc(wsPath, handleWebSocket)
 
 	// Logs and Health API routes (no auth required for monitoring)
 	http.HandleFunc("/api/logs", handleGetLogs)
+	http.HandleFunc("/api/logs/stream", handleLogStream)
 	http.HandleFunc("/api/health", handleHealthCheck)
+	http.HandleFunc(metricsPath, handleMetrics)
+
+	// 连接管理接口（需要 auth.admin_api_key，见 admin.go）
+	http.HandleFunc(adminConnectionsPath, handleAdminConnections)
+	http.HandleFunc(adminConnectionsPath+"/", handleAdminConnections)
+	if config.Auth.AdminAPIKey == "" {
+		log.Println("Admin API disabled (auth.admin_api_key / ADMIN_API_KEY not set)")
+	}
 
 	// Log viewer UI (static files - no auth required)
 	// Use a custom handler to serve static files without authentication
@@ -90,15 +257,27 @@ func main() {
 		fs.ServeHTTP(w, r)
 	})
 
+	// OpenAI 兼容路由
+	// instrumentRoute 的路由名用作 /metrics 的 route 标签（见 metrics.go）
+	// rejectWhenShuttingDown 在关闭过程中拒绝新请求（见 shutdown.go）
+	http.HandleFunc("/v1/chat/completions", instrumentRoute("openai_chat", rejectWhenShuttingDown(handleOpenAIChatCompletions)))
+	http.HandleFunc("/v1/models", instrumentRoute("openai_models", rejectWhenShuttingDown(handleOpenAIModels)))
+	http.HandleFunc("/v1/embeddings", instrumentRoute("openai_embeddings", rejectWhenShuttingDown(handleOpenAIEmbeddings)))
+
+	// Anthropic 兼容路由
+	http.HandleFunc("/v1/messages", instrumentRoute("anthropic_messages", rejectWhenShuttingDown(handleAnthropicMessages)))
+
 	// HTTP 反向代理路由 (捕获所有其他请求)
-	http.HandleFunc("/", handleProxyRequest)
+	http.HandleFunc("/", instrumentRoute("gemini", rejectWhenShuttingDown(handleProxyRequest)))
 
 	log.Printf("Starting server on %s", proxyListenAddr)
 	log.Printf("WebSocket endpoint available at ws://%s%s", proxyListenAddr, wsPath)
 	log.Printf("HTTP proxy available at http://%s/", proxyListenAddr)
+	log.Printf("OpenAI-compatible API available at http://%s/v1/chat/completions", proxyListenAddr)
+	log.Printf("Anthropic-compatible API available at http://%s/v1/messages", proxyListenAddr)
 	log.Printf("Log viewer UI available at http://%s/logs-ui/", proxyListenAddr)
+	log.Printf("Prometheus metrics available at http://%s%s", proxyListenAddr, metricsPath)
 
-	if err := http.ListenAndServe(proxyListenAddr, nil); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
-	}
+	// SIGTERM/SIGINT 时排空进行中的请求后退出（见 shutdown.go）
+	serveUntilShutdown(&http.Server{Addr: proxyListenAddr})
 }
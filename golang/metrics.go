@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Prometheus 指标 ---
+// GET /metrics 以 Prometheus 文本格式输出以下指标（与 /api/health 一样无需认证）：
+//
+//	aistudio_proxy_requests_total{route,model,status}          客户端请求数
+//	aistudio_proxy_request_duration_seconds{route}             请求总耗时
+//	aistudio_proxy_time_to_first_byte_seconds{route}           到写出响应头/首个字节的耗时
+//	aistudio_proxy_stream_duration_seconds{route}              stream_start 到流结束的耗时
+//	aistudio_proxy_stream_chunks{route}                        每个流的数据块数
+//	aistudio_proxy_active_connections{user}                    每个用户的浏览器连接数
+//	aistudio_proxy_pending_requests                            等待浏览器响应的请求数
+//	aistudio_proxy_dropped_messages_total{type,reason}         readPump 无法投递而丢弃的消息（type="stream_chunk" 即丢弃的数据块）
+//	aistudio_proxy_transformer_fired_total{stage,transformer}  转换器实际修改了请求/响应体的次数
+//
+// route 是固定的路由名（gemini、openai_chat 等），不使用请求路径，避免标签基数随模型名增长。
+// model 只取 /v1/models 从上游拿到过的模型名（见 models.go 的 knownModels），其余记为 "other"，
+// 客户端随意填写的模型名不会产生新的时间序列；请求没有模型时为空。
+// 指标很少，这里直接实现文本格式，不引入 client_golang。
+
+const metricsPath = "/metrics"
+
+var (
+	latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+	ttfbBuckets    = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	chunkBuckets   = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500}
+)
+
+var (
+	metricRequests = newMetricVec("aistudio_proxy_requests_total", "counter",
+		"Client requests handled by the proxy.", nil, "route", "model", "status")
+	metricRequestDuration = newMetricVec("aistudio_proxy_request_duration_seconds", "histogram",
+		"Time from receiving a client request to finishing the response.", latencyBuckets, "route")
+	metricTTFB = newMetricVec("aistudio_proxy_time_to_first_byte_seconds", "histogram",
+		"Time from receiving a client request to writing the response headers.", ttfbBuckets, "route")
+	metricStreamDuration = newMetricVec("aistudio_proxy_stream_duration_seconds", "histogram",
+		"Time from stream_start to the end of a streamed response.", latencyBuckets, "route")
+	metricStreamChunks = newMetricVec("aistudio_proxy_stream_chunks", "histogram",
+		"Number of stream_chunk messages per streamed response.", chunkBuckets, "route")
+	metricDroppedMessages = newMetricVec("aistudio_proxy_dropped_messages_total", "counter",
+		"Browser messages discarded because no request was waiting for them or its buffer was full.", nil, "type", "reason")
+	metricTransformerFired = newMetricVec("aistudio_proxy_transformer_fired_total", "counter",
+		"Times a transformer changed a request or response body.", nil, "stage", "transformer")
+)
+
+// metricVec 是一组同名、按标签区分的 counter 或 histogram
+type metricVec struct {
+	name    string
+	kind    string // "counter" 或 "histogram"
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counter 的值，histogram 的 sum
+	count       uint64   // histogram 的观测次数
+	bucketHits  []uint64 // 每个桶（非累计）的观测次数
+}
+
+// registeredMetrics 按注册顺序输出
+var registeredMetrics []*metricVec
+
+func newMetricVec(name, kind, help string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{name: name, kind: kind, help: help, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+	registeredMetrics = append(registeredMetrics, m)
+	return m
+}
+
+// get 返回标签值对应的序列，调用方持有 m.mu
+func (m *metricVec) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == "histogram" {
+			s.bucketHits = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// inc 将 counter 加一
+func (m *metricVec) inc(labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value++
+	m.mu.Unlock()
+}
+
+// observe 向 histogram 记录一次观测
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	s := m.get(labelValues)
+	s.value += v
+	s.count++
+	if i := sort.SearchFloat64s(m.buckets, v); i < len(m.buckets) {
+		s.bucketHits[i]++
+	}
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatFloat(s.value))
+			continue
+		}
+		// 限制容量，append 时复制而不是改写共享的切片
+		names := append(m.labels[:len(m.labels):len(m.labels)], "le")
+		values := s.labelValues[:len(s.labelValues):len(s.labelValues)]
+		var cumulative uint64
+		for i, upper := range m.buckets {
+			cumulative += s.bucketHits[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, append(values, formatFloat(upper))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, append(values, "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues), s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// handleMetrics 输出所有指标；连接数和等待中的请求数在抓取时从连接池统计
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, m := range registeredMetrics {
+		m.write(bw)
+	}
+
+	perUser := make(map[string]int)
+	for _, uc := range globalPool.allConnections() {
+		perUser[uc.UserID]++
+	}
+	users := make([]string, 0, len(perUser))
+	for u := range perUser {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	fmt.Fprintf(bw, "# HELP aistudio_proxy_active_connections Browser WebSocket connections in the pool.\n# TYPE aistudio_proxy_active_connections gauge\n")
+	for _, u := range users {
+		fmt.Fprintf(bw, "aistudio_proxy_active_connections%s %d\n", formatLabels([]string{"user"}, []string{u}), perUser[u])
+	}
+
+	fmt.Fprintf(bw, "# HELP aistudio_proxy_pending_requests Requests waiting for a browser response.\n# TYPE aistudio_proxy_pending_requests gauge\n")
+	fmt.Fprintf(bw, "aistudio_proxy_pending_requests %d\n", countPendingRequests())
+}
+
+// --- 请求级统计 ---
+
+// requestStats 记录一个客户端请求的指标标签和时间点，经由请求的 context 传给处理函数
+type requestStats struct {
+	route string
+	start time.Time
+
+	mu        sync.Mutex
+	model     string
+	status    int
+	firstByte bool
+}
+
+type requestStatsKey struct{}
+
+// statsFromRequest 返回 instrumentRoute 放入的统计信息，未经 instrumentRoute 的请求返回 nil
+func statsFromRequest(r *http.Request) *requestStats {
+	st, _ := r.Context().Value(requestStatsKey{}).(*requestStats)
+	return st
+}
+
+// setModel 在请求体解析出模型后调用
+func (st *requestStats) setModel(model string) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	st.model = model
+	st.mu.Unlock()
+}
+
+// routeLabel 返回流相关指标使用的路由名
+func (st *requestStats) routeLabel() string {
+	if st == nil {
+		return "unknown"
+	}
+	return st.route
+}
+
+// observeStream 在流式响应结束（正常结束、被中止或超时）时调用
+func (st *requestStats) observeStream(started time.Time, chunks int) {
+	route := st.routeLabel()
+	metricStreamDuration.observe(time.Since(started).Seconds(), route)
+	metricStreamChunks.observe(float64(chunks), route)
+}
+
+// headersWritten 记录首字节时间和状态码，只有第一次调用生效
+func (st *requestStats) headersWritten(status int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.firstByte {
+		return
+	}
+	st.firstByte = true
+	st.status = status
+	metricTTFB.observe(time.Since(st.start).Seconds(), st.route)
+}
+
+// finish 记录请求数和耗时，返回写给客户端的状态码
+func (st *requestStats) finish() int {
+	st.mu.Lock()
+	status, model := st.status, st.model
+	st.mu.Unlock()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	metricRequests.inc(st.route, metricModelLabel(model), strconv.Itoa(status))
+	metricRequestDuration.observe(time.Since(st.start).Seconds(), st.route)
+	return status
+}
+
+// metricModelLabel 将模型名映射为有界的标签值
+func metricModelLabel(model string) string {
+	model = strings.TrimPrefix(model, "models/")
+	if model == "" {
+		return ""
+	}
+	if _, ok := knownModels.Load(model); ok {
+		return model
+	}
+	return "other"
+}
+
+// metricsResponseWriter 捕获状态码和首字节时间，保留 Flush 以支持流式响应
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	stats *requestStats
+}
+
+func (mw *metricsResponseWriter) WriteHeader(status int) {
+	mw.stats.headersWritten(status)
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
+	mw.stats.headersWritten(http.StatusOK)
+	return mw.ResponseWriter.Write(b)
+}
+
+func (mw *metricsResponseWriter) Flush() {
+	if f, ok := mw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap 供 http.ResponseController 访问底层 ResponseWriter
+func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
+
+// instrumentRoute 为代理路由记录请求数、耗时和首字节时间，并创建请求的根 span（见 tracing.go）
+func instrumentRoute(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := &requestStats{route: route, start: time.Now()}
+		ctx := context.WithValue(r.Context(), requestStatsKey{}, st)
+		ctx, span := startServerSpan(ctx, r, r.Method+" "+route)
+		defer func() {
+			status := st.finish()
+			span.setAttr("http.route", route)
+			span.setAttr("http.response.status_code", status)
+			if status >= 500 {
+				span.setError(http.StatusText(status))
+			}
+			span.end()
+		}()
+		h(&metricsResponseWriter{ResponseWriter: w, stats: st}, r.WithContext(ctx))
+	}
+}
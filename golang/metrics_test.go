@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestMetricModelLabel(t *testing.T) {
+	knownModels.Store("gemini-2.5-pro", int64(1))
+	t.Cleanup(func() { knownModels.Delete("gemini-2.5-pro") })
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"", ""},
+		{"gemini-2.5-pro", "gemini-2.5-pro"},
+		{"models/gemini-2.5-pro", "gemini-2.5-pro"},
+		{"gemini-2.5-pro-typo", "other"},
+		{"anything-a-client-sends", "other"},
+	}
+	for _, tt := range tests {
+		if got := metricModelLabel(tt.model); got != tt.want {
+			t.Errorf("metricModelLabel(%q) = %q, want %q", tt.model, got, tt.want)
+		}
+	}
+}
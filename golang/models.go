@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- OpenAI /v1/models 兼容层 ---
+// 通过浏览器隧道获取 v1beta/models（跟随 nextPageToken 取完所有页）并转换为 OpenAI 列表格式。
+// 结果按用户缓存 timeouts.models_cache_ttl（为 0 时不缓存），避免模型选择器每次加载都经过浏览器；
+// 同一用户同时发生的缓存未命中只向上游请求一次，其余请求等待并共用结果。
+
+// modelsMaxPages 限制跟随 nextPageToken 的次数，防止上游一直返回新的 token
+const modelsMaxPages = 20
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type openAIModelList struct {
+	Object string        `json:"object"`
+	Data   []openAIModel `json:"data"`
+}
+
+type modelsCacheEntry struct {
+	list      []byte
+	expiresAt time.Time
+}
+
+// modelsFetch 是一次进行中的上游获取，done 关闭后 list 为结果（失败时为 nil）
+type modelsFetch struct {
+	done chan struct{}
+	list []byte
+}
+
+var (
+	modelsCache    = make(map[string]modelsCacheEntry) // key: userID
+	modelsInflight = make(map[string]*modelsFetch)     // key: userID，受 modelsCacheMu 保护
+	modelsCacheMu  sync.Mutex
+
+	// knownModels 记录上游模型列表中出现过的模型名及首次出现的时间（Unix 秒，不随缓存过期）。
+	// 它是指标 model 标签的白名单（见 metrics.go 的 metricModelLabel），
+	// 也是 OpenAI 列表中的 created：Gemini 不提供模型的创建时间，用首次出现时间保证同一进程内的值稳定
+	knownModels sync.Map // key: 模型名（不含 models/ 前缀）
+)
+
+func handleOpenAIModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	apiKey, err := authenticateHTTPRequest(r)
+	if err != nil {
+		writeOpenAIError(w, http.StatusUnauthorized, "Proxy authentication failed", "")
+		return
+	}
+
+	list, fetch, leader := cachedModelList(apiKey.UserID)
+	if list == nil && !leader {
+		// 同一用户的另一个请求正在获取，等待它的结果；它失败时自己再获取一次
+		select {
+		case <-fetch.done:
+			list = fetch.list
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if list != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(list)
+		return
+	}
+
+	list = fetchModelList(w, r, apiKey)
+	if leader {
+		finishModelsFetch(apiKey.UserID, fetch, list)
+	}
+	if list != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(list)
+	}
+}
+
+// cachedModelList 返回未过期的缓存列表；未命中时返回进行中的获取，
+// 没有进行中的获取时登记一个新的，leader 为 true 表示调用方负责获取并调用 finishModelsFetch
+func cachedModelList(userID string) (list []byte, fetch *modelsFetch, leader bool) {
+	modelsCacheMu.Lock()
+	defer modelsCacheMu.Unlock()
+
+	if entry, ok := modelsCache[userID]; ok && time.Now().Before(entry.expiresAt) {
+		return entry.list, nil, false
+	}
+	if fetch, ok := modelsInflight[userID]; ok {
+		return nil, fetch, false
+	}
+	fetch = &modelsFetch{done: make(chan struct{})}
+	modelsInflight[userID] = fetch
+	return nil, fetch, true
+}
+
+// finishModelsFetch 缓存结果并唤醒等待的请求
+func finishModelsFetch(userID string, fetch *modelsFetch, list []byte) {
+	modelsCacheMu.Lock()
+	if ttl := currentConfig().Timeouts.ModelsCacheTTL; ttl > 0 && list != nil {
+		modelsCache[userID] = modelsCacheEntry{list: list, expiresAt: time.Now().Add(ttl)}
+	}
+	delete(modelsInflight, userID)
+	modelsCacheMu.Unlock()
+
+	fetch.list = list
+	close(fetch.done)
+}
+
+// fetchModelList 逐页获取上游模型列表并转换为 OpenAI 格式；失败时已把错误写给客户端，返回 nil
+func fetchModelList(w http.ResponseWriter, r *http.Request, apiKey *APIKey) []byte {
+	reqID := uuid.NewString()
+	addLog("INFO", fmt.Sprintf("[OPENAI %s] models list cache miss, fetching from upstream", reqID), map[string]interface{}{
+		"request_id": reqID,
+		"user_id":    apiKey.UserID,
+		"key_label":  apiKey.Label,
+	})
+
+	out := openAIModelList{Object: "list", Data: []openAIModel{}}
+	pageToken := ""
+	for page := 0; page < modelsMaxPages; page++ {
+		path := "/v1beta/models?pageSize=1000"
+		if pageToken != "" {
+			path += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		t := &modelsPageTranslator{}
+		tw := newTranslatingWriter(w, t, false)
+		dispatchUpstream(tw, r, &upstreamRequest{
+			ID:       fmt.Sprintf("%s-p%d", reqID, page+1),
+			UserID:   apiKey.UserID,
+			KeyLabel: apiKey.Label,
+			Route:    r.URL.Path,
+			Method:   http.MethodGet,
+			Path:     path,
+			Headers:  map[string][]string{},
+		})
+		tw.finish()
+		if !t.ok {
+			return nil
+		}
+		out.Data = append(out.Data, t.models...)
+		if pageToken = t.nextPageToken; pageToken == "" {
+			break
+		}
+	}
+	if pageToken != "" {
+		log.Printf("[OPENAI %s] models list still has more pages after %d, returning what was fetched", reqID, modelsMaxPages)
+	}
+
+	list, err := json.Marshal(out)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "Failed to encode models list", "")
+		return nil
+	}
+	return list
+}
+
+// modelsPageTranslator 解析一页 Gemini 模型列表，成功时不写响应（由 fetchModelList 合并各页后写出），
+// 失败时以 OpenAI 格式写出错误
+type modelsPageTranslator struct {
+	ok            bool
+	models        []openAIModel
+	nextPageToken string
+}
+
+func (t *modelsPageTranslator) fail(w http.ResponseWriter, status int, message, code string) {
+	writeOpenAIError(w, status, message, code)
+}
+
+func (t *modelsPageTranslator) complete(w http.ResponseWriter, body []byte) {
+	var resp struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+		NextPageToken string `json:"nextPageToken"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("[OPENAI] Failed to parse Gemini models list: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "Invalid response from upstream: "+err.Error(), "")
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, m := range resp.Models {
+		id := strings.TrimPrefix(m.Name, "models/")
+		created, _ := knownModels.LoadOrStore(id, now)
+		t.models = append(t.models, openAIModel{
+			ID:      id,
+			Object:  "model",
+			Created: created.(int64),
+			OwnedBy: "google",
+		})
+	}
+	t.nextPageToken = resp.NextPageToken
+	t.ok = true
+}
+
+func (t *modelsPageTranslator) streamEvent(w http.ResponseWriter, data []byte) {}
+
+func (t *modelsPageTranslator) streamEnd(w http.ResponseWriter) {}
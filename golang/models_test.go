@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestModelsPageTranslator(t *testing.T) {
+	t.Cleanup(func() { knownModels.Delete("test-model-a"); knownModels.Delete("test-model-b") })
+
+	parse := func(body string) *modelsPageTranslator {
+		tr := &modelsPageTranslator{}
+		tr.complete(httptest.NewRecorder(), []byte(body))
+		return tr
+	}
+
+	first := parse(`{"models":[{"name":"models/test-model-a"}],"nextPageToken":"page2"}`)
+	if !first.ok || first.nextPageToken != "page2" || len(first.models) != 1 || first.models[0].ID != "test-model-a" {
+		t.Fatalf("first page = %+v", first)
+	}
+	if first.models[0].Created == 0 {
+		t.Fatal("created should be set")
+	}
+
+	// 再次出现的模型沿用首次的 created
+	knownModels.Store("test-model-a", int64(1))
+	again := parse(`{"models":[{"name":"models/test-model-a"},{"name":"models/test-model-b"}]}`)
+	if again.nextPageToken != "" || again.models[0].Created != 1 || again.models[1].Created == 0 {
+		t.Fatalf("second parse = %+v", again)
+	}
+
+	rec := httptest.NewRecorder()
+	bad := &modelsPageTranslator{}
+	bad.complete(rec, []byte(`not json`))
+	var errResp map[string]interface{}
+	if bad.ok || rec.Code != 502 || json.Unmarshal(rec.Body.Bytes(), &errResp) != nil {
+		t.Fatalf("invalid body: ok=%v status=%d body=%s", bad.ok, rec.Code, rec.Body)
+	}
+}
+
+func TestCachedModelListCoalescesMisses(t *testing.T) {
+	const user = "models-test-user"
+	t.Cleanup(func() {
+		modelsCacheMu.Lock()
+		delete(modelsCache, user)
+		delete(modelsInflight, user)
+		modelsCacheMu.Unlock()
+	})
+
+	list, leaderFetch, leader := cachedModelList(user)
+	if list != nil || !leader {
+		t.Fatalf("first miss: list=%s leader=%v", list, leader)
+	}
+	list, fetch, leader := cachedModelList(user)
+	if list != nil || leader || fetch != leaderFetch {
+		t.Fatalf("concurrent miss should wait for the leader: list=%s leader=%v", list, leader)
+	}
+
+	finishModelsFetch(user, leaderFetch, []byte(`{"object":"list","data":[]}`))
+	select {
+	case <-fetch.done:
+	default:
+		t.Fatal("waiters should be released")
+	}
+	if string(fetch.list) != `{"object":"list","data":[]}` {
+		t.Fatalf("waiter list = %s", fetch.list)
+	}
+	if list, _, leader := cachedModelList(user); string(list) != `{"object":"list","data":[]}` || leader {
+		t.Fatalf("after fetch: list=%s leader=%v", list, leader)
+	}
+
+	// 失败的获取不缓存，下一次未命中重新成为 leader
+	modelsCacheMu.Lock()
+	delete(modelsCache, user)
+	modelsCacheMu.Unlock()
+	_, failed, _ := cachedModelList(user)
+	finishModelsFetch(user, failed, nil)
+	if _, _, leader := cachedModelList(user); !leader {
+		t.Fatal("a failed fetch should not be cached")
+	}
+}
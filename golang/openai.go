@@ -0,0 +1,782 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// --- OpenAI Chat Completions 兼容层 ---
+// 将 /v1/chat/completions 请求转换为 Gemini generateContent / streamGenerateContent，
+// 经由 dispatchUpstream 走同一条浏览器隧道，再把 Gemini 响应转换回 OpenAI 格式。
+
+type openAIChatRequest struct {
+	Model         string              `json:"model"`
+	Messages      []openAIChatMessage `json:"messages"`
+	Stream        bool                `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+	Tools               []openAITool      `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage   `json:"tool_choice,omitempty"`
+	ResponseFormat      *openAIRespFormat `json:"response_format,omitempty"`
+	ReasoningEffort     string            `json:"reasoning_effort,omitempty"`
+	Temperature         *float64          `json:"temperature,omitempty"`
+	TopP                *float64          `json:"top_p,omitempty"`
+	MaxTokens           *int              `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int              `json:"max_completion_tokens,omitempty"`
+	N                   *int              `json:"n,omitempty"`
+	Stop                json.RawMessage   `json:"stop,omitempty"`
+	PresencePenalty     *float64          `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64          `json:"frequency_penalty,omitempty"`
+	Seed                *int64            `json:"seed,omitempty"`
+}
+
+type openAIChatMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content,omitempty"`
+	Name       string           `json:"name,omitempty"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+	InputAudio *struct {
+		Data   string `json:"data"`
+		Format string `json:"format"`
+	} `json:"input_audio,omitempty"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description,omitempty"`
+		Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAIRespFormat struct {
+	Type       string `json:"type"` // text, json_object, json_schema
+	JSONSchema *struct {
+		Name   string      `json:"name"`
+		Schema interface{} `json:"schema"`
+	} `json:"json_schema,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens            int `json:"prompt_tokens"`
+	CompletionTokens        int `json:"completion_tokens"`
+	TotalTokens             int `json:"total_tokens"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+type openAIResponseMessage struct {
+	Role             string           `json:"role,omitempty"`
+	Content          *string          `json:"content,omitempty"`
+	ReasoningContent string           `json:"reasoning_content,omitempty"`
+	ToolCalls        []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int                    `json:"index"`
+	Message      *openAIResponseMessage `json:"message,omitempty"`
+	Delta        *openAIResponseMessage `json:"delta,omitempty"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type openAIChatResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+func handleOpenAIChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return
+	}
+
+	apiKey, err := authenticateHTTPRequest(r)
+	if err != nil {
+		writeOpenAIError(w, http.StatusUnauthorized, "Proxy authentication failed", "")
+		return
+	}
+
+	var req openAIChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error(), "")
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Model == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "'model' is required", "")
+		return
+	}
+
+	geminiReq, err := convertOpenAIChatRequest(&req)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+	bodyBytes, err := json.Marshal(geminiReq)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "Failed to build Gemini request", "")
+		return
+	}
+
+	reqID := uuid.NewString()
+	addLog("INFO", fmt.Sprintf("[OPENAI %s] chat.completions model=%s stream=%v", reqID, req.Model, req.Stream), map[string]interface{}{
+		"request_id":     reqID,
+		"user_id":        apiKey.UserID,
+		"key_label":      apiKey.Label,
+		"model":          req.Model,
+		"stream":         req.Stream,
+		"message_count":  len(req.Messages),
+		"tool_count":     len(req.Tools),
+		"openai_request": &req,
+	})
+
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	tw := newTranslatingWriter(w, newOpenAIChatTranslator(req.Model, includeUsage), req.Stream)
+	upstream := &upstreamRequest{
+		ID:       reqID,
+		UserID:   apiKey.UserID,
+		KeyLabel: apiKey.Label,
+		Route:    r.URL.Path,
+		Model:    req.Model,
+		Method:   http.MethodPost,
+		Path:     geminiModelPath(req.Model, req.Stream),
+		Headers:  map[string][]string{"Content-Type": {"application/json"}},
+	}
+	// 转换结果同样需要经过原生路径上的请求转换器（例如清理工具 schema 中不支持的字段）
+	upstream.Body = applyRequestTransformers(r.Context(), upstream.transformContext(), bodyBytes)
+	dispatchUpstream(tw, r, upstream)
+	tw.finish()
+}
+
+// convertOpenAIChatRequest 将 OpenAI Chat Completions 请求转换为 Gemini 请求
+func convertOpenAIChatRequest(req *openAIChatRequest) (*geminiRequest, error) {
+	out := &geminiRequest{Contents: []geminiContent{}}
+
+	// tool_call_id -> 函数名，tool 消息只携带 id，而 Gemini 的 functionResponse 需要函数名
+	toolNames := make(map[string]string)
+	// 相邻的同类消息合并为一个 content（并行工具调用的结果必须放在同一个 content 中）
+	lastKind := ""
+
+	for i, msg := range req.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			parts, err := openAIContentToParts(msg.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			if out.SystemInstruction == nil {
+				out.SystemInstruction = &geminiContent{}
+			}
+			out.SystemInstruction.Parts = append(out.SystemInstruction.Parts, parts...)
+			continue
+
+		case "user", "assistant":
+			parts, err := openAIContentToParts(msg.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			role := "user"
+			if msg.Role == "assistant" {
+				role = "model"
+				for _, tc := range msg.ToolCalls {
+					args := map[string]interface{}{}
+					if strings.TrimSpace(tc.Function.Arguments) != "" {
+						if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+							return nil, fmt.Errorf("messages[%d]: invalid JSON in tool_calls arguments for %s", i, tc.Function.Name)
+						}
+					}
+					toolNames[tc.ID] = tc.Function.Name
+					parts = append(parts, geminiPart{
+						FunctionCall:     &geminiFunctionCall{Name: tc.Function.Name, Args: args},
+						ThoughtSignature: openAIToolCallSignature(tc.ID),
+					})
+				}
+			}
+			if len(parts) == 0 {
+				continue
+			}
+			out.Contents = appendGeminiContent(out.Contents, role, lastKind == role, parts)
+			lastKind = role
+
+		case "tool", "function":
+			name := msg.Name
+			if n, ok := toolNames[msg.ToolCallID]; ok {
+				name = n
+			}
+			if name == "" {
+				return nil, fmt.Errorf("messages[%d]: cannot resolve function name for tool_call_id %q", i, msg.ToolCallID)
+			}
+			text, err := openAIContentText(msg.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			part := geminiPart{FunctionResponse: &geminiFunctionResponse{Name: name, Response: functionResponseObject(text)}}
+			out.Contents = appendGeminiContent(out.Contents, "user", lastKind == "function", []geminiPart{part})
+			lastKind = "function"
+
+		default:
+			return nil, fmt.Errorf("messages[%d]: unsupported role %q", i, msg.Role)
+		}
+	}
+
+	if len(req.Tools) > 0 {
+		decls := make([]geminiFunctionDeclaration, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			if t.Type != "" && t.Type != "function" {
+				continue
+			}
+			decls = append(decls, geminiFunctionDeclaration{
+				Name:        t.Function.Name,
+				Description: t.Function.Description,
+				Parameters:  t.Function.Parameters,
+			})
+		}
+		if len(decls) > 0 {
+			out.Tools = []geminiTool{{FunctionDeclarations: decls}}
+		}
+	}
+
+	toolConfig, err := convertOpenAIToolChoice(req.ToolChoice)
+	if err != nil {
+		return nil, err
+	}
+	out.ToolConfig = toolConfig
+
+	genConfig, err := convertOpenAIGenerationConfig(req)
+	if err != nil {
+		return nil, err
+	}
+	out.GenerationConfig = genConfig
+
+	return out, nil
+}
+
+// appendGeminiContent 追加一条 content，merge 为 true 时并入上一条
+func appendGeminiContent(contents []geminiContent, role string, merge bool, parts []geminiPart) []geminiContent {
+	if merge && len(contents) > 0 {
+		last := &contents[len(contents)-1]
+		last.Parts = append(last.Parts, parts...)
+		return contents
+	}
+	return append(contents, geminiContent{Role: role, Parts: parts})
+}
+
+// functionResponseObject 将工具结果包装为 Gemini 要求的 JSON 对象
+func functionResponseObject(text string) map[string]interface{} {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &obj); err == nil && obj != nil {
+		return obj
+	}
+	return map[string]interface{}{"content": text}
+}
+
+// openAIContentToParts 解析 content（字符串或内容块数组）为 Gemini parts
+func openAIContentToParts(raw json.RawMessage) ([]geminiPart, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []geminiPart{{Text: text}}, nil
+	}
+
+	var blocks []openAIContentPart
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, errors.New("content must be a string or an array of content parts")
+	}
+	parts := make([]geminiPart, 0, len(blocks))
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			if b.Text != "" {
+				parts = append(parts, geminiPart{Text: b.Text})
+			}
+		case "image_url":
+			if b.ImageURL == nil || b.ImageURL.URL == "" {
+				return nil, errors.New("image_url content part is missing url")
+			}
+			parts = append(parts, imageURLToPart(b.ImageURL.URL))
+		case "input_audio":
+			if b.InputAudio == nil {
+				return nil, errors.New("input_audio content part is missing data")
+			}
+			parts = append(parts, geminiPart{InlineData: &geminiBlob{MimeType: "audio/" + b.InputAudio.Format, Data: b.InputAudio.Data}})
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", b.Type)
+		}
+	}
+	return parts, nil
+}
+
+// openAIContentText 将 content 中的文本拼接为一个字符串
+func openAIContentText(raw json.RawMessage) (string, error) {
+	parts, err := openAIContentToParts(raw)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, p := range parts {
+		sb.WriteString(p.Text)
+	}
+	return sb.String(), nil
+}
+
+// imageURLToPart data URL 转为 inlineData，其它 URL 转为 fileData
+func imageURLToPart(u string) geminiPart {
+	if rest, ok := strings.CutPrefix(u, "data:"); ok {
+		if meta, data, ok := strings.Cut(rest, ","); ok {
+			mimeType := strings.TrimSuffix(meta, ";base64")
+			return geminiPart{InlineData: &geminiBlob{MimeType: mimeType, Data: data}}
+		}
+	}
+	mimeType := mime.TypeByExtension(path.Ext(strings.SplitN(u, "?", 2)[0]))
+	if mimeType == "" {
+		mimeType = "image/jpeg"
+	}
+	return geminiPart{FileData: &geminiFileData{MimeType: mimeType, FileURI: u}}
+}
+
+// convertOpenAIToolChoice 将 tool_choice 转换为 Gemini functionCallingConfig
+func convertOpenAIToolChoice(raw json.RawMessage) (*geminiToolConfig, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		switch mode {
+		case "auto":
+			return &geminiToolConfig{FunctionCallingConfig: &geminiFunctionCallingConfig{Mode: "AUTO"}}, nil
+		case "none":
+			return &geminiToolConfig{FunctionCallingConfig: &geminiFunctionCallingConfig{Mode: "NONE"}}, nil
+		case "required":
+			return &geminiToolConfig{FunctionCallingConfig: &geminiFunctionCallingConfig{Mode: "ANY"}}, nil
+		}
+		return nil, fmt.Errorf("unsupported tool_choice %q", mode)
+	}
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &named); err != nil || named.Function.Name == "" {
+		return nil, errors.New("tool_choice must be a string or {\"type\":\"function\",\"function\":{\"name\":...}}")
+	}
+	return &geminiToolConfig{FunctionCallingConfig: &geminiFunctionCallingConfig{
+		Mode:                 "ANY",
+		AllowedFunctionNames: []string{named.Function.Name},
+	}}, nil
+}
+
+// convertOpenAIGenerationConfig 转换采样参数、response_format 和 reasoning_effort
+func convertOpenAIGenerationConfig(req *openAIChatRequest) (*geminiGenerationConfig, error) {
+	cfg := &geminiGenerationConfig{
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		MaxOutputTokens:  req.MaxTokens,
+		CandidateCount:   req.N,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Seed:             req.Seed,
+	}
+	if req.MaxCompletionTokens != nil {
+		cfg.MaxOutputTokens = req.MaxCompletionTokens
+	}
+
+	if len(req.Stop) > 0 && string(req.Stop) != "null" {
+		var stop string
+		if err := json.Unmarshal(req.Stop, &stop); err == nil {
+			cfg.StopSequences = []string{stop}
+		} else if err := json.Unmarshal(req.Stop, &cfg.StopSequences); err != nil {
+			return nil, errors.New("stop must be a string or an array of strings")
+		}
+	}
+
+	if rf := req.ResponseFormat; rf != nil {
+		switch rf.Type {
+		case "", "text":
+		case "json_object":
+			cfg.ResponseMimeType = "application/json"
+		case "json_schema":
+			cfg.ResponseMimeType = "application/json"
+			if rf.JSONSchema != nil && rf.JSONSchema.Schema != nil {
+				cfg.ResponseJSONSchema = rf.JSONSchema.Schema
+			}
+		default:
+			return nil, fmt.Errorf("unsupported response_format type %q", rf.Type)
+		}
+	}
+
+	switch req.ReasoningEffort {
+	case "":
+	case "none":
+		budget := 0
+		cfg.ThinkingConfig = &geminiThinkingConfig{ThinkingBudget: &budget}
+	default:
+		level := req.ReasoningEffort
+		if level == "minimal" {
+			level = "low"
+		}
+		budget := thinkingBudgetForLevel(level)
+		cfg.ThinkingConfig = &geminiThinkingConfig{ThinkingBudget: &budget, IncludeThoughts: true}
+	}
+
+	return cfg, nil
+}
+
+// openAIFinishReason 将 Gemini finishReason 映射为 OpenAI finish_reason
+func openAIFinishReason(reason string, sawToolCall bool) string {
+	switch reason {
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	}
+	if sawToolCall {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+func openAIUsageFromGemini(u *geminiUsageMetadata) *openAIUsage {
+	if u == nil {
+		return nil
+	}
+	usage := &openAIUsage{
+		PromptTokens:     u.PromptTokenCount,
+		CompletionTokens: u.CandidatesTokenCount + u.ThoughtsTokenCount,
+		TotalTokens:      u.TotalTokenCount,
+	}
+	usage.CompletionTokensDetails.ReasoningTokens = u.ThoughtsTokenCount
+	usage.PromptTokensDetails.CachedTokens = u.CachedContentTokenCount
+	return usage
+}
+
+// openAIErrorType 根据HTTP状态码给出 OpenAI 风格的错误类型
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 500:
+		return "server_error"
+	}
+	return "invalid_request_error"
+}
+
+// writeOpenAIError 以 OpenAI 错误格式写出响应
+func writeOpenAIError(w http.ResponseWriter, status int, message, code string) {
+	var errCode interface{}
+	if code != "" {
+		errCode = code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    openAIErrorType(status),
+			"param":   nil,
+			"code":    errCode,
+		},
+	})
+}
+
+// openAIChatTranslator 将 Gemini 响应转换为 chat.completion / chat.completion.chunk
+type openAIChatTranslator struct {
+	model        string
+	includeUsage bool
+	id           string
+	created      int64
+
+	// 流式状态
+	roleSent      map[int]bool
+	finishReasons map[int]string
+	sawToolCall   map[int]bool
+	toolIndex     map[int]int
+	usage         *openAIUsage
+}
+
+func newOpenAIChatTranslator(model string, includeUsage bool) *openAIChatTranslator {
+	return &openAIChatTranslator{
+		model:         model,
+		includeUsage:  includeUsage,
+		id:            "chatcmpl-" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		created:       time.Now().Unix(),
+		roleSent:      make(map[int]bool),
+		finishReasons: make(map[int]string),
+		sawToolCall:   make(map[int]bool),
+		toolIndex:     make(map[int]int),
+	}
+}
+
+func (t *openAIChatTranslator) fail(w http.ResponseWriter, status int, message, code string) {
+	writeOpenAIError(w, status, message, code)
+}
+
+func (t *openAIChatTranslator) complete(w http.ResponseWriter, body []byte) {
+	var resp geminiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("[OPENAI] Failed to parse Gemini response: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "Invalid response from upstream: "+err.Error(), "")
+		return
+	}
+
+	out := openAIChatResponse{
+		ID:      t.id,
+		Object:  "chat.completion",
+		Created: t.created,
+		Model:   t.model,
+		Choices: []openAIChoice{},
+		Usage:   openAIUsageFromGemini(resp.UsageMetadata),
+	}
+	for _, cand := range resp.Candidates {
+		msg := &openAIResponseMessage{Role: "assistant"}
+		var text strings.Builder
+		for _, part := range cand.Content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				msg.ToolCalls = append(msg.ToolCalls, openAIToolCallFromGemini(part, nil))
+			case part.Thought:
+				msg.ReasoningContent += part.Text
+			default:
+				text.WriteString(part.Text)
+			}
+		}
+		if text.Len() > 0 || len(msg.ToolCalls) == 0 {
+			content := text.String()
+			msg.Content = &content
+		}
+		reason := openAIFinishReason(cand.FinishReason, len(msg.ToolCalls) > 0)
+		out.Choices = append(out.Choices, openAIChoice{Index: cand.Index, Message: msg, FinishReason: &reason})
+	}
+	if len(out.Choices) == 0 && resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		content := ""
+		reason := "content_filter"
+		out.Choices = append(out.Choices, openAIChoice{
+			Message:      &openAIResponseMessage{Role: "assistant", Content: &content},
+			FinishReason: &reason,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(out)
+}
+
+// streamEvent 将一个 Gemini SSE 事件转换为 chat.completion.chunk
+func (t *openAIChatTranslator) streamEvent(w http.ResponseWriter, data []byte) {
+	var resp geminiResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		log.Printf("[OPENAI] Skipping unparsable stream event: %v", err)
+		return
+	}
+	if resp.UsageMetadata != nil {
+		t.usage = openAIUsageFromGemini(resp.UsageMetadata)
+	}
+
+	for _, cand := range resp.Candidates {
+		idx := cand.Index
+		delta := &openAIResponseMessage{}
+		if !t.roleSent[idx] {
+			delta.Role = "assistant"
+			t.roleSent[idx] = true
+		}
+		var text strings.Builder
+		for _, part := range cand.Content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				toolIdx := t.toolIndex[idx]
+				t.toolIndex[idx]++
+				t.sawToolCall[idx] = true
+				delta.ToolCalls = append(delta.ToolCalls, openAIToolCallFromGemini(part, &toolIdx))
+			case part.Thought:
+				delta.ReasoningContent += part.Text
+			default:
+				text.WriteString(part.Text)
+			}
+		}
+		if text.Len() > 0 || delta.Role != "" {
+			content := text.String()
+			delta.Content = &content
+		}
+		if cand.FinishReason != "" {
+			t.finishReasons[idx] = cand.FinishReason
+		}
+		if delta.Content == nil && delta.ReasoningContent == "" && len(delta.ToolCalls) == 0 {
+			continue
+		}
+		t.writeChunk(w, []openAIChoice{{Index: idx, Delta: delta}}, nil)
+	}
+}
+
+// streamEnd 输出 finish_reason、可选的 usage 以及 [DONE]
+func (t *openAIChatTranslator) streamEnd(w http.ResponseWriter) {
+	if len(t.finishReasons) == 0 && len(t.roleSent) == 0 {
+		t.finishReasons[0] = ""
+	}
+	for idx := range t.roleSent {
+		if _, ok := t.finishReasons[idx]; !ok {
+			t.finishReasons[idx] = ""
+		}
+	}
+	indexes := make([]int, 0, len(t.finishReasons))
+	for idx := range t.finishReasons {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	for _, idx := range indexes {
+		finish := openAIFinishReason(t.finishReasons[idx], t.sawToolCall[idx])
+		t.writeChunk(w, []openAIChoice{{Index: idx, Delta: &openAIResponseMessage{}, FinishReason: &finish}}, nil)
+	}
+	if t.includeUsage && t.usage != nil {
+		t.writeChunk(w, []openAIChoice{}, t.usage)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// streamFail 在流中断时写出 OpenAI 格式的错误块，不写 finish_reason 和 [DONE]，
+// 客户端（如 openai SDK）会把它当作错误而不是正常结束的回答
+func (t *openAIChatTranslator) streamFail(w http.ResponseWriter, status int, message string) {
+	data, err := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    openAIErrorType(status),
+			"param":   nil,
+			"code":    nil,
+		},
+	})
+	if err != nil {
+		log.Printf("[OPENAI] Failed to marshal stream error: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+func (t *openAIChatTranslator) writeChunk(w http.ResponseWriter, choices []openAIChoice, usage *openAIUsage) {
+	chunk := openAIChatResponse{
+		ID:      t.id,
+		Object:  "chat.completion.chunk",
+		Created: t.created,
+		Model:   t.model,
+		Choices: choices,
+		Usage:   usage,
+	}
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		log.Printf("[OPENAI] Failed to marshal stream chunk: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// openAIToolSignatureLimit 是服务器端最多保存的 tool_call 签名数，超出时淘汰最早保存的
+const openAIToolSignatureLimit = 10000
+
+// openAIToolSignatures 保存 functionCall 的 thoughtSignature，以 tool_call id 为键。
+// 签名常有数百字节以上，而不少 OpenAI 客户端限制 tool_call id 的长度（如 40 个字符），
+// 因此不像 Anthropic 那样编码进 id（见 toolCallIDWithSignature），客户端带回的 id 保持原样长度。
+// 签名只保存在内存中：代理重启或被淘汰后，下一轮请求中对应的 functionCall 不带签名
+var openAIToolSignatures = &toolSignatureStore{byID: map[string]string{}, limit: openAIToolSignatureLimit}
+
+type toolSignatureStore struct {
+	mu    sync.Mutex
+	byID  map[string]string
+	order []string // 保存顺序，用于淘汰
+	limit int
+}
+
+func (s *toolSignatureStore) put(id, signature string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[id]; !ok {
+		s.order = append(s.order, id)
+	}
+	s.byID[id] = signature
+	for len(s.order) > s.limit {
+		delete(s.byID, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *toolSignatureStore) get(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byID[id]
+}
+
+// openAIToolCallSignature 返回客户端带回的 tool_call id 对应的 thoughtSignature，
+// 也接受早期版本把签名编码进 id 的格式
+func openAIToolCallSignature(id string) string {
+	if signature := openAIToolSignatures.get(id); signature != "" {
+		return signature
+	}
+	return splitToolCallSignature(id)
+}
+
+// openAIToolCallFromGemini 转换 functionCall part，thoughtSignature 保存在服务器端（见 openAIToolSignatures）；
+// 流式响应需要带上 index
+func openAIToolCallFromGemini(part geminiPart, index *int) openAIToolCall {
+	fc := part.FunctionCall
+	args, err := json.Marshal(fc.Args)
+	if err != nil || fc.Args == nil {
+		args = []byte("{}")
+	}
+	id := fc.ID
+	if id == "" {
+		id = "call_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:24]
+	}
+	if part.ThoughtSignature != "" {
+		openAIToolSignatures.put(id, part.ThoughtSignature)
+	}
+	tc := openAIToolCall{Index: index, ID: id, Type: "function"}
+	tc.Function.Name = fc.Name
+	tc.Function.Arguments = string(args)
+	return tc
+}
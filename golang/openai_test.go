@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIToolCallSignatureRoundTrip(t *testing.T) {
+	const sig = "c2lnL2NhbGwr/w=="
+
+	rec := httptest.NewRecorder()
+	newOpenAIChatTranslator("gemini-2.5-pro", false).complete(rec, []byte(`{"candidates":[{"content":{"role":"model","parts":[
+		{"functionCall":{"name":"lookup","args":{"q":"x"}},"thoughtSignature":"`+sig+`"}
+	]},"finishReason":"STOP"}]}`))
+	var resp openAIChatResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	calls := resp.Choices[0].Message.ToolCalls
+	if len(calls) != 1 {
+		t.Fatalf("tool_calls = %+v", calls)
+	}
+	// 签名保存在服务器端，id 保持客户端能接受的长度
+	if len(calls[0].ID) > 40 || strings.Contains(calls[0].ID, toolCallSignatureSep) {
+		t.Fatalf("tool_call id %q carries the signature", calls[0].ID)
+	}
+
+	req := &openAIChatRequest{Messages: []openAIChatMessage{
+		{Role: "user", Content: json.RawMessage(`"hi"`)},
+		{Role: "assistant", ToolCalls: calls},
+		{Role: "tool", ToolCallID: calls[0].ID, Content: json.RawMessage(`"result"`)},
+	}}
+	out, err := convertOpenAIChatRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := out.Contents[1].Parts[0]
+	if part.FunctionCall == nil || part.FunctionCall.Name != "lookup" || part.ThoughtSignature != sig {
+		t.Fatalf("model part = %+v", part)
+	}
+	if fr := out.Contents[2].Parts[0].FunctionResponse; fr == nil || fr.Name != "lookup" {
+		t.Fatalf("tool part = %+v", out.Contents[2].Parts[0])
+	}
+}
+
+func TestToolSignatureStoreEvictsOldest(t *testing.T) {
+	store := &toolSignatureStore{byID: map[string]string{}, limit: 2}
+	store.put("a", "sig-a")
+	store.put("b", "sig-b")
+	store.put("a", "sig-a2") // 更新已有的 id 不占新位置
+	store.put("c", "sig-c")
+	if got := store.get("a"); got != "" {
+		t.Fatalf("oldest id kept: %q", got)
+	}
+	if store.get("b") != "sig-b" || store.get("c") != "sig-c" {
+		t.Fatalf("store = %v", store.byID)
+	}
+	if len(store.order) != 2 {
+		t.Fatalf("order = %q", store.order)
+	}
+}
+
+func TestOpenAIToolCallSignatureLegacyID(t *testing.T) {
+	// 早期版本把签名编码进 id，客户端历史中的这类 id 仍然可以还原
+	if got := openAIToolCallSignature(toolCallIDWithSignature("call_old", "sig+/=")); got != "sig+/=" {
+		t.Fatalf("signature = %q", got)
+	}
+	if got := openAIToolCallSignature("call_unknown"); got != "" {
+		t.Fatalf("unknown id signature = %q", got)
+	}
+}
+
+func TestSplitToolCallSignature(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"call_abc", ""},
+		{toolCallIDWithSignature("call_abc", "sig+/="), "sig+/="},
+		{toolCallIDWithSignature("toolu_abc", ""), ""},
+		{"call_abc" + toolCallSignatureSep + "not base64!", ""},
+	}
+	for _, tt := range tests {
+		if got := splitToolCallSignature(tt.id); got != tt.want {
+			t.Errorf("splitToolCallSignature(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestConvertOpenAIChatRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     string
+		want    string // geminiRequest 的 JSON
+		wantErr string
+	}{
+		{
+			name: "system and merged user messages",
+			req:  `{"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"a"},{"role":"user","content":[{"type":"text","text":"b"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}]}`,
+			want: `{"contents":[{"role":"user","parts":[{"text":"a"},{"text":"b"},{"inlineData":{"mimeType":"image/png","data":"AAAA"}}]}],"systemInstruction":{"parts":[{"text":"be brief"}]},"generationConfig":{}}`,
+		},
+		{
+			name: "parallel tool results share one content",
+			req: `{"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":null,"tool_calls":[
+				{"id":"call_1","type":"function","function":{"name":"a","arguments":"{\"x\":1}"}},
+				{"id":"call_2","type":"function","function":{"name":"b","arguments":""}}]},
+				{"role":"tool","tool_call_id":"call_1","content":"{\"ok\":true}"},
+				{"role":"tool","tool_call_id":"call_2","content":"plain"}]}`,
+			want: `{"contents":[{"role":"user","parts":[{"text":"hi"}]},{"role":"model","parts":[{"functionCall":{"name":"a","args":{"x":1}}},{"functionCall":{"name":"b","args":{}}}]},{"role":"user","parts":[{"functionResponse":{"name":"a","response":{"ok":true}}},{"functionResponse":{"name":"b","response":{"content":"plain"}}}]}],"generationConfig":{}}`,
+		},
+		{
+			name: "tools, tool_choice and generation config",
+			req: `{"messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"f","parameters":{"type":"object"}}}],
+				"tool_choice":{"type":"function","function":{"name":"f"}},"max_tokens":10,"max_completion_tokens":20,"stop":"END",
+				"response_format":{"type":"json_schema","json_schema":{"name":"s","schema":{"type":"object"}}},"reasoning_effort":"none"}`,
+			want: `{"contents":[{"role":"user","parts":[{"text":"hi"}]}],"tools":[{"functionDeclarations":[{"name":"f","parameters":{"type":"object"}}]}],"toolConfig":{"functionCallingConfig":{"mode":"ANY","allowedFunctionNames":["f"]}},"generationConfig":{"maxOutputTokens":20,"stopSequences":["END"],"responseMimeType":"application/json","responseJsonSchema":{"type":"object"},"thinkingConfig":{"thinkingBudget":0}}}`,
+		},
+		{name: "unknown role", req: `{"messages":[{"role":"robot","content":"x"}]}`, wantErr: `messages[0]: unsupported role "robot"`},
+		{name: "unresolvable tool result", req: `{"messages":[{"role":"tool","tool_call_id":"nope","content":"x"}]}`, wantErr: "cannot resolve function name"},
+		{name: "bad tool arguments", req: `{"messages":[{"role":"assistant","tool_calls":[{"id":"c","function":{"name":"f","arguments":"{"}}]}]}`, wantErr: "invalid JSON in tool_calls arguments"},
+		{name: "bad content part", req: `{"messages":[{"role":"user","content":[{"type":"video"}]}]}`, wantErr: `unsupported content part type "video"`},
+		{name: "bad tool_choice", req: `{"messages":[],"tool_choice":"sometimes"}`, wantErr: `unsupported tool_choice "sometimes"`},
+		{name: "bad response_format", req: `{"messages":[],"response_format":{"type":"xml"}}`, wantErr: `unsupported response_format type "xml"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req openAIChatRequest
+			if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+				t.Fatal(err)
+			}
+			out, err := convertOpenAIChatRequest(&req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(out)
+			var gotV, wantV interface{}
+			json.Unmarshal(got, &gotV)
+			if err := json.Unmarshal([]byte(tt.want), &wantV); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotV, wantV) {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// openAIStreamChunks 解析 translatingWriter 写出的 SSE，返回各个 data 内容
+func openAIStreamChunks(t *testing.T, body string) []string {
+	t.Helper()
+	var d sseDecoder
+	var chunks []string
+	for _, e := range append(d.feed([]byte(body)), d.flush()...) {
+		chunks = append(chunks, string(e))
+	}
+	return chunks
+}
+
+func TestOpenAIChatTranslatorStream(t *testing.T) {
+	events := []string{
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"hmm","thought":true}]},"index":0}]}`,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"Hel"}]},"index":0}]}`,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"lo"},{"functionCall":{"id":"c1","name":"f","args":{"a":1}}}]},"finishReason":"STOP","index":0}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":2,"thoughtsTokenCount":1,"totalTokenCount":6}}`,
+	}
+	var upstream string
+	for _, e := range events {
+		upstream += "data: " + e + "\r\n\r\n"
+	}
+
+	rec := httptest.NewRecorder()
+	tw := newTranslatingWriter(rec, newOpenAIChatTranslator("gemini-2.5-pro", true), true)
+	tw.WriteHeader(200)
+	// 按任意位置切分，模拟浏览器转发的数据块
+	for i := 0; i < len(upstream); i += 13 {
+		tw.Write([]byte(upstream[i:min(i+13, len(upstream))]))
+	}
+	tw.finish()
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	chunks := openAIStreamChunks(t, rec.Body.String())
+	if len(chunks) == 0 || chunks[len(chunks)-1] != "[DONE]" {
+		t.Fatalf("stream should end with [DONE]: %q", chunks)
+	}
+
+	var content, reasoning string
+	var finish []string
+	var toolCalls []openAIToolCall
+	var usage *openAIUsage
+	for _, c := range chunks[:len(chunks)-1] {
+		var resp openAIChatResponse
+		if err := json.Unmarshal([]byte(c), &resp); err != nil {
+			t.Fatalf("chunk %q: %v", c, err)
+		}
+		if resp.Object != "chat.completion.chunk" || resp.Model != "gemini-2.5-pro" {
+			t.Fatalf("chunk = %s", c)
+		}
+		if resp.Usage != nil {
+			usage = resp.Usage
+		}
+		for _, ch := range resp.Choices {
+			if ch.Delta.Content != nil {
+				content += *ch.Delta.Content
+			}
+			reasoning += ch.Delta.ReasoningContent
+			toolCalls = append(toolCalls, ch.Delta.ToolCalls...)
+			if ch.FinishReason != nil {
+				finish = append(finish, *ch.FinishReason)
+			}
+		}
+	}
+	if content != "Hello" || reasoning != "hmm" {
+		t.Fatalf("content = %q, reasoning = %q", content, reasoning)
+	}
+	if len(toolCalls) != 1 || toolCalls[0].ID != "c1" || *toolCalls[0].Index != 0 || toolCalls[0].Function.Arguments != `{"a":1}` {
+		t.Fatalf("tool_calls = %+v", toolCalls)
+	}
+	if !reflect.DeepEqual(finish, []string{"tool_calls"}) {
+		t.Fatalf("finish_reason = %q", finish)
+	}
+	if usage == nil || usage.PromptTokens != 3 || usage.CompletionTokens != 3 || usage.CompletionTokensDetails.ReasoningTokens != 1 {
+		t.Fatalf("usage = %+v", usage)
+	}
+}
+
+func TestOpenAIChatTranslatorComplete(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		finish string
+		text   *string
+	}{
+		{"text", `{"candidates":[{"content":{"parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`, "stop", strPtr("hi")},
+		{"max tokens", `{"candidates":[{"content":{"parts":[{"text":"hi"}]},"finishReason":"MAX_TOKENS"}]}`, "length", strPtr("hi")},
+		{"safety", `{"candidates":[{"content":{"parts":[]},"finishReason":"SAFETY"}]}`, "content_filter", strPtr("")},
+		{"tool call only has no content", `{"candidates":[{"content":{"parts":[{"functionCall":{"name":"f","args":{}}}]},"finishReason":"STOP"}]}`, "tool_calls", nil},
+		{"blocked prompt", `{"promptFeedback":{"blockReason":"SAFETY"}}`, "content_filter", strPtr("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			newOpenAIChatTranslator("m", false).complete(rec, []byte(tt.body))
+			var resp openAIChatResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Choices) != 1 {
+				t.Fatalf("choices = %s", rec.Body)
+			}
+			ch := resp.Choices[0]
+			if *ch.FinishReason != tt.finish || !reflect.DeepEqual(ch.Message.Content, tt.text) {
+				t.Fatalf("finish_reason = %q, content = %v", *ch.FinishReason, ch.Message.Content)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string { return &s }
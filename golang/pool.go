@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -11,10 +13,121 @@ import (
 
 // UserConnection 存储单个WebSocket连接及其元数据
 type UserConnection struct {
-	Conn       *websocket.Conn
-	UserID     string
-	LastActive time.Time
-	writeMutex sync.Mutex // 保护对此单个连接的并发写入
+	ID          string // 连接ID，用于管理接口（见 admin.go）
+	Conn        *websocket.Conn
+	UserID      string
+	ConnectedAt time.Time
+	Weight      int        // weighted 负载均衡的权重，来自连接URL的 weight 参数，默认 1
+	Client      ClientInfo // 握手时客户端声明的版本和功能，见 handshake.go
+	writeMutex  sync.Mutex // 保护对此单个连接的并发写入
+
+	lastActive    atomic.Int64 // 最近一次收到消息或 pong 的时间（UnixNano），见 reaper.go
+	totalRequests atomic.Int64 // 发往此连接的请求总数
+	draining      atomic.Bool  // 为 true 时不再分配新请求，正在处理的请求不受影响
+	currentWeight int          // weighted 负载均衡的当前权重，受 UserConnections 锁保护
+
+	// requests 记录已发往此连接、尚未结束的请求（WS消息ID -> 发送时间），
+	// 连接断开时据此通知等待中的请求（见 failInFlightRequests）
+	requestsMu sync.Mutex
+	requests   map[string]time.Time
+	cancelled  map[string]time.Time // 已发送 cancel 的请求，其后迟到的消息不再告警
+	closed     bool
+
+	lastError   string // 最近一次请求失败的原因，受 requestsMu 保护
+	lastErrorAt time.Time
+}
+
+// touch 记录连接仍然活跃
+func (uc *UserConnection) touch() {
+	uc.lastActive.Store(time.Now().UnixNano())
+}
+
+// LastActive 返回最近一次收到消息或 pong 的时间
+func (uc *UserConnection) LastActive() time.Time {
+	return time.Unix(0, uc.lastActive.Load())
+}
+
+// InFlight 返回此连接上正在处理的请求数，用于 least_in_flight 负载均衡
+func (uc *UserConnection) InFlight() int {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	return len(uc.requests)
+}
+
+// beginRequest 记录请求发往此连接；连接已断开时返回 false
+func (uc *UserConnection) beginRequest(id string) bool {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	if uc.closed {
+		return false
+	}
+	if uc.requests == nil {
+		uc.requests = make(map[string]time.Time)
+	}
+	uc.requests[id] = time.Now()
+	uc.totalRequests.Add(1)
+	return true
+}
+
+// endRequest 在请求结束时调用
+func (uc *UserConnection) endRequest(id string) {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	delete(uc.requests, id)
+}
+
+// recordError 记录此连接上最近一次请求失败的原因
+func (uc *UserConnection) recordError(msg string) {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	uc.lastError = msg
+	uc.lastErrorAt = time.Now()
+}
+
+// LastError 返回最近一次请求失败的原因和时间
+func (uc *UserConnection) LastError() (string, time.Time) {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	return uc.lastError, uc.lastErrorAt
+}
+
+// cancelledRequestTTL 发送 cancel 后继续忽略该请求迟到消息的时长
+const cancelledRequestTTL = time.Minute
+
+// markCancelled 记录已向浏览器发送 cancel 的请求
+func (uc *UserConnection) markCancelled(id string) {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	now := time.Now()
+	if uc.cancelled == nil {
+		uc.cancelled = make(map[string]time.Time)
+	}
+	for cid, at := range uc.cancelled {
+		if now.Sub(at) > cancelledRequestTTL {
+			delete(uc.cancelled, cid)
+		}
+	}
+	uc.cancelled[id] = now
+}
+
+// wasCancelled 判断请求是否刚被取消，用于忽略浏览器中止前已发出的消息
+func (uc *UserConnection) wasCancelled(id string) bool {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	at, ok := uc.cancelled[id]
+	return ok && time.Since(at) <= cancelledRequestTTL
+}
+
+// markClosed 标记连接已断开，返回此时仍在处理的请求ID
+func (uc *UserConnection) markClosed() []string {
+	uc.requestsMu.Lock()
+	defer uc.requestsMu.Unlock()
+	uc.closed = true
+	ids := make([]string, 0, len(uc.requests))
+	for id := range uc.requests {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
 // safeWriteJSON 线程安全地向单个WebSocket连接写入JSON
@@ -28,7 +141,7 @@ func (uc *UserConnection) safeWriteJSON(v interface{}) error {
 type UserConnections struct {
 	sync.Mutex
 	Connections []*UserConnection
-	NextIndex   int // 用于轮询 (round-robin)
+	NextIndex   int // 用于轮询 (round-robin)，见 balancer.go
 }
 
 // ConnectionPool 全局连接池，并发安全
@@ -37,13 +150,23 @@ type ConnectionPool struct {
 	Users map[string]*UserConnections
 }
 
+// connectionSeq 用于生成连接ID
+var connectionSeq atomic.Int64
+
 // AddConnection 将新连接添加到池中
-func (p *ConnectionPool) AddConnection(userID string, conn *websocket.Conn) *UserConnection {
+func (p *ConnectionPool) AddConnection(userID string, conn *websocket.Conn, weight int, client ClientInfo) *UserConnection {
+	if weight < 1 {
+		weight = 1
+	}
 	userConn := &UserConnection{
-		Conn:       conn,
-		UserID:     userID,
-		LastActive: time.Now(),
+		ID:          fmt.Sprintf("c%d", connectionSeq.Add(1)),
+		Conn:        conn,
+		UserID:      userID,
+		ConnectedAt: time.Now(),
+		Weight:      weight,
+		Client:      client,
 	}
+	userConn.touch()
 
 	p.Lock()
 	defer p.Unlock()
@@ -61,7 +184,7 @@ func (p *ConnectionPool) AddConnection(userID string, conn *websocket.Conn) *Use
 	userConns.Connections = append(userConns.Connections, userConn)
 	userConns.Unlock()
 
-	log.Printf("WebSocket connected: UserID=%s, Total connections for user: %d", userID, len(userConns.Connections))
+	log.Printf("WebSocket connected: UserID=%s, ConnID=%s, Total connections for user: %d", userID, userConn.ID, len(userConns.Connections))
 	return userConn
 }
 
@@ -95,8 +218,33 @@ func (p *ConnectionPool) RemoveConnection(userID string, conn *websocket.Conn) {
 	}
 }
 
-// GetConnection 使用轮询策略为用户选择一个连接
-func (p *ConnectionPool) GetConnection(userID string) (*UserConnection, error) {
+// allConnections 返回池中所有连接的快照
+func (p *ConnectionPool) allConnections() []*UserConnection {
+	p.RLock()
+	defer p.RUnlock()
+
+	var conns []*UserConnection
+	for _, userConns := range p.Users {
+		userConns.Lock()
+		conns = append(conns, userConns.Connections...)
+		userConns.Unlock()
+	}
+	return conns
+}
+
+// findConnection 按连接ID查找
+func (p *ConnectionPool) findConnection(id string) *UserConnection {
+	for _, uc := range p.allConnections() {
+		if uc.ID == id {
+			return uc
+		}
+	}
+	return nil
+}
+
+// GetConnection 使用该用户配置的负载均衡策略（见 balancer.go）选择一个连接
+// 标记为 draining 的连接和 exclude 中的连接（本请求已尝试过的连接）不参与选择，没有其他连接时返回错误
+func (p *ConnectionPool) GetConnection(userID string, exclude ...*UserConnection) (*UserConnection, error) {
 	p.RLock()
 	userConns, exists := p.Users[userID]
 	p.RUnlock()
@@ -114,10 +262,35 @@ func (p *ConnectionPool) GetConnection(userID string) (*UserConnection, error) {
 		return nil, errors.New("no available client for this user")
 	}
 
-	// 轮询负载均衡
-	idx := userConns.NextIndex % numConns
-	selectedConn := userConns.Connections[idx]
-	userConns.NextIndex = (userConns.NextIndex + 1) % numConns // 更新索引
+	accepting := make([]*UserConnection, 0, numConns)
+	for _, uc := range userConns.Connections {
+		if !uc.draining.Load() {
+			accepting = append(accepting, uc)
+		}
+	}
+	if len(accepting) == 0 {
+		return nil, errors.New("no available client for this user (all connections are draining)")
+	}
 
-	return selectedConn, nil
+	candidates := make([]*UserConnection, 0, len(accepting))
+	for _, uc := range accepting {
+		if !containsConnection(exclude, uc) {
+			candidates = append(candidates, uc)
+		}
+	}
+	if len(candidates) == 0 {
+		// 重试不回到已经失败过的连接
+		return nil, errors.New("no untried client for this user")
+	}
+
+	return balancerFor(userID).Pick(userConns, candidates), nil
+}
+
+func containsConnection(conns []*UserConnection, uc *UserConnection) bool {
+	for _, c := range conns {
+		if c == uc {
+			return true
+		}
+	}
+	return false
 }
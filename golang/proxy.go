@@ -2,45 +2,48 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
 
-const (
-	proxyRequestTimeout = 600 * time.Second
-)
+// 上游地址、请求超时和重试次数/退避时间见配置文件的 upstream 和 timeouts 部分（config.go）
+
+// upstreamRequest 描述一次需要经由浏览器隧道发往 Gemini 的请求
+type upstreamRequest struct {
+	ID     string
+	UserID string
+	// KeyLabel 发起请求的 API Key 的标签，仅用于日志
+	KeyLabel string
+	Route    string // 客户端请求的路径，用于转换器规则匹配和日志
+	Model    string
+	Method   string
+	Path     string // 相对于 upstream.base_url 的路径（含查询参数）
+	Headers  map[string][]string
+	Body     []byte
+}
+
+// transformContext 返回转换器规则匹配所需的请求信息
+func (req *upstreamRequest) transformContext() *TransformContext {
+	return &TransformContext{RequestID: req.ID, UserID: req.UserID, Route: req.Route, Model: req.Model}
+}
 
 func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
-	// 1. 认证并获取UserID (这里模拟)
-	userID, err := authenticateHTTPRequest(r)
+	// 1. 认证并获取API Key对应的用户
+	apiKey, err := authenticateHTTPRequest(r)
 	if err != nil {
 		http.Error(w, "Proxy authentication failed", http.StatusUnauthorized)
 		return
 	}
 
-	// 2. 生成唯一请求ID
-	reqID := uuid.NewString()
-
-	// 3. 创建响应通道并注册
-	// 使用带缓冲的通道以适应流式响应块
-	respChan := make(chan *WSMessage, 10)
-	pendingRequests.Store(reqID, respChan)
-	defer pendingRequests.Delete(reqID) // 确保请求结束后清理
-
-	// 4. 选择一个WebSocket连接
-	selectedConn, err := globalPool.GetConnection(userID)
-	if err != nil {
-		log.Printf("Error getting connection for user %s: %v", userID, err)
-		http.Error(w, "Service Unavailable: No active client connected", http.StatusServiceUnavailable)
-		return
-	}
-
-	// 5. 封装HTTP请求为WS消息
+	// 2. 读取请求体
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
@@ -48,68 +51,284 @@ func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Fix tool definitions format for Gemini API compatibility
-	// Roo/Cline sends "parametersJsonSchema" but Gemini expects "parameters"
-	bodyBytes = fixToolDefinitions(bodyBytes)
+	req := &upstreamRequest{
+		ID:       uuid.NewString(),
+		UserID:   apiKey.UserID,
+		KeyLabel: apiKey.Label,
+		Route:    r.URL.Path,
+		Model:    modelFromPath(r.URL.Path),
+		Method:   r.Method,
+		Path:     r.URL.String(),
+		Headers:  forwardableHeaders(r.Header),
+	}
+
+	// 3. 应用请求转换器（修复 Roo/Cline 等客户端的格式问题，见 transformer_registry.go）
+	req.Body = applyRequestTransformers(r.Context(), req.transformContext(), bodyBytes)
 
-	// Fix systemInstruction role field (should not have role: "user")
-	bodyBytes = fixSystemInstruction(bodyBytes)
+	// 4. 通过浏览器隧道转发
+	dispatchUpstream(w, r, req)
+}
 
+// forwardableHeaders 过滤掉HTTP/1.1特有的或代理不应转发的头
+func forwardableHeaders(src http.Header) map[string][]string {
 	// 注意：将Header直接序列化为JSON可能需要一些处理，这里简化处理
 	// 对于生产环境，可能需要更精细的Header转换
 	headers := make(map[string][]string)
-	for k, v := range r.Header {
-		// 过滤掉一些HTTP/1.1特有的或代理不应转发的头
+	for k, v := range src {
 		if k != "Connection" && k != "Keep-Alive" && k != "Proxy-Authenticate" && k != "Proxy-Authorization" && k != "Te" && k != "Trailers" && k != "Transfer-Encoding" && k != "Upgrade" {
 			headers[k] = v
 		}
 	}
+	return headers
+}
 
-	requestPayload := WSMessage{
-		ID:   reqID,
-		Type: "http_request",
-		Payload: map[string]interface{}{
-			"method": r.Method,
-			// 假设前端知道如何处理这个相对URL，或者您在这里构建完整的外部URL
-			"url":     "https://generativelanguage.googleapis.com" + r.URL.String(),
-			"headers": headers,
-			"body":    string(bodyBytes), // 对于二进制数据，应使用base64编码
-		},
+// dispatchUpstream 选择用户的浏览器连接，发送 http_request 消息并把响应写回 w。
+// 原生 Gemini 代理和各兼容层（OpenAI 等）共用这条路径。
+// 在响应头写出之前，发送失败或浏览器返回 error 时会换用该用户的下一个连接重试。
+func dispatchUpstream(w http.ResponseWriter, r *http.Request, req *upstreamRequest) {
+	reqID := req.ID
+	statsFromRequest(r).setModel(req.Model)
+	root := spanFromContext(r.Context())
+	root.setAttr("proxy.request_id", reqID)
+	root.setAttr("proxy.user_id", req.UserID)
+	root.setAttr("proxy.model", req.Model)
+
+	// 封装HTTP请求为WS消息，二进制请求体（如文件上传）使用base64编码
+	body, encoding := encodeBody(req.Body)
+	requestPayload := map[string]interface{}{
+		"method":   req.Method,
+		"url":      currentConfig().Upstream.BaseURL + req.Path,
+		"headers":  req.Headers,
+		"body":     body,
+		"encoding": encoding,
 	}
 
 	// Concise stdout logging, full details in web UI
-	log.Printf("[REQUEST %s] %s %s (%d bytes)", reqID, r.Method, r.URL.String(), len(bodyBytes))
-	addLog("INFO", fmt.Sprintf("[REQUEST %s] %s %s", reqID, r.Method, r.URL.String()), map[string]interface{}{
+	log.Printf("[REQUEST %s] %s %s (%d bytes)", reqID, req.Method, req.Path, len(req.Body))
+	addLog("INFO", fmt.Sprintf("[REQUEST %s] %s %s", reqID, req.Method, req.Path), map[string]interface{}{
 		"request_id": reqID,
-		"method":     r.Method,
-		"url":        r.URL.String(),
-		"headers":    headers,
-		"body":       string(bodyBytes),
+		"user_id":    req.UserID,
+		"key_label":  req.KeyLabel,
+		"method":     req.Method,
+		"url":        req.Path,
+		"headers":    req.Headers,
+		"body":       logBody(req.Body),
 	})
 
-	// 6. 发送请求到WebSocket客户端
-	if err := selectedConn.safeWriteJSON(requestPayload); err != nil {
+	maxAttempts := currentConfig().Upstream.MaxAttempts
+	var tried []*UserConnection
+	var failure string // 上一次尝试的失败原因
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 && !waitRetryBackoff(r.Context(), attempt) {
+			log.Printf("[REQUEST %s] Client went away before attempt %d", reqID, attempt)
+			return
+		}
+
+		// 选择一个本请求尚未尝试过的WebSocket连接
+		_, selectSpan := startSpan(r.Context(), "select_connection")
+		selectSpan.setAttr("proxy.attempt", attempt)
+		selectedConn, err := globalPool.GetConnection(req.UserID, tried...)
+		if err != nil {
+			selectSpan.setError(err.Error())
+			selectSpan.end()
+			log.Printf("Error getting connection for user %s: %v", req.UserID, err)
+			addLog("WARN", fmt.Sprintf("[REQUEST %s] No browser connection for user %s", reqID, req.UserID), map[string]interface{}{
+				"request_id": reqID,
+				"user_id":    req.UserID,
+				"key_label":  req.KeyLabel,
+				"attempt":    attempt,
+				"error":      err.Error(),
+			})
+			if attempt > 1 {
+				// 没有其他连接可以重试，返回上一次尝试的失败原因
+				http.Error(w, "Bad Gateway: "+failure, http.StatusBadGateway)
+				return
+			}
+			http.Error(w, "Service Unavailable: No active client connected", http.StatusServiceUnavailable)
+			return
+		}
+		selectSpan.setAttr("proxy.connection_id", selectedConn.ID)
+		selectSpan.end()
+		tried = append(tried, selectedConn)
+
+		failure = sendUpstreamAttempt(w, r, req, selectedConn, requestPayload, attempt, maxAttempts)
+		if failure == "" {
+			return
+		}
+		if attempt < maxAttempts {
+			logMsg := fmt.Sprintf("[REQUEST %s] Attempt %d/%d failed: %s; retrying in %s", reqID, attempt, maxAttempts, failure, retryBackoff(attempt+1))
+			log.Println(logMsg)
+			addLog("WARN", logMsg, map[string]interface{}{
+				"request_id": reqID,
+				"user_id":    req.UserID,
+				"attempt":    attempt,
+				"connection": selectedConn.Conn.RemoteAddr().String(),
+				"error":      failure,
+			})
+		}
+	}
+}
+
+// sendUpstreamAttempt 通过指定连接发送一次请求并处理响应。
+// 返回空字符串表示响应（成功或最终错误）已写出；否则返回失败原因，此时 w 尚未写入任何内容，可以重试。
+func sendUpstreamAttempt(w http.ResponseWriter, r *http.Request, req *upstreamRequest, conn *UserConnection, payload map[string]interface{}, attempt, maxAttempts int) (failure string) {
+	reqID := req.ID
+	canRetry := attempt < maxAttempts
+
+	// 每次尝试使用独立的消息ID，避免失败连接上迟到的响应混入本次尝试
+	wsID := reqID
+	if attempt > 1 {
+		wsID = fmt.Sprintf("%s.%d", reqID, attempt)
+	}
+
+	_, span := startSpan(r.Context(), "ws_dispatch")
+	span.setAttr("proxy.attempt", attempt)
+	span.setAttr("proxy.ws_id", wsID)
+	span.setAttr("proxy.connection_id", conn.ID)
+	defer func() {
+		if failure != "" {
+			span.setError(failure)
+		}
+		span.end()
+	}()
+
+	// 创建响应通道并注册（容量见 flowcontrol.go）
+	window := flowControlWindow(conn)
+	pending := newPendingRequest(window)
+	pendingRequests.Store(wsID, pending)
+	defer func() {
+		// 确保请求结束后清理
+		pendingRequests.Delete(wsID)
+		pending.finish()
+	}()
+
+	// 记录请求所在的连接，连接断开时 readPump 会向通道发送 CONNECTION_LOST 错误
+	if !conn.beginRequest(wsID) {
+		if canRetry {
+			return "browser connection already closed"
+		}
+		http.Error(w, "Bad Gateway: Browser connection closed", http.StatusBadGateway)
+		return ""
+	}
+	defer conn.endRequest(wsID)
+
+	// 流控只对声明支持的客户端启用（见 flowcontrol.go）；
+	// traceparent 让浏览器把自己的 span 接入本次请求的追踪（见 tracing.go）
+	if window > 0 || span != nil {
+		extended := make(map[string]interface{}, len(payload)+2)
+		for k, v := range payload {
+			extended[k] = v
+		}
+		if window > 0 {
+			extended["flow_control"] = map[string]interface{}{"window": window}
+		}
+		if span != nil {
+			extended["traceparent"] = span.traceparent()
+		}
+		payload = extended
+	}
+
+	// 发送请求到WebSocket客户端
+	if err := conn.safeWriteJSON(WSMessage{ID: wsID, Type: "http_request", Payload: payload}); err != nil {
 		errMsg := fmt.Sprintf("[ERROR %s] Failed to send request over WebSocket: %v", reqID, err)
 		log.Println(errMsg)
+		conn.recordError("send request: " + err.Error())
 		addLog("ERROR", errMsg, map[string]interface{}{
 			"request_id": reqID,
+			"user_id":    req.UserID,
+			"attempt":    attempt,
+			"connection": conn.Conn.RemoteAddr().String(),
 			"error":      err.Error(),
 		})
+		if canRetry {
+			return "failed to send request over WebSocket: " + err.Error()
+		}
 		http.Error(w, "Bad Gateway: Failed to send request to client", http.StatusBadGateway)
-		return
+		return ""
 	}
-	successMsg := fmt.Sprintf("[REQUEST %s] Sent to WebSocket client", reqID)
+	successMsg := fmt.Sprintf("[REQUEST %s] Sent to WebSocket client (attempt %d/%d)", reqID, attempt, maxAttempts)
 	log.Println(successMsg)
-	addLog("INFO", successMsg, map[string]interface{}{"request_id": reqID})
+	addLog("INFO", successMsg, map[string]interface{}{
+		"request_id": reqID,
+		"user_id":    req.UserID,
+		"attempt":    attempt,
+		"connection": conn.Conn.RemoteAddr().String(),
+	})
+
+	// 异步等待并处理响应
+	return processWebSocketResponse(w, r, req, &upstreamAttempt{conn: conn, req: req, wsID: wsID, pending: pending, window: window, span: span}, canRetry)
+}
+
+// upstreamAttempt 是一次发往某个浏览器连接的请求，processWebSocketResponse 通过它向浏览器回送控制消息
+type upstreamAttempt struct {
+	conn    *UserConnection
+	req     *upstreamRequest
+	wsID    string
+	pending *pendingRequest
 
-	// 7. 异步等待并处理响应
-	processWebSocketResponse(w, r, respChan)
+	window  int // 流控额度，0 表示浏览器不使用 credit，见 flowcontrol.go
+	unacked int // 已写出但尚未补充额度的数据块数
+
+	span *traceSpan // 本次尝试的 ws_dispatch span，未启用追踪时为 nil
 }
 
-// processWebSocketResponse 处理来自WS通道的响应，构建HTTP响应
-func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan chan *WSMessage) {
+// cancel 向浏览器发送 cancel 消息，浏览器应中止对应的 fetch 并不再发送该ID的消息
+func (a *upstreamAttempt) cancel(reason string) {
+	conn, req, wsID := a.conn, a.req, a.wsID
+	conn.markCancelled(wsID)
+	a.span.setAttr("proxy.cancelled", reason)
+	logMsg := fmt.Sprintf("[CANCEL %s] Request cancelled (%s), notifying browser", req.ID, reason)
+	log.Println(logMsg)
+	addLog("INFO", logMsg, map[string]interface{}{
+		"request_id": req.ID,
+		"user_id":    req.UserID,
+		"ws_id":      wsID,
+		"reason":     reason,
+		"connection": conn.Conn.RemoteAddr().String(),
+	})
+	if !conn.Client.HasFeature(featureCancel) {
+		return
+	}
+	err := conn.safeWriteJSON(WSMessage{ID: wsID, Type: "cancel", Payload: map[string]interface{}{"reason": reason}})
+	if err != nil {
+		log.Printf("[CANCEL %s] Failed to send cancel over WebSocket: %v", req.ID, err)
+	}
+}
+
+// retryBackoff 返回第 attempt 次尝试前的等待时间（指数退避）
+func retryBackoff(attempt int) time.Duration {
+	upstream := currentConfig().Upstream
+	d, upstreamRetryBackoffMax := upstream.RetryBackoff, upstream.RetryBackoffMax
+	for i := 2; i < attempt && d < upstreamRetryBackoffMax; i++ {
+		d *= 2
+	}
+	if d > upstreamRetryBackoffMax {
+		d = upstreamRetryBackoffMax
+	}
+	return d
+}
+
+// waitRetryBackoff 等待退避时间，客户端断开时返回 false
+func waitRetryBackoff(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(retryBackoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// processWebSocketResponse 处理来自WS通道的响应，构建HTTP响应。
+// canRetry 为 true 时，响应头写出前收到的 error 不会写给客户端，而是作为失败原因返回，由调用方换连接重试。
+// 客户端断开或超时导致请求提前结束时通过 attempt.cancel 通知浏览器停止该请求。
+func processWebSocketResponse(w http.ResponseWriter, r *http.Request, req *upstreamRequest, attempt *upstreamAttempt, canRetry bool) string {
+	respChan := attempt.pending.ch
+
 	// 设置超时
-	ctx, cancel := context.WithTimeout(r.Context(), proxyRequestTimeout)
+	requestTimeout := currentConfig().Timeouts.Request
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
 	defer cancel()
 
 	// 获取Flusher以支持流式响应
@@ -122,6 +341,23 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 	var errorBodyChunks []string
 	var errorStatusCode int
 	var errorRequestID string
+	// 响应体在写出前经过响应转换器（见 transformers.go）
+	var bodyTransformer *responseTransformerStream
+	// 流式响应的指标（见 metrics.go）和 span（见 tracing.go），流结束、被中止或超时时记录
+	stats := statsFromRequest(r)
+	var streamStarted time.Time
+	var streamSpan *traceSpan
+	streamChunks := 0
+	firstChunkSpan := attempt.span.child("first_chunk")
+	defer func() {
+		firstChunkSpan.setError("no response from browser")
+		firstChunkSpan.end()
+		if !streamStarted.IsZero() {
+			stats.observeStream(streamStarted, streamChunks)
+			streamSpan.setAttr("proxy.stream_chunks", streamChunks)
+			streamSpan.end()
+		}
+	}()
 
 	for {
 		select {
@@ -130,8 +366,15 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 				// 通道被关闭，理论上不应该发生，除非有panic
 				if !headersSet {
 					http.Error(w, "Internal Server Error: Response channel closed unexpectedly", http.StatusInternalServerError)
+				} else {
+					abortStream(w, http.StatusInternalServerError, "Response channel closed unexpectedly")
 				}
-				return
+				return ""
+			}
+			if firstChunkSpan != nil {
+				firstChunkSpan.setAttr("proxy.message_type", msg.Type)
+				firstChunkSpan.end()
+				firstChunkSpan = nil
 			}
 
 			switch msg.Type {
@@ -139,7 +382,7 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 				// 标准单个响应
 				if headersSet {
 					log.Println("Received http_response after headers were already set. Ignoring.")
-					return
+					return ""
 				}
 
 				// Extract request ID from context if available
@@ -155,24 +398,30 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 					statusCode = int(status)
 				}
 
-				bodyLen := 0
-				if body, ok := msg.Payload["body"].(string); ok {
-					bodyLen = len(body)
-				}
+				body := payloadBody(msg.Payload)
 
 				// Concise stdout logging, full details in web UI
-				log.Printf("[RESPONSE %s] Status: %d (%d bytes)", reqID, statusCode, bodyLen)
+				log.Printf("[RESPONSE %s] Status: %d (%d bytes)", reqID, statusCode, len(body))
 				addLog("INFO", fmt.Sprintf("[RESPONSE %s] Status: %d", reqID, statusCode), map[string]interface{}{
 					"request_id": reqID,
+					"user_id":    req.UserID,
 					"status":     statusCode,
 					"headers":    msg.Payload["headers"],
-					"body":       msg.Payload["body"],
+					"body":       logBody(body),
 				})
 
+				attempt.span.recordBrowserTiming(msg.Payload)
+				attempt.span.setAttr("http.response.status_code", statusCode)
+				rt := newResponseTransformerStream(req.transformContext(), msg.Payload, false)
 				setResponseHeaders(w, msg.Payload)
+				if rt.transforms() {
+					// 转换后的长度可能不同，由 net/http 重新计算
+					w.Header().Del("Content-Length")
+				}
 				writeStatusCode(w, msg.Payload)
-				writeBody(w, msg.Payload)
-				return // 请求结束
+				body = rt.write(body)
+				writeBody(w, append(body, rt.flush()...))
+				return "" // 请求结束
 
 			case "stream_start":
 				// 流开始
@@ -202,14 +451,24 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 					errorBodyChunks = []string{}
 					addLog("WARN", fmt.Sprintf("[STREAM ERROR %s] Status: %d - Waiting for error body in chunks", reqID, statusCode), map[string]interface{}{
 						"request_id": reqID,
+						"user_id":    req.UserID,
 						"status":     statusCode,
 						"headers":    msg.Payload["headers"],
 					})
 				}
 
+				bodyTransformer = newResponseTransformerStream(req.transformContext(), msg.Payload, true)
 				setResponseHeaders(w, msg.Payload)
+				if bodyTransformer.transforms() {
+					// 转换后的长度可能不同，改用分块传输
+					w.Header().Del("Content-Length")
+				}
 				writeStatusCode(w, msg.Payload)
 				headersSet = true
+				streamStarted = time.Now()
+				streamSpan = attempt.span.child("stream")
+				attempt.span.recordBrowserTiming(msg.Payload)
+				attempt.span.setAttr("http.response.status_code", statusCode)
 				if flusher != nil {
 					flusher.Flush()
 				}
@@ -220,25 +479,39 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 					log.Println("Warning: Received stream_chunk before stream_start. Using default 200 OK.")
 					w.WriteHeader(http.StatusOK)
 					headersSet = true
+					streamStarted = time.Now()
+					streamSpan = attempt.span.child("stream")
 				}
+				streamChunks++
+				if bodyTransformer == nil {
+					bodyTransformer = newResponseTransformerStream(req.transformContext(), nil, true)
+				}
+
+				chunk := payloadBody(msg.Payload)
 
 				// If this is an error response, accumulate chunks for logging
 				if errorStatusCode >= 400 {
-					if data, ok := msg.Payload["data"].(string); ok {
-						errorBodyChunks = append(errorBodyChunks, data)
-					}
+					errorBodyChunks = append(errorBodyChunks, string(chunk))
 				}
 
-				writeBody(w, msg.Payload)
+				writeBody(w, bodyTransformer.write(chunk))
 				if flusher != nil {
 					flusher.Flush()
 				}
+				// 数据已交给 HTTP 客户端，允许浏览器继续发送
+				attempt.chunkConsumed()
 
 			case "stream_end":
 				// 流结束
 				if !headersSet {
 					w.WriteHeader(http.StatusOK)
 				}
+				if bodyTransformer != nil {
+					writeBody(w, bodyTransformer.flush())
+					if flusher != nil {
+						flusher.Flush()
+					}
+				}
 
 				// If this was an error response, log the complete error body
 				if errorStatusCode >= 400 && len(errorBodyChunks) > 0 {
@@ -247,15 +520,16 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 						fullErrorBody += chunk
 					}
 					addLog("ERROR", fmt.Sprintf("[STREAM ERROR %s] Complete error response from Gemini API", errorRequestID), map[string]interface{}{
-						"request_id":  errorRequestID,
-						"status":      errorStatusCode,
-						"error_body":  fullErrorBody,
+						"request_id": errorRequestID,
+						"user_id":    req.UserID,
+						"status":     errorStatusCode,
+						"error_body": fullErrorBody,
 					})
 					log.Printf("[STREAM ERROR] %s - Status %d - Body: %s", errorRequestID, errorStatusCode, fullErrorBody)
 				}
 
 				log.Println("[STREAM] Completed")
-				return
+				return ""
 
 			case "error":
 				// 前端返回错误
@@ -271,6 +545,9 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 					errMsg := "Bad Gateway: Client reported an error"
 					if payloadErr, ok := msg.Payload["error"].(string); ok {
 						errMsg = payloadErr
+					} else if payloadErr, ok := msg.Payload["message"].(string); ok {
+						// 浏览器端的 fetch 错误使用 message 字段
+						errMsg = payloadErr
 					}
 					statusCode := http.StatusBadGateway
 					if code, ok := msg.Payload["status"].(float64); ok {
@@ -279,8 +556,11 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 
 					// Concise stdout logging, full details in web UI
 					log.Printf("[ERROR %s] Status: %d - %s", reqID, statusCode, errMsg)
+					attempt.conn.recordError(errMsg)
+					attempt.span.setError(errMsg)
 					addLog("ERROR", fmt.Sprintf("[ERROR %s] Status: %d", reqID, statusCode), map[string]interface{}{
 						"request_id": reqID,
+						"user_id":    req.UserID,
 						"status":     statusCode,
 						"error":      errMsg,
 						"headers":    msg.Payload["headers"],
@@ -289,27 +569,92 @@ func processWebSocketResponse(w http.ResponseWriter, r *http.Request, respChan c
 						"method":     msg.Payload["method"],
 						"payload":    msg.Payload,
 					})
+					if canRetry {
+						return fmt.Sprintf("client reported an error: %s", errMsg)
+					}
 					http.Error(w, errMsg, statusCode)
 				} else {
-					// 如果已经开始发送流，我们只能记录错误并关闭连接
+					// 如果已经开始发送流，我们只能记录错误并结束响应（先写出转换器中缓冲的数据）
 					log.Printf("[ERROR] Error received from client after stream started: %v", msg.Payload)
+					streamSpan.setError(fmt.Sprintf("stream aborted: %v", msg.Payload["error"]))
+					attempt.conn.recordError(fmt.Sprintf("stream aborted: %v", msg.Payload["error"]))
+					addLog("ERROR", fmt.Sprintf("[STREAM ERROR %s] Stream aborted: %v", msg.ID, msg.Payload["error"]), map[string]interface{}{
+						"request_id": msg.ID,
+						"user_id":    req.UserID,
+						"payload":    msg.Payload,
+					})
+					if bodyTransformer != nil {
+						writeBody(w, bodyTransformer.flush())
+					}
+					errMsg := "Bad Gateway: Stream aborted by the browser"
+					if payloadErr, ok := msg.Payload["error"].(string); ok {
+						errMsg = payloadErr
+					} else if payloadErr, ok := msg.Payload["message"].(string); ok {
+						errMsg = payloadErr
+					}
+					abortStream(w, http.StatusBadGateway, errMsg)
 				}
-				return // 请求结束
+				return "" // 请求结束
 
 			default:
 				log.Printf("[UNKNOWN] Received unexpected message type %s while waiting for response", msg.Type)
 			}
 
+		case <-attempt.pending.overflowed:
+			// HTTP 客户端读取太慢，溢出队列超出上限（浏览器不支持流控）或浏览器不遵守额度，
+			// 已有消息被丢弃（见 flowcontrol.go）
+			errMsg := "Bad Gateway: response buffer overflowed because the client is reading too slowly"
+			logMsg := fmt.Sprintf("[FLOW %s] Response buffer overflowed, failing the request", req.ID)
+			log.Println(logMsg)
+			addLog("WARN", logMsg, map[string]interface{}{
+				"request_id":     req.ID,
+				"user_id":        req.UserID,
+				"buffer":         cap(attempt.pending.ch),
+				"flow_control":   attempt.window > 0,
+				"overflow_limit": legacyOverflowLimit,
+			})
+			attempt.cancel("response buffer overflow")
+			if !headersSet {
+				http.Error(w, errMsg, http.StatusBadGateway)
+			} else {
+				streamSpan.setError("response buffer overflow")
+				abortStream(w, http.StatusBadGateway, errMsg)
+			}
+			return ""
+
 		case <-ctx.Done():
+			if cancelledByShutdown(r.Context()) {
+				// 排空超时，服务器取消了剩余请求（见 shutdown.go）；
+				// 排空期间客户端自己断开的请求走下面的 client disconnected 分支
+				log.Printf("[SHUTDOWN] Cancelling request %s", req.ID)
+				attempt.cancel("server shutting down")
+				if !headersSet {
+					writeShutdownError(w)
+				} else {
+					streamSpan.setError("server shutting down")
+					abortStream(w, http.StatusServiceUnavailable, "The proxy is shutting down, please retry.")
+				}
+				return ""
+			}
+			if r.Context().Err() != nil {
+				// 客户端断开（例如 IDE 中止生成），没有人再接收响应
+				log.Printf("[CANCEL] Client went away for request %s", r.URL.Path)
+				attempt.cancel("client disconnected")
+				return ""
+			}
 			// 超时
+			attempt.cancel("timeout")
+			attempt.conn.recordError(fmt.Sprintf("no response within %s", requestTimeout))
 			if !headersSet {
 				log.Printf("Gateway Timeout: No response from client for request %s", r.URL.Path)
 				http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
 			} else {
 				// 如果流已经开始，我们只能记录日志并断开连接
 				log.Printf("Gateway Timeout: Stream incomplete for request %s", r.URL.Path)
+				streamSpan.setError("timeout")
+				abortStream(w, http.StatusGatewayTimeout, fmt.Sprintf("Gateway Timeout: stream incomplete after %s", requestTimeout))
 			}
-			return
+			return ""
 		}
 	}
 }
@@ -346,19 +691,96 @@ func writeStatusCode(w http.ResponseWriter, payload map[string]interface{}) {
 	w.WriteHeader(int(status))
 }
 
-// writeBody 从payload中解析并写入HTTP响应体
-func writeBody(w http.ResponseWriter, payload map[string]interface{}) {
-	var bodyData []byte
+// payloadBody 从payload中解析HTTP响应体，按 "encoding" 字段解码
+func payloadBody(payload map[string]interface{}) []byte {
+	var raw string
 	// 对于 http_response，body 键通常包含数据
 	if body, ok := payload["body"].(string); ok {
-		bodyData = []byte(body)
+		raw = body
 	}
 	// 对于 stream_chunk，data 键通常包含数据
 	if data, ok := payload["data"].(string); ok {
-		bodyData = []byte(data)
+		raw = data
 	}
-	// 注意：如果前端发送的是二进制数据，这里应该假设它是base64编码的字符串并进行解码
 
+	encoding, _ := payload["encoding"].(string)
+	switch encoding {
+	case "", bodyEncodingUTF8:
+		return []byte(raw)
+	case bodyEncodingBase64:
+		bodyData, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			log.Printf("Error decoding base64 body from client: %v", err)
+			return nil
+		}
+		return bodyData
+	default:
+		log.Printf("Warning: unknown body encoding %q from client, using raw string", encoding)
+		return []byte(raw)
+	}
+}
+
+// encodeBody 将请求体编码为WS消息中的字符串，非UTF-8的数据使用base64
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), bodyEncodingUTF8
+	}
+	return base64.StdEncoding.EncodeToString(body), bodyEncodingBase64
+}
+
+// logBody 返回适合写入日志的请求/响应体，二进制数据只记录长度
+func logBody(body []byte) string {
+	if utf8.Valid(body) {
+		return string(body)
+	}
+	return fmt.Sprintf("<binary data, %d bytes>", len(body))
+}
+
+// payloadHeader 从payload的响应头中读取指定头（大小写不敏感）
+func payloadHeader(payload map[string]interface{}, name string) string {
+	headers, ok := payload["headers"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for key, value := range headers {
+		if !strings.EqualFold(key, name) {
+			continue
+		}
+		if strV, ok := value.(string); ok {
+			return strV
+		}
+		if values, ok := value.([]interface{}); ok && len(values) > 0 {
+			if strV, ok := values[0].(string); ok {
+				return strV
+			}
+		}
+	}
+	return ""
+}
+
+// streamAborter 由需要区分流式响应正常结束与中途中断的 ResponseWriter 实现（见 gemini.go 的 translatingWriter）
+type streamAborter interface {
+	abortStream(status int, message string)
+}
+
+// abortStream 通知 ResponseWriter 流式响应在写出响应头后中断；
+// 透传的 Gemini 响应没有可以追加的错误格式，只能由客户端从不完整的响应体中发现
+func abortStream(w http.ResponseWriter, status int, message string) {
+	for {
+		if a, ok := w.(streamAborter); ok {
+			a.abortStream(status, message)
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// writeBody 写入HTTP响应体
+func writeBody(w http.ResponseWriter, bodyData []byte) {
 	if len(bodyData) > 0 {
 		w.Write(bodyData)
 	}
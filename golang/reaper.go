@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- 失效连接清理 ---
+// 后台每隔 timeouts.ws_ping_interval 向所有浏览器连接发送 WebSocket ping 控制帧（浏览器会自动回复 pong），
+// 超过 timeouts.ws_idle 没有收到任何消息或 pong 的连接会被关闭并移出连接池，
+// 避免半死的浏览器标签页继续被分配请求。
+
+const wsControlWriteTimeout = 5 * time.Second
+
+// reaperDisabledRecheck 是清理关闭（ws_ping_interval 为 0）时重新检查配置的间隔，配置重载后可重新开启
+const reaperDisabledRecheck = 5 * time.Second
+
+// startConnectionReaper 启动后台清理协程
+// 每轮都重新读取 ws_ping_interval，重载配置后下一轮生效
+func startConnectionReaper() {
+	timeouts := currentConfig().Timeouts
+	if timeouts.WSPingInterval <= 0 {
+		log.Println("Connection reaper disabled (timeouts.ws_ping_interval is 0)")
+	} else {
+		log.Printf("Connection reaper started: ping every %s, evict after %s idle", timeouts.WSPingInterval, timeouts.WSIdle)
+	}
+
+	go func() {
+		for {
+			wsPingInterval := currentConfig().Timeouts.WSPingInterval
+			if wsPingInterval <= 0 {
+				time.Sleep(reaperDisabledRecheck)
+				continue
+			}
+			time.Sleep(wsPingInterval)
+			if currentConfig().Timeouts.WSPingInterval > 0 {
+				reapConnections()
+			}
+		}
+	}()
+}
+
+// reapConnections 驱逐空闲超时的连接，并向其余连接发送 ping
+func reapConnections() {
+	now := time.Now()
+	wsIdleTimeout := currentConfig().Timeouts.WSIdle
+	for _, uc := range globalPool.allConnections() {
+		idle := now.Sub(uc.LastActive())
+		if wsIdleTimeout > 0 && idle > wsIdleTimeout {
+			evictConnection(uc, fmt.Sprintf("idle for %s", idle.Round(time.Second)))
+			continue
+		}
+		if err := uc.Conn.WriteControl(websocket.PingMessage, nil, now.Add(wsControlWriteTimeout)); err != nil {
+			evictConnection(uc, "ping failed: "+err.Error())
+		}
+	}
+}
+
+// evictConnection 将连接移出连接池并关闭，readPump 随后退出
+func evictConnection(uc *UserConnection, reason string) {
+	remoteAddr := uc.Conn.RemoteAddr().String()
+	logMsg := fmt.Sprintf("[REAPER] Evicting stale connection %s for user %s (%s): %s", uc.ID, uc.UserID, remoteAddr, reason)
+	log.Println(logMsg)
+	addLog("WARN", logMsg, map[string]interface{}{
+		"user_id":       uc.UserID,
+		"connection_id": uc.ID,
+		"connection":    remoteAddr,
+		"reason":        reason,
+		"last_active":   uc.LastActive(),
+		"in_flight":     uc.InFlight(),
+	})
+
+	globalPool.RemoveConnection(uc.UserID, uc.Conn)
+	closeUserConnection(uc, websocket.CloseGoingAway, "connection idle")
+}
+
+// closeUserConnection 发送关闭帧后关闭连接，readPump 随后退出并结束其在途请求
+func closeUserConnection(uc *UserConnection, code int, text string) {
+	uc.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(wsControlWriteTimeout))
+	uc.Conn.Close()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// --- 配置热重载 ---
+// 收到 SIGHUP，或者 PROXY_CONFIG 及其引用的文件（auth.api_keys_file、auth.jwt.public_key_file、auth.jwt.jwks_file、
+// routing.balancer_config、transformers.config_file）的修改时间变化时，重新加载配置。
+// 文件每隔 reload.poll_interval 检查一次；环境变量在进程运行中不会变化，仍然覆盖文件中的值。
+//
+// 重载时先解析并校验新配置和所有引用文件，任何一步失败都记录错误并保留当前配置；
+// 全部成功后构建新的 runtimeState，用一次 atomic Store 同时替换配置、API Key、JWT 验证器、负载均衡策略和转换器。
+// 每次读取 currentState 得到的都是同一次加载的结果，不存在新旧配置混合的窗口；
+// 但分多次读取的调用方（例如先读 currentConfig 再查 API Key）可能跨过一次重载，需要一致时应只读取一次 currentState。
+// 连接池不会重建，浏览器连接保持不变；进行中的请求继续使用开始时读到的超时和流控窗口，新请求使用新配置。
+// listen.* 和持久化日志的 logging.dir / file_max_mb / max_age / max_files 只在启动时生效，
+// 修改后打印警告并沿用旧值，需要重启。
+
+// reloadMu 保证同一时间只有一次重载（SIGHUP 和文件轮询可能同时触发）
+var reloadMu sync.Mutex
+
+// startupOnlyKeys 是重载时不会生效的配置项
+var startupOnlyKeys = map[string]bool{
+	"listen.addr":         true,
+	"listen.ws_path":      true,
+	"logging.dir":         true,
+	"logging.file_max_mb": true,
+	"logging.max_age":     true,
+	"logging.max_files":   true,
+}
+
+// runtimeState 是配置以及由它加载的 API Key、JWT 验证器（为 nil 时只有 auth.allow_legacy_token 才接受固定 token）、
+// 负载均衡策略和转换器。创建后不再修改，启动和重载时整体替换
+type runtimeState struct {
+	config       *proxyConfig
+	apiKeys      *APIKeyStore
+	jwtValidator *jwtValidator
+	balancer     *balancerSetup
+	transformers *transformerSetup
+}
+
+var activeState atomic.Pointer[runtimeState]
+
+func init() {
+	// main 加载配置前使用默认值
+	state, err := newRuntimeState(defaultConfig())
+	if err != nil {
+		panic(err)
+	}
+	activeState.Store(state)
+}
+
+// currentState 返回当前生效的运行时状态，调用方不得修改
+func currentState() *runtimeState {
+	return activeState.Load()
+}
+
+// newRuntimeState 加载 config 引用的全部文件并校验，不修改任何正在使用的状态
+func newRuntimeState(config *proxyConfig) (*runtimeState, error) {
+	state := &runtimeState{config: config}
+	var errs []error
+	keys, err := loadAPIKeys(config.Auth.APIKeysFile, config.Auth.APIKey)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("auth.api_keys_file: %w", err))
+	}
+	state.apiKeys = newAPIKeyStore(keys)
+	// loadJWTValidator 的错误已经带有 auth.jwt.* 前缀
+	if state.jwtValidator, err = loadJWTValidator(config.Auth.JWT); err != nil {
+		errs = append(errs, err)
+	}
+	if state.balancer, err = parseBalancerConfig(config.Routing.BalancerConfig); err != nil {
+		errs = append(errs, fmt.Errorf("routing.balancer_config: %w", err))
+	}
+	if state.transformers, err = parseTransformerConfig(config.Transformers.ConfigFile); err != nil {
+		errs = append(errs, fmt.Errorf("transformers.config_file: %w", err))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return state, nil
+}
+
+// prepareReload 加载并校验全部配置
+func prepareReload(configPath string) (*runtimeState, error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return newRuntimeState(config)
+}
+
+// reloadConfig 重新加载配置，失败时保留当前配置；trigger 只用于日志
+func reloadConfig(configPath, trigger string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	state, err := prepareReload(configPath)
+	if err != nil {
+		logMsg := fmt.Sprintf("[CONFIG] Reload (%s) failed, keeping the current configuration:\n%v", trigger, err)
+		log.Println(logMsg)
+		addLog("ERROR", logMsg, map[string]interface{}{
+			"trigger": trigger,
+			"error":   err.Error(),
+		})
+		return err
+	}
+
+	changed, ignored := splitStartupOnly(currentConfig(), state.config)
+	activeState.Store(state)
+
+	keys, _, users := state.apiKeys.summary()
+	requestNames, responseNames := transformerNames(state.transformers.request), transformerNames(state.transformers.response)
+	logMsg := fmt.Sprintf("[CONFIG] Reloaded (%s): %d API keys for %d users, balancer default=%s, transformers request=%v response=%v, changed settings: %v",
+		trigger, keys, users, state.balancer.def.Name(), requestNames, responseNames, changed)
+	log.Println(logMsg)
+	addLog("INFO", logMsg, map[string]interface{}{
+		"trigger":       trigger,
+		"changed":       changed,
+		"api_keys":      keys,
+		"api_key_users": users,
+		"jwt_enabled":   state.jwtValidator != nil,
+		"balancer":      state.balancer.def.Name(),
+		"transformers":  append(requestNames, responseNames...),
+		"connections":   len(globalPool.allConnections()),
+	})
+	if len(ignored) > 0 {
+		logMsg := fmt.Sprintf("[CONFIG] %s changed but only take effect after a restart; keeping the current values", strings.Join(ignored, ", "))
+		log.Println(logMsg)
+		addLog("WARN", logMsg, map[string]interface{}{"ignored": ignored})
+	}
+	return nil
+}
+
+// splitStartupOnly 比较当前配置和新配置，返回会生效的变化和只在启动时生效、因而被忽略的变化；
+// 后者在 next 中被改回 old 的值
+func splitStartupOnly(old, next *proxyConfig) (changed, ignored []string) {
+	for _, key := range configChanges(old, next) {
+		if startupOnlyKeys[key] {
+			ignored = append(ignored, key)
+		} else {
+			changed = append(changed, key)
+		}
+	}
+	next.Listen = old.Listen
+	next.Logging.Dir = old.Logging.Dir
+	next.Logging.FileMaxMB = old.Logging.FileMaxMB
+	next.Logging.MaxAge = old.Logging.MaxAge
+	next.Logging.MaxFiles = old.Logging.MaxFiles
+	return changed, ignored
+}
+
+// configChanges 返回两份配置中值不同的配置项路径（如 timeouts.request），不包含值本身以免把密钥写进日志
+func configChanges(old, next *proxyConfig) []string {
+	var changed []string
+	var walk func(prefix string, a, b reflect.Value)
+	walk = func(prefix string, a, b reflect.Value) {
+		if a.Kind() != reflect.Struct {
+			if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+				changed = append(changed, prefix)
+			}
+			return
+		}
+		for i := 0; i < a.NumField(); i++ {
+			key := strings.Split(a.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			walk(key, a.Field(i), b.Field(i))
+		}
+	}
+	walk("", reflect.ValueOf(*old), reflect.ValueOf(*next))
+	return changed
+}
+
+// --- 触发方式 ---
+
+// fileStamp 是判断文件是否被修改的依据；文件不存在时为零值，重新出现时也会触发重载
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchedFiles 返回需要检查修改时间的文件：配置文件本身和它引用的文件
+func watchedFiles(configPath string, c *proxyConfig) []string {
+	var files []string
+	for _, path := range []string{configPath, c.Auth.APIKeysFile, c.Auth.JWT.PublicKeyFile, c.Auth.JWT.JWKSFile, c.Routing.BalancerConfig, c.Transformers.ConfigFile} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+func statFiles(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		var stamp fileStamp
+		if info, err := os.Stat(path); err == nil {
+			stamp = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+		stamps[path] = stamp
+	}
+	return stamps
+}
+
+// startConfigReloader 监听 SIGHUP 并定期检查配置文件的修改时间
+func startConfigReloader(configPath string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	files := watchedFiles(configPath, currentConfig())
+	if interval := currentConfig().Reload.PollInterval; interval > 0 && len(files) > 0 {
+		log.Printf("Config reload enabled: SIGHUP, or changes to %v (checked every %s)", files, interval)
+	} else {
+		log.Println("Config reload enabled: SIGHUP")
+	}
+
+	go func() {
+		stamps := statFiles(files)
+		for {
+			// 每轮重新读取间隔，poll_interval 本身也可以被重载
+			var poll <-chan time.Time
+			if interval := currentConfig().Reload.PollInterval; interval > 0 {
+				poll = time.After(interval)
+			}
+
+			select {
+			case <-hup:
+				reloadConfig(configPath, "SIGHUP")
+			case <-poll:
+				current := statFiles(watchedFiles(configPath, currentConfig()))
+				if maps.Equal(current, stamps) {
+					continue
+				}
+				var modified []string
+				for path, stamp := range current {
+					if stamps[path] != stamp {
+						modified = append(modified, path)
+					}
+				}
+				sort.Strings(modified)
+				reloadConfig(configPath, "modified: "+strings.Join(modified, ", "))
+			}
+			// 重载后引用的文件可能变化；失败时同样更新，文件再次修改前不重复报错
+			stamps = statFiles(watchedFiles(configPath, currentConfig()))
+		}
+	}()
+}
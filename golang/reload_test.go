@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useRuntimeState 替换当前运行时状态的一份修改后的副本，测试结束后恢复
+func useRuntimeState(t *testing.T, modify func(state *runtimeState)) {
+	t.Helper()
+	old := currentState()
+	next := *old
+	modify(&next)
+	activeState.Store(&next)
+	t.Cleanup(func() { activeState.Store(old) })
+}
+
+func TestConfigChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *proxyConfig)
+		want   []string
+	}{
+		{"unchanged", func(c *proxyConfig) {}, nil},
+		{"duration", func(c *proxyConfig) { c.Timeouts.Request = time.Minute }, []string{"timeouts.request"}},
+		{"nested string", func(c *proxyConfig) { c.Auth.JWT.Secret = "s" }, []string{"auth.jwt.secret"}},
+		{"map", func(c *proxyConfig) { c.Transformers.ThinkingBudgets = map[string]int{"high": 1} }, []string{"transformers.thinking_budgets"}},
+		{"several, in field order", func(c *proxyConfig) {
+			c.Reload.PollInterval = time.Second
+			c.Listen.Addr = ":9999"
+			c.Logging.Dir = "/tmp/logs"
+		}, []string{"listen.addr", "logging.dir", "reload.poll_interval"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, next := defaultConfig(), defaultConfig()
+			tt.modify(next)
+			if got := configChanges(old, next); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("configChanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitStartupOnly(t *testing.T) {
+	old, next := defaultConfig(), defaultConfig()
+	next.Listen.Addr = ":9999"
+	next.Listen.WSPath = "/ws"
+	next.Logging.Dir = "/tmp/logs"
+	next.Logging.MaxFiles = 3
+	next.Timeouts.Request = time.Minute
+
+	changed, ignored := splitStartupOnly(old, next)
+	if want := []string{"timeouts.request"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("changed = %v, want %v", changed, want)
+	}
+	if want := []string{"listen.addr", "listen.ws_path", "logging.dir", "logging.max_files"}; !reflect.DeepEqual(ignored, want) {
+		t.Fatalf("ignored = %v, want %v", ignored, want)
+	}
+	// 只在启动时生效的值保持不变，其他值采用新配置
+	if next.Listen != old.Listen || next.Logging.Dir != old.Logging.Dir || next.Logging.MaxFiles != old.Logging.MaxFiles {
+		t.Fatalf("startup-only values were not restored: listen=%+v logging=%+v", next.Listen, next.Logging)
+	}
+	if next.Timeouts.Request != time.Minute {
+		t.Fatalf("timeouts.request = %s, want 1m", next.Timeouts.Request)
+	}
+	if got := configChanges(old, next); !reflect.DeepEqual(got, changed) {
+		t.Fatalf("after split, configChanges() = %v, want %v", got, changed)
+	}
+}
+
+func TestStartupOnlyKeysExist(t *testing.T) {
+	// startupOnlyKeys 中的键必须是真实的配置路径，否则 splitStartupOnly 不会报告对应的修改
+	all := make(map[string]bool)
+	zero := &proxyConfig{}
+	for _, key := range configChanges(zero, defaultConfigWithEveryField()) {
+		all[key] = true
+	}
+	for key := range startupOnlyKeys {
+		if !all[key] {
+			t.Errorf("startupOnlyKeys contains unknown key %q", key)
+		}
+	}
+}
+
+// defaultConfigWithEveryField 返回每个字段都不是零值的配置
+func defaultConfigWithEveryField() *proxyConfig {
+	c := defaultConfig()
+	var fill func(v reflect.Value)
+	fill = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				fill(v.Field(i))
+			}
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Int, reflect.Int64:
+			v.SetInt(1)
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Map:
+			v.Set(reflect.MakeMap(v.Type()))
+			v.SetMapIndex(reflect.Zero(v.Type().Key()), reflect.Zero(v.Type().Elem()))
+		}
+	}
+	fill(reflect.ValueOf(c).Elem())
+	return c
+}
+
+func TestReloadConfigSwapsStateAtomically(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "keys.json")
+	balancerFile := filepath.Join(dir, "balancer.json")
+	configPath := filepath.Join(dir, "proxy.yaml")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(keys, `{"keys": [{"key": "k1", "user_id": "alice"}]}`)
+	write(balancerFile, `{"default": "random"}`)
+	write(configPath, "auth:\n  allow_legacy_token: true\n  api_keys_file: "+keys+"\nrouting:\n  balancer_config: "+balancerFile+"\nlisten:\n  addr: \":1\"\n")
+
+	useRuntimeState(t, func(state *runtimeState) {})
+	if err := reloadConfig(configPath, "test"); err != nil {
+		t.Fatal(err)
+	}
+	state := currentState()
+	if key, err := state.apiKeys.Lookup("k1"); err != nil || key.UserID != "alice" {
+		t.Fatalf("Lookup(k1) = %v, %v", key, err)
+	}
+	if state.balancer.def.Name() != "random" || balancerFor("alice").Name() != "random" {
+		t.Fatalf("balancer = %s", state.balancer.def.Name())
+	}
+	if state.config.Listen.Addr != defaultConfig().Listen.Addr {
+		t.Fatalf("listen.addr changed on reload: %q", state.config.Listen.Addr)
+	}
+
+	// 引用的文件无效时整个重载失败，状态保持不变
+	write(balancerFile, `{"default": "nope"}`)
+	write(keys, `{"keys": [{"key": "k2", "user_id": "bob"}]}`)
+	if err := reloadConfig(configPath, "test"); err == nil {
+		t.Fatal("reload with an invalid balancer config succeeded")
+	}
+	if currentState() != state {
+		t.Fatal("failed reload replaced the runtime state")
+	}
+	if _, err := currentState().apiKeys.Lookup("k2"); err == nil {
+		t.Fatal("failed reload installed the new API keys")
+	}
+}
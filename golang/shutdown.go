@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- 优雅关闭 ---
+// 收到 SIGTERM 或 SIGINT 后：
+//  1. 新代理请求返回 Gemini 格式的 503（UNAVAILABLE）。监听在排空期间保持打开，新连接同样得到 503
+//     而不是被拒绝；keep-alive 被关闭，客户端收到响应后会断开并重试；
+//  2. 等待进行中的请求（包括 processWebSocketResponse 中的流式响应）结束，最长 timeouts.shutdown_drain；
+//  3. 超过期限仍未结束的请求被取消（通知浏览器 cancel），尚未写出响应头的返回 503；
+//  4. 排空结束后才关闭监听，向每个浏览器连接发送关闭帧（1001 Going Away），导出剩余的追踪数据并关闭持久化日志后退出。
+// 等待期间再次收到信号会立即退出。
+
+const (
+	// shutdownCancelGrace 是取消剩余请求后等待处理函数返回的时间
+	shutdownCancelGrace = 5 * time.Second
+	// shutdownFlushTimeout 是退出前导出追踪数据的最长时间
+	shutdownFlushTimeout = 5 * time.Second
+	// shutdownPollInterval 是排空期间检查进行中请求数的间隔
+	shutdownPollInterval = 50 * time.Millisecond
+)
+
+// shuttingDown 在收到退出信号后置位，之后的代理请求直接返回 503
+var shuttingDown atomic.Bool
+
+// inFlightProxyRequests 是已通过 rejectWhenShuttingDown、尚未返回的代理请求数，排空阶段等待它归零
+var inFlightProxyRequests atomic.Int64
+
+// errServerShutdown 是排空超时后取消剩余请求时使用的 cause，
+// 用来区分服务器取消的请求和排空期间自己断开的客户端（见 cancelledByShutdown）
+var errServerShutdown = errors.New("server shutting down")
+
+// cancelledByShutdown 判断请求的 context 是否因排空超时被服务器取消
+func cancelledByShutdown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errServerShutdown)
+}
+
+// rejectWhenShuttingDown 在关闭过程中以 503 拒绝新的代理请求
+func rejectWhenShuttingDown(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 先计数再检查标志：排空阶段看到计数为 0 之后，不会再有请求越过检查
+		inFlightProxyRequests.Add(1)
+		if shuttingDown.Load() {
+			inFlightProxyRequests.Add(-1)
+			writeShutdownError(w)
+			return
+		}
+		defer inFlightProxyRequests.Add(-1)
+		h(w, r)
+	}
+}
+
+func writeShutdownError(w http.ResponseWriter) {
+	// 让客户端在新连接上重试，而不是继续复用这个即将关闭的连接
+	w.Header().Set("Connection", "close")
+	writeGeminiError(w, http.StatusServiceUnavailable, "The proxy is shutting down, please retry.", "UNAVAILABLE")
+}
+
+// serveUntilShutdown 启动 HTTP 服务并阻塞，直到收到退出信号并完成关闭
+func serveUntilShutdown(server *http.Server) {
+	// 所有请求的 context 都派生自 requestsCtx，排空超时后取消它来结束剩余请求
+	requestsCtx, cancelRequests := context.WithCancelCause(context.Background())
+	defer cancelRequests(errServerShutdown)
+	server.BaseContext = func(net.Listener) context.Context { return requestsCtx }
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServe() }()
+
+	var sig os.Signal
+	select {
+	case err := <-serveErr:
+		log.Fatalf("Could not start server: %s\n", err)
+	case sig = <-signals:
+	}
+
+	shuttingDown.Store(true)
+	drain := currentConfig().Timeouts.ShutdownDrain
+	logMsg := fmt.Sprintf("[SHUTDOWN] Received %s, draining %d in-flight request(s) (up to %s)", sig, inFlightProxyRequests.Load(), drain)
+	log.Println(logMsg)
+	addLog("WARN", logMsg, map[string]interface{}{
+		"signal":      sig.String(),
+		"drain":       drain.String(),
+		"in_flight":   inFlightProxyRequests.Load(),
+		"connections": len(globalPool.allConnections()),
+	})
+	go func() {
+		<-signals
+		log.Println("[SHUTDOWN] Received second signal, exiting immediately")
+		os.Exit(1)
+	}()
+
+	// SSE 日志流不会自己结束，先断开，客户端会在新进程上重连续传
+	closeLogStreams()
+
+	// 排空期间监听保持打开，新请求由 rejectWhenShuttingDown 返回 503；
+	// 关闭 keep-alive（同时关闭空闲连接），响应写完后连接随即断开
+	server.SetKeepAlivesEnabled(false)
+	deadline := time.Now().Add(drain)
+	if !waitForProxyRequests(deadline) {
+		logMsg := fmt.Sprintf("[SHUTDOWN] Drain deadline reached, cancelling %d in-flight request(s)", inFlightProxyRequests.Load())
+		log.Println(logMsg)
+		addLog("WARN", logMsg, map[string]interface{}{"in_flight": inFlightProxyRequests.Load()})
+		cancelRequests(errServerShutdown)
+		deadline = time.Now().Add(shutdownCancelGrace)
+		waitForProxyRequests(deadline)
+	}
+
+	// 排空结束才关闭监听；Shutdown 等待剩余的请求（如正在写出的 503）。
+	// 浏览器的 WebSocket 连接已被接管，不在等待之列
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	if err := server.Shutdown(ctx); err != nil {
+		cancelRequests(errServerShutdown)
+		server.Close()
+	}
+	cancel()
+
+	conns := globalPool.allConnections()
+	for _, uc := range conns {
+		globalPool.RemoveConnection(uc.UserID, uc.Conn)
+		closeUserConnection(uc, websocket.CloseGoingAway, "server shutting down")
+	}
+	logMsg = fmt.Sprintf("[SHUTDOWN] Closed %d browser connection(s), exiting", len(conns))
+	log.Println(logMsg)
+	addLog("INFO", logMsg, map[string]interface{}{"connections": len(conns)})
+
+	tracer.flush(shutdownFlushTimeout)
+	persistentLogs.close()
+}
+
+// waitForProxyRequests 等待进行中的代理请求全部返回，到达 deadline 仍未结束时返回 false
+func waitForProxyRequests(deadline time.Time) bool {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for inFlightProxyRequests.Load() > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		<-ticker.C
+	}
+	return true
+}
+
+// countPendingRequests 返回等待浏览器响应的请求数
+func countPendingRequests() int {
+	pending := 0
+	pendingRequests.Range(func(_, _ interface{}) bool {
+		pending++
+		return true
+	})
+	return pending
+}
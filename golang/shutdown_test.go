@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCancelledByShutdown(t *testing.T) {
+	// 与 serveUntilShutdown 相同的结构：请求的 context 派生自可带 cause 取消的 requestsCtx
+	requestsCtx, cancelRequests := context.WithCancelCause(context.Background())
+	defer cancelRequests(nil)
+
+	clientGone, disconnect := context.WithCancel(requestsCtx)
+	disconnect()
+	if cancelledByShutdown(clientGone) {
+		t.Fatal("client disconnect reported as shutdown")
+	}
+
+	running, cancel := context.WithCancel(requestsCtx)
+	defer cancel()
+	if cancelledByShutdown(running) {
+		t.Fatal("running request reported as shutdown")
+	}
+	cancelRequests(errServerShutdown)
+	if !cancelledByShutdown(running) {
+		t.Fatalf("request cancelled by the server: cause = %v", context.Cause(running))
+	}
+	// 先断开的客户端保持原来的 cause
+	if cancelledByShutdown(clientGone) {
+		t.Fatal("earlier client disconnect reported as shutdown")
+	}
+}
+
+func TestRejectWhenShuttingDown(t *testing.T) {
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := rejectWhenShuttingDown(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// 信号之前进入的请求计入排空
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-entered
+	shuttingDown.Store(true)
+	if waitForProxyRequests(time.Now().Add(2 * shutdownPollInterval)) {
+		t.Fatal("drain finished while a request is still running")
+	}
+
+	// 排空期间的新连接得到 503，而不是被拒绝
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request during drain: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "UNAVAILABLE") {
+		t.Fatalf("got %d %s, want 503 UNAVAILABLE", resp.StatusCode, body)
+	}
+	if !resp.Close {
+		t.Fatal("503 during drain should close the connection")
+	}
+
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("in-flight request finished with %d, want 200", status)
+	}
+	if !waitForProxyRequests(time.Now().Add(time.Second)) {
+		t.Fatalf("drain did not finish: %d request(s) in flight", inFlightProxyRequests.Load())
+	}
+}
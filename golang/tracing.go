@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- OpenTelemetry 追踪 ---
+// 设置 OTEL_EXPORTER_OTLP_ENDPOINT（如 http://localhost:4318，自动追加 /v1/traces）或
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT（完整URL）后，每个代理请求生成一条追踪，以 OTLP/HTTP JSON 格式批量发送：
+//
+//	<METHOD> <route>       整个客户端请求；客户端带 traceparent 头时作为其子 span
+//	├── auth               API Key 认证
+//	├── transform          请求转换器
+//	├── select_connection  选择浏览器连接（每次尝试一个）
+//	└── ws_dispatch        一次发往浏览器的尝试，直到响应结束
+//	    ├── first_chunk    发出 http_request 到收到第一条响应消息（浏览器 fetch + Google 的耗时）
+//	    ├── browser_fetch  浏览器上报的 fetch 耗时
+//	    └── stream         stream_start 到流结束
+//
+// http_request 的 payload 带 ws_dispatch 的 W3C "traceparent"，浏览器可据此把自己的 span 接入同一条追踪。
+// 浏览器在 stream_start / http_response 的 payload 中带
+// "timing": {"fetch_start": <Unix 毫秒>, "response_start": <Unix 毫秒>} 时，服务器据此记录 browser_fetch span。
+// 未设置 endpoint 时不创建任何 span，也不发送 traceparent。
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	traceExportBatchSize = 512
+	traceQueueSize       = 4096
+)
+
+// tracer 在 main 中初始化，为 nil 时不追踪
+var tracer *otlpExporter
+
+// traceSpan 是一个进行中或已结束的 span；所有方法都接受 nil（未启用追踪）
+type traceSpan struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // 全零表示根 span
+	name     string
+	kind     int
+	start    time.Time
+
+	mu      sync.Mutex
+	endTime time.Time
+	attrs   map[string]interface{}
+	errMsg  string
+}
+
+type traceSpanKey struct{}
+
+// spanFromContext 返回 context 中当前的 span
+func spanFromContext(ctx context.Context) *traceSpan {
+	s, _ := ctx.Value(traceSpanKey{}).(*traceSpan)
+	return s
+}
+
+// startSpan 以 context 中的 span 为父 span 创建子 span，并返回携带新 span 的 context
+func startSpan(ctx context.Context, name string) (context.Context, *traceSpan) {
+	s := spanFromContext(ctx).child(name)
+	if s == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, traceSpanKey{}, s), s
+}
+
+// startServerSpan 为客户端请求创建根 span，请求头中的 traceparent 有效时沿用其 trace ID
+func startServerSpan(ctx context.Context, r *http.Request, name string) (context.Context, *traceSpan) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &traceSpan{name: name, kind: spanKindServer, start: time.Now()}
+	if traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	s.setAttr("http.request.method", r.Method)
+	s.setAttr("url.path", r.URL.Path)
+	return context.WithValue(ctx, traceSpanKey{}, s), s
+}
+
+// child 创建子 span，父 span 为 nil 时返回 nil
+func (s *traceSpan) child(name string) *traceSpan {
+	if s == nil {
+		return nil
+	}
+	c := &traceSpan{traceID: s.traceID, parentID: s.spanID, name: name, kind: spanKindInternal, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *traceSpan) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// setError 把 span 标记为失败
+func (s *traceSpan) setError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = msg
+	s.mu.Unlock()
+}
+
+// end 结束 span 并交给导出器，重复调用无效
+func (s *traceSpan) end() {
+	s.endAt(time.Now())
+}
+
+func (s *traceSpan) endAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.endTime.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.endTime = t
+	s.mu.Unlock()
+	tracer.enqueue(s)
+}
+
+// traceparent 返回 W3C traceparent 格式的 span 上下文
+func (s *traceSpan) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// parseTraceparent 解析 "00-<trace-id>-<parent-id>-<flags>"
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// recordBrowserTiming 根据 stream_start / http_response 中浏览器上报的 timing 记录 browser_fetch span
+func (s *traceSpan) recordBrowserTiming(payload map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	timing, ok := payload["timing"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	fetchStart, ok1 := timing["fetch_start"].(float64)
+	responseStart, ok2 := timing["response_start"].(float64)
+	if !ok1 || !ok2 || responseStart < fetchStart {
+		return
+	}
+	c := s.child("browser_fetch")
+	c.start = time.UnixMilli(int64(fetchStart))
+	// 浏览器时钟与服务器不同步，span 位置仅供参考，时长是准确的
+	c.setAttr("browser.clock", "client")
+	c.endAt(time.UnixMilli(int64(responseStart)))
+}
+
+// --- OTLP/HTTP JSON 导出 ---
+
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	interval time.Duration
+	client   *http.Client
+
+	queue   chan *traceSpan
+	flushed chan chan struct{} // 退出前请求导出剩余的 span，完成后关闭传入的通道
+	dropped atomic.Int64       // 队列满而丢弃的 span 数
+}
+
+// initTracing 根据 OTEL_* 环境变量启动导出器
+func initTracing() error {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("OTLP endpoint %q must be an http(s) URL", endpoint)
+	}
+
+	headers := make(map[string]string)
+	if raw := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(k) == "" {
+				return fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: invalid entry %q, expected key=value", pair)
+			}
+			value, err := url.QueryUnescape(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: invalid value for %q: %w", k, err)
+			}
+			headers[strings.TrimSpace(k)] = value
+		}
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "aistudio-build-proxy"
+	}
+
+	interval := time.Duration(envInt("OTEL_BSP_SCHEDULE_DELAY", 5000)) * time.Millisecond
+	if interval <= 0 {
+		return fmt.Errorf("OTEL_BSP_SCHEDULE_DELAY must be positive")
+	}
+
+	tracer = &otlpExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *traceSpan, traceQueueSize),
+		flushed:  make(chan chan struct{}),
+	}
+	go tracer.run()
+	log.Printf("Tracing enabled: exporting spans for service %q to %s every %s", service, endpoint, tracer.interval)
+	return nil
+}
+
+// enqueue 把已结束的 span 放入导出队列，队列满时丢弃（不阻塞请求处理）
+func (e *otlpExporter) enqueue(s *traceSpan) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	batch := make([]*traceSpan, 0, traceExportBatchSize)
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < traceExportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-e.flushed:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+				if len(batch) == traceExportBatchSize {
+					e.export(batch)
+					batch = batch[:0]
+				}
+			}
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = batch[:0]
+			}
+			close(done)
+			continue
+		}
+		e.export(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush 导出队列中剩余的 span，最多等待 timeout；退出前调用
+func (e *otlpExporter) flush(timeout time.Duration) {
+	if e == nil {
+		return
+	}
+	done := make(chan struct{})
+	deadline := time.After(timeout)
+	select {
+	case e.flushed <- done:
+	case <-deadline:
+		return
+	}
+	select {
+	case <-done:
+	case <-deadline:
+		log.Printf("[TRACING] Flush did not finish within %s", timeout)
+	}
+}
+
+// export 发送一批 span，失败只打印日志，不重试
+func (e *otlpExporter) export(spans []*traceSpan) {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		log.Printf("[TRACING] Cannot encode %d span(s): %v", len(spans), err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[TRACING] Cannot build export request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("[TRACING] Export of %d span(s) failed: %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("[TRACING] Export of %d span(s) rejected by collector: %s", len(spans), resp.Status)
+	}
+}
+
+// encode 按 OTLP JSON 编码（trace/span ID 为十六进制字符串，时间为纳秒字符串）
+func (e *otlpExporter) encode(spans []*traceSpan) map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.endTime.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.errMsg != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.errMsg}
+		}
+		s.mu.Unlock()
+		out = append(out, span)
+	}
+
+	resourceAttrs := map[string]interface{}{"service.name": e.service}
+	if dropped := e.dropped.Load(); dropped > 0 {
+		resourceAttrs["proxy.spans_dropped"] = dropped
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resourceAttrs)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "aistudio-build-proxy"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": k, "value": value})
+	}
+	return out
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Transformer rewrites a Gemini request or response body
+// It must return the input unchanged when it has nothing to fix
+type Transformer interface {
+	Name() string
+	Transform(tc *TransformContext, bodyBytes []byte) []byte
+}
+
+// transformerFunc adapts a plain function (like fixToolDefinitions) to Transformer
+type transformerFunc struct {
+	name string
+	fn   func(*TransformContext, []byte) []byte
+}
+
+func (t transformerFunc) Name() string { return t.name }
+func (t transformerFunc) Transform(tc *TransformContext, bodyBytes []byte) []byte {
+	return t.fn(tc, bodyBytes)
+}
+
+// TransformContext identifies the request a transformer runs for
+// Transformers include RequestID/UserID in their own log entries via logData
+type TransformContext struct {
+	RequestID string
+	UserID    string
+	Route     string // client-facing path, e.g. /v1/chat/completions
+	Model     string
+}
+
+// TransformerConfig enables or disables one transformer
+// Rules are checked in order and the first match wins; Enabled is the fallback (default true)
+type TransformerConfig struct {
+	Enabled *bool                    `json:"enabled,omitempty"`
+	Rules   []TransformerMatchConfig `json:"rules,omitempty"`
+}
+
+// TransformerMatchConfig matches a route and/or model ("*" is a wildcard, empty matches anything)
+type TransformerMatchConfig struct {
+	Route   string `json:"route,omitempty"`
+	Model   string `json:"model,omitempty"`
+	Enabled bool   `json:"enabled"`
+}
+
+// TransformReport records which transformers ran for a request and what they changed
+type TransformReport struct {
+	Ran     []string            `json:"ran"`
+	Skipped []string            `json:"skipped,omitempty"`
+	Changed map[string][]string `json:"changed,omitempty"` // transformer -> changed JSON paths
+}
+
+// TransformerRegistry runs the transformers of one stage
+// The compiled-in transformers are fixed; the custom ones from TRANSFORMERS_CONFIG and the
+// enable rules are part of the runtime state (see transformerSetup and reload.go)
+type TransformerRegistry struct {
+	stage   string // "request" or "response"
+	builtin []Transformer
+}
+
+func newTransformerRegistry(stage string, transformers ...Transformer) *TransformerRegistry {
+	return &TransformerRegistry{stage: stage, builtin: transformers}
+}
+
+// requestTransformers run in order on every request body before it is sent upstream
+var requestTransformers = newTransformerRegistry("request",
+	// Roo/Cline sends "parametersJsonSchema" but Gemini expects "parameters"
+	transformerFunc{"fix_tool_definitions", fixToolDefinitions},
+	// systemInstruction should not have role: "user"; thinkingLevel -> thinkingBudget
+	transformerFunc{"fix_system_instruction", fixSystemInstruction},
+)
+
+// responseTransformers run in order on every complete response object (see transformers.go)
+var responseTransformers = newTransformerRegistry("response",
+	transformerFunc{"fix_missing_candidate_parts", fixMissingCandidateParts},
+)
+
+// active returns the transformers (built-in first, then custom) and enable rules currently in effect
+func (reg *TransformerRegistry) active() ([]Transformer, map[string]TransformerConfig) {
+	setup := currentState().transformers
+	if reg.stage == "response" {
+		return setup.response, setup.responseConfigs
+	}
+	return setup.request, setup.requestConfigs
+}
+
+// Names returns the registered transformer names in order
+func (reg *TransformerRegistry) Names() []string {
+	transformers, _ := reg.active()
+	return transformerNames(transformers)
+}
+
+// builtinNames returns the names of the compiled-in transformers
+func (reg *TransformerRegistry) builtinNames() []string {
+	return transformerNames(reg.builtin)
+}
+
+func transformerNames(transformers []Transformer) []string {
+	names := make([]string, 0, len(transformers))
+	for _, t := range transformers {
+		names = append(names, t.Name())
+	}
+	return names
+}
+
+// anyEnabled reports whether at least one transformer would run for the request
+func (reg *TransformerRegistry) anyEnabled(tc *TransformContext) bool {
+	transformers, configs := reg.active()
+	for _, t := range transformers {
+		if transformerEnabled(configs[t.Name()], tc) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply runs every enabled transformer in order and reports what happened
+func (reg *TransformerRegistry) Apply(tc *TransformContext, bodyBytes []byte) ([]byte, *TransformReport) {
+	// transformers and rules come from the same runtime state, so a reload can't mix them
+	transformers, configs := reg.active()
+
+	report := &TransformReport{Ran: []string{}}
+	for _, t := range transformers {
+		if !transformerEnabled(configs[t.Name()], tc) {
+			report.Skipped = append(report.Skipped, t.Name())
+			continue
+		}
+		before := bodyBytes
+		bodyBytes = t.Transform(tc, bodyBytes)
+		report.Ran = append(report.Ran, t.Name())
+		if len(before) == len(bodyBytes) && string(before) == string(bodyBytes) {
+			continue
+		}
+		metricTransformerFired.inc(reg.stage, t.Name())
+		if report.Changed == nil {
+			report.Changed = make(map[string][]string)
+		}
+		report.Changed[t.Name()] = jsonChangedPaths(before, bodyBytes)
+	}
+	return bodyBytes, report
+}
+
+// applyRequestTransformers runs the request registry and logs which transformers ran
+func applyRequestTransformers(ctx context.Context, tc *TransformContext, bodyBytes []byte) []byte {
+	if len(bodyBytes) == 0 {
+		return bodyBytes
+	}
+	_, span := startSpan(ctx, "transform")
+	defer span.end()
+	bodyBytes, report := requestTransformers.Apply(tc, bodyBytes)
+
+	level := "DEBUG"
+	if len(report.Changed) > 0 {
+		level = "INFO"
+	}
+	changed := make([]string, 0, len(report.Changed))
+	for name := range report.Changed {
+		changed = append(changed, name)
+	}
+	sort.Strings(changed)
+	span.setAttr("transformers.ran", strings.Join(report.Ran, ","))
+	span.setAttr("transformers.changed", strings.Join(changed, ","))
+	addLog(level, fmt.Sprintf("[TRANSFORMERS %s] ran: %s; changed: %s", tc.RequestID, strings.Join(report.Ran, ", "), strings.Join(changed, ", ")), map[string]interface{}{
+		"request_id": tc.RequestID,
+		"user_id":    tc.UserID,
+		"route":      tc.Route,
+		"model":      tc.Model,
+		"ran":        report.Ran,
+		"skipped":    report.Skipped,
+		"changes":    report.Changed,
+	})
+	return bodyBytes
+}
+
+// logData adds the request and user IDs to a transformer's log entry data
+func (tc *TransformContext) logData(data map[string]interface{}) map[string]interface{} {
+	data["request_id"] = tc.RequestID
+	data["user_id"] = tc.UserID
+	return data
+}
+
+// transformerEnabled evaluates a transformer's rules for the given request
+func transformerEnabled(cfg TransformerConfig, tc *TransformContext) bool {
+	for _, rule := range cfg.Rules {
+		if wildcardMatch(rule.Route, tc.Route) && wildcardMatch(rule.Model, tc.Model) {
+			return rule.Enabled
+		}
+	}
+	if cfg.Enabled != nil {
+		return *cfg.Enabled
+	}
+	return true
+}
+
+// wildcardMatch matches s against a pattern where "*" matches any sequence; an empty pattern matches anything
+func wildcardMatch(pattern, s string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// modelFromPath extracts the model name from a Gemini path like /v1beta/models/{model}:generateContent
+func modelFromPath(path string) string {
+	i := strings.Index(path, "/models/")
+	if i < 0 {
+		return ""
+	}
+	model := path[i+len("/models/"):]
+	if j := strings.IndexAny(model, ":/?"); j >= 0 {
+		model = model[:j]
+	}
+	return model
+}
+
+// jsonChangedPaths lists the JSON paths that differ between two bodies (capped to keep logs small)
+func jsonChangedPaths(before, after []byte) []string {
+	var a, b interface{}
+	if json.Unmarshal(before, &a) != nil || json.Unmarshal(after, &b) != nil {
+		return []string{"(body changed)"}
+	}
+	paths := make([]string, 0)
+	diffJSON(a, b, "", &paths)
+	return paths
+}
+
+const maxChangedPaths = 50
+
+func diffJSON(a, b interface{}, path string, out *[]string) {
+	if len(*out) >= maxChangedPaths {
+		return
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			childPath := k
+			if path != "" {
+				childPath = path + "." + k
+			}
+			aChild, inA := av[k]
+			bChild, inB := bv[k]
+			switch {
+			case !inB:
+				*out = append(*out, childPath+" (removed)")
+			case !inA:
+				*out = append(*out, childPath+" (added)")
+			default:
+				diffJSON(aChild, bChild, childPath, out)
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			break
+		}
+		for i := range av {
+			diffJSON(av[i], bv[i], fmt.Sprintf("%s[%d]", path, i), out)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*out = append(*out, path+" (changed)")
+	}
+}
+
+// --- Configuration ---
+
+// transformerFileConfig is the JSON file pointed to by TRANSFORMERS_CONFIG
+type transformerFileConfig struct {
+	// Transformers enables/disables transformers (built-in or custom) by name
+	Transformers map[string]TransformerConfig `json:"transformers"`
+	// CustomTransformers are appended after the built-in ones, in order
+	CustomTransformers []fieldTransformerConfig `json:"custom_transformers"`
+}
+
+// transformerSetup is a validated TRANSFORMERS_CONFIG, part of the runtime state (see reload.go)
+// Each stage gets only the enable rules for its own transformers
+type transformerSetup struct {
+	request         []Transformer // built-in then custom request transformers, in order
+	response        []Transformer // built-in then custom response transformers, in order
+	requestConfigs  map[string]TransformerConfig
+	responseConfigs map[string]TransformerConfig
+}
+
+// parseTransformerConfig reads and validates a JSON file without touching the active transformers
+// An empty path yields the built-in transformers with no rules
+func parseTransformerConfig(path string) (*transformerSetup, error) {
+	setup := &transformerSetup{
+		request:         append([]Transformer{}, requestTransformers.builtin...),
+		response:        append([]Transformer{}, responseTransformers.builtin...),
+		requestConfigs:  make(map[string]TransformerConfig),
+		responseConfigs: make(map[string]TransformerConfig),
+	}
+	if path == "" {
+		return setup, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg transformerFileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	// names must be unique across both registries: the "transformers" section is keyed by name alone
+	stageOf := make(map[string]string) // transformer name -> stage
+	for _, reg := range []*TransformerRegistry{requestTransformers, responseTransformers} {
+		for _, name := range reg.builtinNames() {
+			stageOf[name] = reg.stage
+		}
+	}
+	for i, custom := range cfg.CustomTransformers {
+		t, err := newFieldTransformer(custom)
+		if err != nil {
+			return nil, fmt.Errorf("custom_transformers[%d]: %w", i, err)
+		}
+		stage := "request"
+		if custom.Stage == "response" {
+			stage = "response"
+		}
+		if existing, ok := stageOf[t.Name()]; ok {
+			return nil, fmt.Errorf("custom_transformers[%d]: %q is already registered as a %s transformer", i, t.Name(), existing)
+		}
+		stageOf[t.Name()] = stage
+		if stage == "response" {
+			setup.response = append(setup.response, t)
+		} else {
+			setup.request = append(setup.request, t)
+		}
+	}
+
+	for name, c := range cfg.Transformers {
+		switch stageOf[name] {
+		case "request":
+			setup.requestConfigs[name] = c
+		case "response":
+			setup.responseConfigs[name] = c
+		default:
+			return nil, fmt.Errorf("transformers.%s: unknown transformer", name)
+		}
+	}
+	return setup, nil
+}
+
+// fieldTransformerConfig declares a custom transformer that removes or sets fields by dotted path
+type fieldTransformerConfig struct {
+	Name   string                 `json:"name"`
+	Stage  string                 `json:"stage"` // request (default) or response
+	Remove []string               `json:"remove,omitempty"`
+	Set    map[string]interface{} `json:"set,omitempty"`
+}
+
+// fieldTransformer implements fieldTransformerConfig
+type fieldTransformer struct {
+	cfg fieldTransformerConfig
+}
+
+func newFieldTransformer(cfg fieldTransformerConfig) (*fieldTransformer, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if cfg.Stage != "" && cfg.Stage != "request" && cfg.Stage != "response" {
+		return nil, fmt.Errorf("stage must be \"request\" or \"response\", got %q", cfg.Stage)
+	}
+	if len(cfg.Remove) == 0 && len(cfg.Set) == 0 {
+		return nil, fmt.Errorf("%s: at least one of remove or set is required", cfg.Name)
+	}
+	return &fieldTransformer{cfg: cfg}, nil
+}
+
+func (t *fieldTransformer) Name() string { return t.cfg.Name }
+
+func (t *fieldTransformer) Transform(tc *TransformContext, bodyBytes []byte) []byte {
+	var body map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return bodyBytes
+	}
+
+	modified := false
+	for _, path := range t.cfg.Remove {
+		keys := strings.Split(path, ".")
+		parent := walkJSONObject(body, keys[:len(keys)-1], false)
+		if parent == nil {
+			continue
+		}
+		if _, ok := parent[keys[len(keys)-1]]; ok {
+			delete(parent, keys[len(keys)-1])
+			modified = true
+		}
+	}
+	for path, value := range t.cfg.Set {
+		keys := strings.Split(path, ".")
+		parent := walkJSONObject(body, keys[:len(keys)-1], true)
+		if parent == nil {
+			continue
+		}
+		if !reflect.DeepEqual(parent[keys[len(keys)-1]], value) {
+			parent[keys[len(keys)-1]] = value
+			modified = true
+		}
+	}
+
+	if !modified {
+		return bodyBytes
+	}
+	fixedBody, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Error marshaling after %s: %v", t.cfg.Name, err)
+		return bodyBytes
+	}
+	return fixedBody
+}
+
+// walkJSONObject follows keys through nested objects, optionally creating missing ones
+func walkJSONObject(obj map[string]interface{}, keys []string, create bool) map[string]interface{} {
+	for _, key := range keys {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			if !create {
+				return nil
+			}
+			if _, exists := obj[key]; exists {
+				return nil // not an object, don't clobber it
+			}
+			next = make(map[string]interface{})
+			obj[key] = next
+		}
+		obj = next
+	}
+	return obj
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTransformerConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "transformers.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseTransformerConfigSplitsConfigsByStage(t *testing.T) {
+	setup, err := parseTransformerConfig(writeTransformerConfig(t, `{
+		"transformers": {
+			"fix_system_instruction": {"enabled": false},
+			"fix_missing_candidate_parts": {"enabled": false},
+			"strip_usage": {"enabled": true}
+		},
+		"custom_transformers": [
+			{"name": "strip_usage", "stage": "response", "remove": ["usageMetadata"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := setup.requestConfigs["fix_system_instruction"]; !ok || len(setup.requestConfigs) != 1 {
+		t.Fatalf("requestConfigs = %v", setup.requestConfigs)
+	}
+	if len(setup.responseConfigs) != 2 || setup.responseConfigs["strip_usage"].Enabled == nil {
+		t.Fatalf("responseConfigs = %v", setup.responseConfigs)
+	}
+	if got := transformerNames(setup.request); !reflect.DeepEqual(got, []string{"fix_tool_definitions", "fix_system_instruction"}) {
+		t.Fatalf("request transformers = %v", got)
+	}
+	if got := transformerNames(setup.response); !reflect.DeepEqual(got, []string{"fix_missing_candidate_parts", "strip_usage"}) {
+		t.Fatalf("response transformers = %v", got)
+	}
+}
+
+func TestParseTransformerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"duplicate within a stage", `{"custom_transformers": [
+			{"name": "a", "remove": ["x"]}, {"name": "a", "remove": ["y"]}]}`, `"a" is already registered as a request transformer`},
+		{"duplicate across stages", `{"custom_transformers": [
+			{"name": "a", "stage": "request", "remove": ["x"]}, {"name": "a", "stage": "response", "remove": ["y"]}]}`, `"a" is already registered as a request transformer`},
+		{"custom shadows a builtin of the other stage", `{"custom_transformers": [
+			{"name": "fix_missing_candidate_parts", "stage": "request", "remove": ["x"]}]}`, "already registered as a response transformer"},
+		{"unknown transformer", `{"transformers": {"nope": {"enabled": false}}}`, "transformers.nope: unknown transformer"},
+		{"bad stage", `{"custom_transformers": [{"name": "a", "stage": "both", "remove": ["x"]}]}`, "stage must be"},
+		{"no action", `{"custom_transformers": [{"name": "a"}]}`, "at least one of remove or set is required"},
+		{"invalid JSON", `{`, "parse "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTransformerConfig(writeTransformerConfig(t, tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseTransformerConfig() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
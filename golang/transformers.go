@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 )
 
+// thinkingBudgetForLevel returns the thinkingBudget for a level, defaulting to high
+// The table is transformers.thinking_budgets in the config file (see config.go)
+func thinkingBudgetForLevel(level string) int {
+	thinkingBudgets := currentConfig().Transformers.ThinkingBudgets
+	if budget, ok := thinkingBudgets[level]; ok {
+		return budget
+	}
+	return thinkingBudgets["high"]
+}
+
 // cleanParameters recursively removes unsupported fields from JSON Schema
 // Based on Gemini API documentation, the following OpenAPI 3.0 schema attributes are NOT supported:
 // - additionalProperties
@@ -85,7 +97,7 @@ func cleanParameters(params map[string]interface{}, context string) (bool, map[s
 
 // fixSystemInstruction removes the incorrect "role" field from systemInstruction
 // Roo/Cline sends systemInstruction with role:"user" which causes 400 errors
-func fixSystemInstruction(bodyBytes []byte) []byte {
+func fixSystemInstruction(tc *TransformContext, bodyBytes []byte) []byte {
 	var requestBody map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
 		return bodyBytes
@@ -100,10 +112,10 @@ func fixSystemInstruction(bodyBytes []byte) []byte {
 			delete(sysInst, "role")
 			logMsg := "[SYSTEM_INSTRUCTION_FIX] Removed invalid 'role' field from systemInstruction"
 			log.Println(logMsg)
-			addLog("WARN", logMsg, map[string]interface{}{
+			addLog("WARN", logMsg, tc.logData(map[string]interface{}{
 				"removed_field": "role",
 				"removed_value": roleValue,
-			})
+			}))
 			modified = true
 		}
 	}
@@ -113,29 +125,18 @@ func fixSystemInstruction(bodyBytes []byte) []byte {
 		if thinkingCfg, ok := genConfig["thinkingConfig"].(map[string]interface{}); ok {
 			if level, hasLevel := thinkingCfg["thinkingLevel"].(string); hasLevel {
 				// Convert thinkingLevel to thinkingBudget
-				// Based on working example: high = 26240 tokens
-				var budget int
-				switch level {
-				case "high":
-					budget = 26240
-				case "medium":
-					budget = 13120
-				case "low":
-					budget = 6560
-				default:
-					budget = 26240 // default to high
-				}
+				budget := thinkingBudgetForLevel(level)
 
 				thinkingCfg["thinkingBudget"] = budget
 				delete(thinkingCfg, "thinkingLevel")
 				logMsg := fmt.Sprintf("[THINKING_CONFIG_FIX] Converted thinkingLevel '%s' to thinkingBudget %d", level, budget)
 				log.Println(logMsg)
-				addLog("INFO", logMsg, map[string]interface{}{
+				addLog("INFO", logMsg, tc.logData(map[string]interface{}{
 					"original_field":  "thinkingLevel",
 					"original_value":  level,
 					"converted_field": "thinkingBudget",
 					"converted_value": budget,
-				})
+				}))
 				modified = true
 			}
 		}
@@ -157,7 +158,7 @@ func fixSystemInstruction(bodyBytes []byte) []byte {
 // fixToolDefinitions transforms tool definitions from Roo/Cline format to Gemini API format
 // Roo/Cline sends "parametersJsonSchema" but Gemini API expects "parameters"
 // Also converts "functionDeclarations" (camelCase) to "function_declarations" (snake_case)
-func fixToolDefinitions(bodyBytes []byte) []byte {
+func fixToolDefinitions(tc *TransformContext, bodyBytes []byte) []byte {
 	var requestBody map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
 		// If we can't parse it, return original body
@@ -275,12 +276,216 @@ func fixToolDefinitions(bodyBytes []byte) []byte {
 	// Log comprehensive transformation summary to web UI
 	logMsg := fmt.Sprintf("[TOOL FIX] Transformed %d tool definitions for Gemini API compatibility", toolCount)
 	log.Println(logMsg)
-	addLog("INFO", logMsg, map[string]interface{}{
+	addLog("INFO", logMsg, tc.logData(map[string]interface{}{
 		"total_tools":               toolCount,
 		"total_removed_fields":      len(totalRemovedFields),
 		"transformations":           transformations,
 		"all_removed_fields_detail": totalRemovedFields,
-	})
+	}))
+
+	return fixedBody
+}
+
+// --- Response transformers ---
+// Applied to every complete Gemini response object before it is written to the client:
+// an http_response body or a single SSE event of a stream.
+
+// transformResponseBody applies the enabled response transformers to one response object
+// The transformers log their own changes; a per-event summary would flood the log for streams
+func transformResponseBody(tc *TransformContext, bodyBytes []byte) []byte {
+	bodyBytes, _ = responseTransformers.Apply(tc, bodyBytes)
+	return bodyBytes
+}
+
+// fixMissingCandidateParts adds an empty "content.parts" array to candidates that lack one
+// Gemini omits content/parts when generation stops early (MAX_TOKENS, SAFETY, ...),
+// and clients like Roo/Cline crash reading candidates[0].content.parts
+func fixMissingCandidateParts(tc *TransformContext, bodyBytes []byte) []byte {
+	var responseBody map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &responseBody); err != nil {
+		return bodyBytes
+	}
+
+	candidates, ok := responseBody["candidates"].([]interface{})
+	if !ok || len(candidates) == 0 {
+		return bodyBytes
+	}
+
+	fixed := make([]map[string]interface{}, 0)
+	for i, candidate := range candidates {
+		candMap, ok := candidate.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		content, ok := candMap["content"].(map[string]interface{})
+		if !ok {
+			content = map[string]interface{}{"role": "model"}
+			candMap["content"] = content
+		}
+		if _, ok := content["parts"].([]interface{}); ok {
+			continue
+		}
+		content["parts"] = []interface{}{}
+		fixed = append(fixed, map[string]interface{}{
+			"candidate_index": i,
+			"finish_reason":   candMap["finishReason"],
+		})
+	}
 
+	if len(fixed) == 0 {
+		return bodyBytes
+	}
+
+	fixedBody, err := json.Marshal(responseBody)
+	if err != nil {
+		log.Printf("Error marshaling after response fixes: %v", err)
+		return bodyBytes
+	}
+
+	logMsg := fmt.Sprintf("[RESPONSE FIX] Added empty content.parts to %d candidate(s)", len(fixed))
+	log.Println(logMsg)
+	addLog("INFO", logMsg, tc.logData(map[string]interface{}{
+		"fixed_candidates": fixed,
+	}))
 	return fixedBody
 }
+
+// responseTransformerStream feeds a response body through the response transformers
+// - text/event-stream: each complete SSE event is transformed as soon as it arrives
+// - application/json http_response: the whole body is transformed once it arrives
+// - anything else, error statuses, or no response transformer enabled for the request: passed through untouched
+//
+// A streamed application/json body (streamGenerateContent without alt=sse) is a JSON array sent
+// piece by piece; it is passed through so every chunk reaches the client as soon as it arrives.
+//
+// In sse/json mode the body length may change, so the caller must drop the upstream Content-Length (see transforms)
+type responseTransformerStream struct {
+	tc   *TransformContext
+	mode string // "sse", "json", "passthrough"
+	buf  []byte
+}
+
+// newResponseTransformerStream picks the mode from the stream_start (streamed) or http_response payload
+func newResponseTransformerStream(tc *TransformContext, payload map[string]interface{}, streamed bool) *responseTransformerStream {
+	rt := &responseTransformerStream{tc: tc, mode: "passthrough"}
+	if payload == nil {
+		return rt
+	}
+	if status, ok := payload["status"].(float64); ok && status >= 400 {
+		return rt
+	}
+	// nothing to run: don't buffer a json response just to hand it back unchanged
+	if !responseTransformers.anyEnabled(tc) {
+		return rt
+	}
+	contentType := payloadHeader(payload, "Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "text/event-stream"):
+		rt.mode = "sse"
+	case strings.HasPrefix(contentType, "application/json") && !streamed:
+		rt.mode = "json"
+	}
+	return rt
+}
+
+// transforms reports whether the body may be rewritten (and its length change)
+func (rt *responseTransformerStream) transforms() bool {
+	return rt.mode != "passthrough"
+}
+
+// write accepts a chunk and returns the bytes that are ready to be sent to the client
+func (rt *responseTransformerStream) write(data []byte) []byte {
+	switch rt.mode {
+	case "json":
+		rt.buf = append(rt.buf, data...)
+		return nil
+	case "sse":
+		rt.buf = append(rt.buf, data...)
+		var out []byte
+		for {
+			end, next := sseEventEnd(rt.buf)
+			if end < 0 {
+				break
+			}
+			out = append(out, transformSSEEvent(rt.tc, rt.buf[:end], rt.buf[end:next])...)
+			rt.buf = rt.buf[next:]
+		}
+		return out
+	}
+	return data
+}
+
+// flush returns whatever is still buffered when the stream ends
+func (rt *responseTransformerStream) flush() []byte {
+	rest := rt.buf
+	rt.buf = nil
+	if len(rest) == 0 {
+		return nil
+	}
+	switch rt.mode {
+	case "json":
+		return transformResponseBody(rt.tc, rest)
+	case "sse":
+		return transformSSEEvent(rt.tc, rest, nil)
+	}
+	return rest
+}
+
+// sseEventEnd finds the first blank line in buf; it returns the end of the event
+// and the start of the next one, or -1 if no complete event is buffered
+func sseEventEnd(buf []byte) (int, int) {
+	lineStart := 0
+	for lineStart < len(buf) {
+		i := bytes.IndexByte(buf[lineStart:], '\n')
+		if i < 0 {
+			return -1, -1
+		}
+		line := bytes.TrimRight(buf[lineStart:lineStart+i], "\r")
+		if len(line) == 0 && lineStart > 0 {
+			return lineStart, lineStart + i + 1
+		}
+		lineStart += i + 1
+	}
+	return -1, -1
+}
+
+// transformSSEEvent transforms the data of one SSE event; the event is re-encoded
+// only if a transformer changed it, otherwise the original bytes are returned
+func transformSSEEvent(tc *TransformContext, event, terminator []byte) []byte {
+	var data [][]byte
+	lines := bytes.Split(bytes.TrimRight(event, "\r\n"), []byte("\n"))
+	for _, line := range lines {
+		line = bytes.TrimRight(line, "\r")
+		if d, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(d, []byte(" ")))
+		}
+	}
+	original := append(append([]byte{}, event...), terminator...)
+	if len(data) == 0 {
+		return original
+	}
+
+	joined := bytes.Join(data, []byte("\n"))
+	transformed := transformResponseBody(tc, joined)
+	if bytes.Equal(transformed, joined) {
+		return original
+	}
+
+	// Gemini terminates SSE lines with CRLF; keep the same style
+	eol := "\n"
+	if bytes.Contains(event, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	var out bytes.Buffer
+	for _, line := range lines {
+		line = bytes.TrimRight(line, "\r")
+		if !bytes.HasPrefix(line, []byte("data:")) && len(line) > 0 {
+			out.Write(line)
+			out.WriteString(eol)
+		}
+	}
+	out.WriteString("data: ")
+	out.Write(transformed)
+	out.WriteString(eol + eol)
+	return out.Bytes()
+}
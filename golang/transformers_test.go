@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResponseTransformerStreamMode(t *testing.T) {
+	disabled := false
+	tc := &TransformContext{Route: "/v1beta/models/gemini-2.5-pro:generateContent", Model: "gemini-2.5-pro"}
+	payload := func(status float64, contentType string) map[string]interface{} {
+		return map[string]interface{}{
+			"status":  status,
+			"headers": map[string]interface{}{"Content-Type": contentType, "Content-Length": "42"},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		configs  map[string]TransformerConfig
+		payload  map[string]interface{}
+		streamed bool
+		wantMode string
+	}{
+		{"json", nil, payload(200, "application/json; charset=UTF-8"), false, "json"},
+		{"streamed json", nil, payload(200, "application/json; charset=UTF-8"), true, "passthrough"},
+		{"sse", nil, payload(200, "text/event-stream"), true, "sse"},
+		{"other content type", nil, payload(200, "text/plain"), false, "passthrough"},
+		{"error status", nil, payload(500, "application/json"), false, "passthrough"},
+		{"no payload", nil, nil, true, "passthrough"},
+		{"all response transformers disabled", map[string]TransformerConfig{"fix_missing_candidate_parts": {Enabled: &disabled}}, payload(200, "application/json"), false, "passthrough"},
+		{"disabled for this model only", map[string]TransformerConfig{"fix_missing_candidate_parts": {Rules: []TransformerMatchConfig{{Model: "gemini-2.5-*", Enabled: false}}}}, payload(200, "text/event-stream"), true, "passthrough"},
+		{"rule for another model", map[string]TransformerConfig{"fix_missing_candidate_parts": {Rules: []TransformerMatchConfig{{Model: "gemini-1.5-*", Enabled: false}}}}, payload(200, "text/event-stream"), true, "sse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRuntimeState(t, func(state *runtimeState) {
+				setup := *state.transformers
+				setup.responseConfigs = tt.configs
+				state.transformers = &setup
+			})
+
+			rt := newResponseTransformerStream(tc, tt.payload, tt.streamed)
+			if rt.mode != tt.wantMode {
+				t.Fatalf("mode = %q, want %q", rt.mode, tt.wantMode)
+			}
+			if rt.transforms() != (tt.wantMode != "passthrough") {
+				t.Fatalf("transforms() = %v for mode %q", rt.transforms(), rt.mode)
+			}
+		})
+	}
+}
+
+// streamGenerateContent without alt=sse streams a JSON array; every chunk must reach the client as it arrives
+func TestResponseTransformerStreamJSONArray(t *testing.T) {
+	tc := &TransformContext{Route: "/v1beta/models/gemini-2.5-pro:streamGenerateContent", Model: "gemini-2.5-pro"}
+	rt := newResponseTransformerStream(tc, map[string]interface{}{
+		"status":  float64(200),
+		"headers": map[string]interface{}{"Content-Type": "application/json; charset=UTF-8"},
+	}, true)
+
+	chunks := []string{
+		`[{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hel"}]}}]}`,
+		"\r\n,",
+		`{"candidates": [{"content": {"role": "model"}, "finishReason": "STOP"}]}`,
+		"\r\n]",
+	}
+	var got strings.Builder
+	for i, chunk := range chunks {
+		out := rt.write([]byte(chunk))
+		if string(out) != chunk {
+			t.Fatalf("chunk %d: write returned %q, want %q", i, out, chunk)
+		}
+		got.Write(out)
+	}
+	if rest := rt.flush(); len(rest) != 0 {
+		t.Fatalf("flush returned %q, want nothing", rest)
+	}
+	if got.String() != strings.Join(chunks, "") {
+		t.Fatalf("body = %q", got.String())
+	}
+}
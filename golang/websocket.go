@@ -3,29 +3,33 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Constants for WebSocket
-const (
-	wsReadTimeout = 60 * time.Second
-)
-
 // WSMessage 是前后端之间通信的基本结构
 type WSMessage struct {
 	ID      string                 `json:"id"`      // 请求/响应的唯一ID
-	Type    string                 `json:"type"`    // ping, pong, http_request, http_response, stream_start, stream_chunk, stream_end, error
+	Type    string                 `json:"type"`    // hello, ping, pong, http_request, cancel, credit, http_response, stream_start, stream_chunk, stream_end, error
 	Payload map[string]interface{} `json:"payload"` // 具体数据
 }
 
+// 请求/响应体（http_request/http_response 的 body、stream_chunk 的 data）的编码，
+// 由同一 payload 中的 "encoding" 字段指明；缺省为 utf8，即原样的字符串
+const (
+	bodyEncodingUTF8   = "utf8"
+	bodyEncodingBase64 = "base64" // 非 UTF-8 的二进制数据
+)
+
 // pendingRequests 存储待处理的HTTP请求，等待WS响应
-// key: reqID (string), value: chan *WSMessage
+// key: reqID (string), value: *pendingRequest
 var pendingRequests sync.Map
 
 var upgrader = websocket.Upgrader{
@@ -52,8 +56,30 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 添加到连接池
-	userConn := globalPool.AddConnection(userID, conn)
+	// 添加到连接池，weight 参数用于 weighted 负载均衡策略
+	weight := 1
+	if v := r.URL.Query().Get("weight"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			weight = n
+		} else {
+			log.Printf("Ignoring invalid weight %q for user %s", v, userID)
+		}
+	}
+
+	// 握手通过后才加入连接池（见 handshake.go）
+	client, err := performHandshake(conn)
+	if err != nil {
+		rejectHandshake(conn, userID, err)
+		return
+	}
+	userConn := globalPool.AddConnection(userID, conn, weight, client)
+	logMsg := fmt.Sprintf("[HANDSHAKE] Browser connected for user %s: protocol v%d, build %q, account %q", userID, client.ProtocolVersion, client.ClientBuild, client.AccountLabel)
+	log.Println(logMsg)
+	addLog("INFO", logMsg, map[string]interface{}{
+		"user_id":    userID,
+		"connection": conn.RemoteAddr().String(),
+		"client":     client,
+	})
 
 	// 启动读取循环
 	go readPump(userConn)
@@ -64,11 +90,18 @@ func readPump(uc *UserConnection) {
 	defer func() {
 		globalPool.RemoveConnection(uc.UserID, uc.Conn)
 		uc.Conn.Close()
+		failInFlightRequests(uc)
 		log.Printf("readPump closed for user %s", uc.UserID)
 	}()
 
-	// 设置读取超时 (心跳机制)
-	uc.Conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	// 设置读取超时 (心跳机制)，时长为 timeouts.ws_read
+	uc.Conn.SetReadDeadline(time.Now().Add(currentConfig().Timeouts.WSRead))
+	// 浏览器自动回复服务器发送的 ping 控制帧（见 reaper.go），pong 同样视为活跃
+	uc.Conn.SetPongHandler(func(string) error {
+		uc.touch()
+		uc.Conn.SetReadDeadline(time.Now().Add(currentConfig().Timeouts.WSRead))
+		return nil
+	})
 
 	for {
 		_, message, err := uc.Conn.ReadMessage()
@@ -83,8 +116,8 @@ func readPump(uc *UserConnection) {
 		}
 
 		// 收到任何消息，重置读取超时
-		uc.Conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
-		uc.LastActive = time.Now()
+		uc.Conn.SetReadDeadline(time.Now().Add(currentConfig().Timeouts.WSRead))
+		uc.touch()
 
 		// 解析消息
 		var msg WSMessage
@@ -106,15 +139,16 @@ func readPump(uc *UserConnection) {
 			// Full details are logged by the proxy handlers
 
 			// 路由响应到等待的HTTP Handler
-			if ch, ok := pendingRequests.Load(msg.ID); ok {
-				respChan := ch.(chan *WSMessage)
-				select {
-				case respChan <- &msg:
-					// Successfully routed - no need for verbose logging
-				default:
-					log.Printf("Warning: Response channel full for request ID %s, dropping message type %s", msg.ID, msg.Type)
+			// 通道满时的处理见 flowcontrol.go，请求结束时放弃投递
+			if p, ok := pendingRequests.Load(msg.ID); ok {
+				if reason := p.(*pendingRequest).deliver(&msg); reason != "" {
+					metricDroppedMessages.inc(msg.Type, reason)
 				}
+			} else if uc.wasCancelled(msg.ID) {
+				// 已取消的请求：浏览器中止 fetch 前发出的消息会陆续到达，直接丢弃
+				metricDroppedMessages.inc(msg.Type, "cancelled")
 			} else {
+				metricDroppedMessages.inc(msg.Type, "unknown_request")
 				log.Printf("Warning: Received response for unknown/timed-out request ID: %s", msg.ID)
 			}
 		default:
@@ -123,44 +157,100 @@ func readPump(uc *UserConnection) {
 	}
 }
 
-// validateJWT 模拟JWT验证并返回userID
+// failInFlightRequests 在连接断开后通知仍在此连接上等待响应的请求。
+// 错误消息排在已收到的响应之后，processWebSocketResponse 据此在响应头写出前换连接重试，
+// 或在流已开始时结束响应，而不必等到 timeouts.request。
+func failInFlightRequests(uc *UserConnection) {
+	ids := uc.markClosed()
+	if len(ids) == 0 {
+		return
+	}
+
+	logMsg := fmt.Sprintf("[CONNECTION LOST] Browser connection for user %s closed with %d in-flight request(s)", uc.UserID, len(ids))
+	log.Println(logMsg)
+	addLog("WARN", logMsg, map[string]interface{}{
+		"user_id":     uc.UserID,
+		"connection":  uc.Conn.RemoteAddr().String(),
+		"request_ids": ids,
+	})
+
+	for _, id := range ids {
+		p, ok := pendingRequests.Load(id)
+		if !ok {
+			continue
+		}
+		msg := &WSMessage{
+			ID:   id,
+			Type: "error",
+			Payload: map[string]interface{}{
+				"code":   "CONNECTION_LOST",
+				"error":  "Bad Gateway: Browser connection closed",
+				"status": float64(http.StatusBadGateway),
+			},
+		}
+		// 通道可能已满，异步投递以免一个慢请求阻塞其他请求
+		go p.(*pendingRequest).deliver(msg)
+	}
+}
+
+// validateJWT 验证浏览器连接携带的 auth_token 并返回userID（配置见 jwt.go）
 func validateJWT(token string) (string, error) {
 	if token == "" {
 		return "", errors.New("missing auth_token")
 	}
-	// 实际应用中，这里需要使用JWT库（如golang-jwt/jwt）来验证签名和过期时间
-	// 这里我们简单地将token当作userID
-	if token == "valid-token-user-1" {
+	// 验证器和 allow_legacy_token 取自同一份运行时状态（见 reload.go）
+	state := currentState()
+	if validator := state.jwtValidator; validator != nil {
+		userID, err := validator.validate(token)
+		if err != nil {
+			return "", fmt.Errorf("invalid token: %w", err)
+		}
+		return userID, nil
+	}
+	// 未配置 JWT 密钥时，只有显式开启 auth.allow_legacy_token 才兼容旧的固定 token
+	if !state.config.Auth.AllowLegacyToken {
+		return "", errors.New("JWT validation is not configured")
+	}
+	if token == legacyAuthToken {
 		return "user-1", nil
 	}
-	//if token == "valid-token-user-2" {
-	//	return "user-2", nil
-	//}
 	return "", errors.New("invalid token")
 }
 
-// authenticateHTTPRequest 模拟HTTP代理请求的认证
-func authenticateHTTPRequest(r *http.Request) (string, error) {
-	// 实际应用中，可能检查Authorization头或其他API Key
+// authenticateHTTPRequest 认证HTTP代理请求，返回API Key对应的用户（见 apikeys.go）
+func authenticateHTTPRequest(r *http.Request) (*APIKey, error) {
+	_, span := startSpan(r.Context(), "auth")
+	defer span.end()
+
 	apiKey := r.Header.Get("x-goog-api-key")
 	if apiKey == "" {
 		// r.URL.Query() 会解析URL中的查询参数，返回一个 map[string][]string
 		// .Get() 方法可以方便地获取指定参数的第一个值，如果参数不存在则返回空字符串
 		apiKey = r.URL.Query().Get("key")
 	}
-
-	// 从环境变量中获取预期的API密钥
-	expectedAPIKey := os.Getenv("AUTH_API_KEY")
-	if expectedAPIKey == "" {
-		log.Println("CRITICAL: AUTH_API_KEY environment variable not set.")
-		// 在生产环境中，您可能希望完全阻止请求
-		return "", errors.New("server configuration error")
+	if apiKey == "" {
+		// Anthropic 兼容客户端使用 "x-api-key"
+		apiKey = r.Header.Get("x-api-key")
 	}
-
-	if apiKey == expectedAPIKey {
-		// 单租户
-		return "user-1", nil
+	if apiKey == "" {
+		// OpenAI 兼容客户端使用 "Authorization: Bearer <key>"
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			apiKey = strings.TrimPrefix(auth, "Bearer ")
+		}
 	}
 
-	return "", errors.New("invalid API key")
+	key, err := currentState().apiKeys.Lookup(apiKey)
+	if err != nil {
+		if errors.Is(err, errAPIKeyNoConfig) {
+			log.Println("CRITICAL: no API keys configured (AUTH_API_KEY / API_KEYS_FILE).")
+		}
+		if errors.Is(err, errAPIKeyDisabled) {
+			log.Printf("Rejected request with disabled API key for user %s (%s)", key.UserID, key.Label)
+		}
+		span.setError(err.Error())
+		return nil, err
+	}
+	span.setAttr("proxy.user_id", key.UserID)
+	span.setAttr("proxy.key_label", key.Label)
+	return key, nil
 }
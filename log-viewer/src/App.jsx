@@ -21,6 +21,7 @@ import {
 import "./App.css";
 
 const API_BASE = "";
+const MAX_LOGS = 1000;
 
 function App() {
   const [logs, setLogs] = useState([]);
@@ -37,13 +38,17 @@ function App() {
     logsEndRef.current?.scrollIntoView({ behavior: "smooth" });
   };
 
+  // Returns the id of the newest entry so the live stream can continue from it
   const fetchLogs = async () => {
     try {
       const response = await fetch(`${API_BASE}/api/logs`);
       const data = await response.json();
-      setLogs(data.logs || []);
+      const entries = data.logs || [];
+      setLogs(entries);
+      return entries.length ? entries[entries.length - 1].id : 0;
     } catch (error) {
       console.error("Failed to fetch logs:", error);
+      return 0;
     }
   };
 
@@ -58,16 +63,38 @@ function App() {
   };
 
   useEffect(() => {
-    fetchLogs();
+    let source = null;
+    let cancelled = false;
+
     fetchHealth();
+    fetchLogs().then((lastId) => {
+      if (cancelled || !autoRefresh) return;
+      // New entries are pushed by the server; on reconnect EventSource sends
+      // Last-Event-ID and the server replays what was missed.
+      source = new EventSource(
+        `${API_BASE}/api/logs/stream?since_id=${lastId}`,
+      );
+      source.addEventListener("log", (event) => {
+        const entry = JSON.parse(event.data);
+        setLogs((prev) =>
+          prev.length && prev[prev.length - 1].id >= entry.id
+            ? prev
+            : [...prev, entry].slice(-MAX_LOGS),
+        );
+      });
+    });
 
     if (autoRefresh) {
-      const interval = setInterval(() => {
-        fetchLogs();
-        fetchHealth();
-      }, 2000);
-      return () => clearInterval(interval);
+      const interval = setInterval(fetchHealth, 2000);
+      return () => {
+        cancelled = true;
+        source?.close();
+        clearInterval(interval);
+      };
     }
+    return () => {
+      cancelled = true;
+    };
   }, [autoRefresh]);
 
   useEffect(() => {
@@ -295,7 +322,7 @@ function App() {
           ) : (
             filteredLogs.map((log, index) => (
               <div
-                key={index}
+                key={log.id ?? index}
                 className={getLevelClass(log.level)}
                 onClick={() => setSelectedLog(log)}
               >
@@ -431,6 +458,17 @@ function App() {
                 </div>
               )}
 
+              {selectedLog.data && selectedLog.data.user_id && (
+                <div className="detail-section">
+                  <label>User:</label>
+                  <div className="detail-value mono">
+                    {selectedLog.data.user_id}
+                    {selectedLog.data.key_label &&
+                      ` (${selectedLog.data.key_label})`}
+                  </div>
+                </div>
+              )}
+
               {selectedLog.data && selectedLog.data.url && (
                 <div className="detail-section">
                   <div className="detail-label-row">